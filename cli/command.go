@@ -1,20 +1,33 @@
 package cli
 
 import (
+	"bufio"
 	"context"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"sort"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/golang/glog"
 	cli "github.com/jawher/mow.cli"
 	freenasProvisioner "github.com/travisghansen/freenas-iscsi-provisioner/provisioner"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
+	"sigs.k8s.io/yaml"
 )
 
 const (
@@ -39,6 +52,32 @@ var (
 	controllerRetryPeriod                 *int
 	controllerTermLimit                   *int
 	controllerMetricsPort                 *int
+
+	// orphan collection
+	orphanGCInterval    *string
+	orphanGCGracePeriod *string
+	orphanGCDryRun      *bool
+
+	// preflight checks
+	preflightInterval *string
+
+	// initiator group synchronisation
+	initiatorSyncInterval  *string
+	initiatorIQNKey        *string
+	attachmentSyncInterval *string
+	discoveryAuthInterval  *string
+
+	// drift detection
+	driftCheckInterval *string
+	driftRepair        *bool
+
+	// capacity publishing
+	capacityPublishInterval *string
+	capacityConfigMap       *string
+
+	// usage collection
+	usageInterval    *string
+	usageAnnotations *bool
 )
 
 // Process all command line parameters
@@ -116,29 +155,407 @@ func Process(appName, appDesc, appVersion string) {
 		EnvVar: "CONTROLLER_METRICS_PORT",
 	})
 
+	orphanGCInterval = app.String(cli.StringOpt{
+		Name:   "orphan-gc-interval",
+		Value:  "0",
+		Desc:   "interval between orphaned FreeNAS resource scans (e.g. 1h), 0 disables",
+		EnvVar: "ORPHAN_GC_INTERVAL",
+	})
+
+	orphanGCGracePeriod = app.String(cli.StringOpt{
+		Name:   "orphan-gc-grace-period",
+		Value:  "30m",
+		Desc:   "how long a resource must remain orphaned before it is deleted",
+		EnvVar: "ORPHAN_GC_GRACE_PERIOD",
+	})
+
+	orphanGCDryRun = app.Bool(cli.BoolOpt{
+		Name:   "orphan-gc-dry-run",
+		Value:  true,
+		Desc:   "only report orphaned FreeNAS resources, never delete them",
+		EnvVar: "ORPHAN_GC_DRY_RUN",
+	})
+
+	preflightInterval = app.String(cli.StringOpt{
+		Name:   "preflight-interval",
+		Value:  "0",
+		Desc:   "interval between preflight checks of the FreeNAS iscsi configuration (e.g. 15m), 0 only checks on startup",
+		EnvVar: "PREFLIGHT_INTERVAL",
+	})
+
+	initiatorSyncInterval = app.String(cli.StringOpt{
+		Name:   "initiator-sync-interval",
+		Value:  "0",
+		Desc:   "interval between full syncs of node initiators into initiator groups (e.g. 10m), node changes sync immediately, 0 disables",
+		EnvVar: "INITIATOR_SYNC_INTERVAL",
+	})
+
+	initiatorIQNKey = app.String(cli.StringOpt{
+		Name:   "initiator-iqn-key",
+		Value:  "freenas.org/initiator-iqn",
+		Desc:   "node annotation (or label) holding the initiator name of the node",
+		EnvVar: "INITIATOR_IQN_KEY",
+	})
+
+	attachmentSyncInterval = app.String(cli.StringOpt{
+		Name:   "attachment-sync-interval",
+		Value:  "0",
+		Desc:   "interval between full syncs of per volume initiator groups with the nodes using the volumes (e.g. 10m), changes sync immediately, 0 disables",
+		EnvVar: "ATTACHMENT_SYNC_INTERVAL",
+	})
+
+	discoveryAuthInterval = app.String(cli.StringOpt{
+		Name:   "discovery-auth-interval",
+		Value:  "0",
+		Desc:   "interval between syncs of portal discovery auth with the CHAP secret of StorageClasses with targetDiscoveryCHAPManage (e.g. 1m), 0 disables",
+		EnvVar: "DISCOVERY_AUTH_INTERVAL",
+	})
+
+	driftCheckInterval = app.String(cli.StringOpt{
+		Name:   "drift-check-interval",
+		Value:  "0",
+		Desc:   "interval between checks of PV annotations against FreeNAS (e.g. 10m), 0 disables",
+		EnvVar: "DRIFT_CHECK_INTERVAL",
+	})
+
+	driftRepair = app.Bool(cli.BoolOpt{
+		Name:   "drift-repair",
+		Value:  false,
+		Desc:   "recreate missing target, targetgroup, extent and lun mapping for intact zvols",
+		EnvVar: "DRIFT_REPAIR",
+	})
+
+	capacityPublishInterval = app.String(cli.StringOpt{
+		Name:   "capacity-publish-interval",
+		Value:  "0",
+		Desc:   "interval between publishing the capacity of each StorageClass (e.g. 5m), 0 disables",
+		EnvVar: "CAPACITY_PUBLISH_INTERVAL",
+	})
+
+	capacityConfigMap = app.String(cli.StringOpt{
+		Name:   "capacity-configmap",
+		Value:  "kube-system/freenas-iscsi-provisioner-capacity",
+		Desc:   "ConfigMap (namespace/name) capacity is published to, empty only publishes metrics",
+		EnvVar: "CAPACITY_CONFIGMAP",
+	})
+
+	usageInterval = app.String(cli.StringOpt{
+		Name:   "usage-interval",
+		Value:  "0",
+		Desc:   "interval between collecting the zvol usage of each PV (e.g. 5m), 0 disables",
+		EnvVar: "USAGE_INTERVAL",
+	})
+
+	usageAnnotations = app.Bool(cli.BoolOpt{
+		Name:   "usage-annotations",
+		Value:  false,
+		Desc:   "also record the zvol usage as PV annotations",
+		EnvVar: "USAGE_ANNOTATIONS",
+	})
+
+	app.Command("gc", "Find (and optionally delete) orphaned FreeNAS resources once", cmdGC)
+	app.Command("import", "Import an existing zvol as a statically provisioned PV", cmdImport)
+	app.Command("repair", "Recover missing PV annotations by looking resources up by name", cmdRepair)
+	app.Command("chap-rotate", "Rotate the CHAP session credentials of secrets and their auth groups in two phases", cmdCHAPRotate)
+	app.Command("lint", "Check StorageClass and Secret manifests offline", cmdLint)
+	app.Command("webhook", "Serve the validating admission webhook for StorageClasses and claims", cmdWebhook)
+
 	app.Action = execute
 	app.Run(os.Args)
 }
 
-func execute() {
-	var err error
-	var config *rest.Config
+func cmdGC(cmd *cli.Cmd) {
+	gracePeriod := cmd.String(cli.StringOpt{
+		Name:  "grace-period",
+		Value: "0",
+		Desc:  "re-scan after this duration and only act on resources orphaned in both scans",
+	})
+	dryRun := cmd.Bool(cli.BoolOpt{
+		Name:  "dry-run",
+		Value: true,
+		Desc:  "only report orphaned resources, never delete them",
+	})
 
-	/* Params checking */
-	var msgs []string
-	if *identifier == "" {
-		msgs = append(msgs, "Identifier parameter must be specified")
+	cmd.Action = func() {
+		grace, err := time.ParseDuration(*gracePeriod)
+		if err != nil {
+			glog.Fatalf("Invalid grace period: %v", err)
+		}
+
+		clientset := getClientset()
+		ctx := context.Background()
+		collector := freenasProvisioner.NewOrphanCollector(clientset, *provisionerName, grace, *dryRun)
+
+		orphans, err := collector.Collect(ctx)
+		if err != nil {
+			glog.Fatalf("Failed to collect orphans: %v", err)
+		}
+
+		if grace > 0 && len(orphans) > 0 {
+			glog.Infof("found %d orphan(s), re-scanning in %s", len(orphans), grace)
+			time.Sleep(grace)
+			orphans, err = collector.Collect(ctx)
+			if err != nil {
+				glog.Fatalf("Failed to collect orphans: %v", err)
+			}
+		}
+
+		for _, orphan := range orphans {
+			status := "orphaned"
+			if orphan.Deleted {
+				status = "deleted"
+			}
+			fmt.Printf("%s\t%s\t%s\n", status, orphan.Kind, orphan)
+		}
 	}
+}
 
-	// Print all parameters' error and exist if need be
-	if len(msgs) > 0 {
-		fmt.Fprintf(os.Stderr, "The following error(s) occured:\n")
-		for _, m := range msgs {
-			fmt.Fprintf(os.Stderr, "  - %s\n", m)
+func cmdImport(cmd *cli.Cmd) {
+	cmd.Spec = "--storage-class --zvol [OPTIONS]"
+
+	storageClass := cmd.String(cli.StringOpt{
+		Name: "storage-class",
+		Desc: "StorageClass whose parameters are used for the target, targetgroup and extent",
+	})
+	zvol := cmd.String(cli.StringOpt{
+		Name: "zvol",
+		Desc: "full path of the zvol including the pool (e.g. tank/k8s/legacy-volume)",
+	})
+	secretNamespace := cmd.String(cli.StringOpt{
+		Name: "secret-namespace",
+		Desc: "namespace of the server secret (default: from StorageClass)",
+	})
+	secretName := cmd.String(cli.StringOpt{
+		Name: "secret-name",
+		Desc: "name of the server secret (default: from StorageClass)",
+	})
+	pvName := cmd.String(cli.StringOpt{
+		Name: "pv-name",
+		Desc: "name of the PV (default: last component of the zvol path, sanitized)",
+	})
+	claimNamespace := cmd.String(cli.StringOpt{
+		Name:  "claim-namespace",
+		Value: "default",
+		Desc:  "namespace of the claim to pre-bind the PV to",
+	})
+	claimName := cmd.String(cli.StringOpt{
+		Name: "claim-name",
+		Desc: "name of the claim to pre-bind the PV to",
+	})
+	accessModes := cmd.Strings(cli.StringsOpt{
+		Name:  "access-mode",
+		Value: []string{string(v1.ReadWriteOnce)},
+		Desc:  "access mode(s) of the PV",
+	})
+	block := cmd.Bool(cli.BoolOpt{
+		Name: "block",
+		Desc: "use volumeMode Block",
+	})
+	configureAccess := cmd.Bool(cli.BoolOpt{
+		Name: "configure-access",
+		Desc: "apply the targetgroup, initiator group and CHAP settings of the StorageClass to an existing target",
+	})
+	apply := cmd.Bool(cli.BoolOpt{
+		Name: "apply",
+		Desc: "create the PV instead of printing it",
+	})
+
+	cmd.Action = func() {
+		clientset := getClientset()
+		ctx := context.Background()
+
+		options := freenasProvisioner.ImportOptions{
+			ProvisionerName:       *provisionerName,
+			Identifier:            *identifier,
+			StorageClassName:      *storageClass,
+			ServerSecretNamespace: *secretNamespace,
+			ServerSecretName:      *secretName,
+			Zvol:                  *zvol,
+			PVName:                *pvName,
+			ClaimNamespace:        *claimNamespace,
+			ClaimName:             *claimName,
+			ConfigureAccess:       *configureAccess,
 		}
-		os.Exit(1)
+		for _, mode := range *accessModes {
+			options.AccessModes = append(options.AccessModes, v1.PersistentVolumeAccessMode(mode))
+		}
+		if *block {
+			mode := v1.PersistentVolumeBlock
+			options.VolumeMode = &mode
+		}
+
+		pv, err := freenasProvisioner.ImportVolume(ctx, clientset, options)
+		if err != nil {
+			glog.Fatalf("Failed to import zvol: %v", err)
+		}
+
+		if *apply {
+			pv, err = clientset.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{})
+			if err != nil {
+				glog.Fatalf("Failed to create PV: %v", err)
+			}
+			fmt.Printf("persistentvolume/%s created\n", pv.Name)
+			return
+		}
+
+		pv.TypeMeta = metav1.TypeMeta{Kind: "PersistentVolume", APIVersion: "v1"}
+		out, err := yaml.Marshal(pv)
+		if err != nil {
+			glog.Fatalf("Failed to marshal PV: %v", err)
+		}
+		fmt.Printf("---\n%s", out)
 	}
-	/* End params checking */
+}
+
+func cmdRepair(cmd *cli.Cmd) {
+	cmd.Spec = "[--dry-run] PV..."
+
+	dryRun := cmd.Bool(cli.BoolOpt{
+		Name: "dry-run",
+		Desc: "only print the recovered annotations",
+	})
+	volumes := cmd.Strings(cli.StringsArg{
+		Name: "PV",
+		Desc: "name(s) of the PersistentVolume(s) to repair",
+	})
+
+	cmd.Action = func() {
+		clientset := getClientset()
+		ctx := context.Background()
+
+		failed := false
+		for _, name := range *volumes {
+			recovered, err := freenasProvisioner.RepairVolume(ctx, clientset, *identifier, name, *dryRun)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+				failed = true
+				continue
+			}
+			if len(recovered) < 1 {
+				fmt.Printf("%s: nothing to recover\n", name)
+				continue
+			}
+
+			keys := make([]string, 0, len(recovered))
+			for k := range recovered {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Printf("%s: %s=%s\n", name, k, recovered[k])
+			}
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	}
+}
+
+func cmdCHAPRotate(cmd *cli.Cmd) {
+	cmd.Spec = "[--finish [--force]] [--dry-run] [--storage-class...] [PV...]"
+
+	finish := cmd.Bool(cli.BoolOpt{
+		Name: "finish",
+		Desc: "remove the previous credentials of rotations in progress",
+	})
+	force := cmd.Bool(cli.BoolOpt{
+		Name: "force",
+		Desc: "finish even though volumes are still logged in with the previous credentials",
+	})
+	dryRun := cmd.Bool(cli.BoolOpt{
+		Name: "dry-run",
+		Desc: "only list the secrets, their auth groups and the volumes needing a re-login",
+	})
+	classes := cmd.Strings(cli.StringsOpt{
+		Name: "storage-class",
+		Desc: "only secrets used by volumes of these StorageClass(es)",
+	})
+	volumes := cmd.Strings(cli.StringsArg{
+		Name: "PV",
+		Desc: "only secrets used by these PersistentVolume(s)",
+	})
+
+	cmd.Action = func() {
+		clientset := getClientset()
+		ctx := context.Background()
+		rotator := freenasProvisioner.NewCHAPRotator(clientset, *provisionerName)
+
+		groups, err := rotator.Groups(ctx)
+		if err != nil {
+			glog.Fatalf("Failed to list CHAP secrets: %v", err)
+		}
+
+		selected := func(group *freenasProvisioner.CHAPGroup) bool {
+			if len(*classes) < 1 && len(*volumes) < 1 {
+				return true
+			}
+			for _, class := range *classes {
+				for _, name := range group.StorageClasses {
+					if name == class {
+						return true
+					}
+				}
+			}
+			for _, volume := range *volumes {
+				for _, name := range group.Volumes {
+					if name == volume {
+						return true
+					}
+				}
+			}
+			return false
+		}
+
+		failed := false
+		for _, group := range groups {
+			if !selected(group) {
+				continue
+			}
+
+			var uses []freenasProvisioner.CHAPVolumeUse
+			switch {
+			case *dryRun:
+				state := "in use"
+				if group.RotationStarted != nil {
+					state = fmt.Sprintf("rotation started %s, previous user %s", group.RotationStarted.Format(time.RFC3339), group.PreviousUser)
+				}
+				fmt.Printf("%s: %s, %d volume(s)\n", group, state, len(group.Volumes))
+				for _, authGroup := range group.AuthGroups {
+					fmt.Printf("  %s\n", authGroup)
+				}
+				uses, err = rotator.InUse(ctx, group)
+			case *finish:
+				uses, err = rotator.Finish(ctx, group, *force)
+				if err == nil {
+					fmt.Printf("%s: previous credentials removed\n", group)
+				}
+			default:
+				err = rotator.Start(ctx, group)
+				if err == nil {
+					fmt.Printf("%s: rotated, previous user %s stays valid until --finish\n", group, group.PreviousUser)
+					uses, err = rotator.InUse(ctx, group)
+				}
+			}
+
+			for _, use := range uses {
+				fmt.Printf("  re-login needed: %s\n", use)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				failed = true
+			}
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	}
+}
+
+func getClientset() *kubernetes.Clientset {
+	var err error
+	var config *rest.Config
 
 	if *kubeconfig != "" {
 		// use the current context in kubeconfig
@@ -157,6 +574,73 @@ func execute() {
 		glog.Fatalf("Failed to create client: %v", err)
 	}
 
+	return clientset
+}
+
+func execute() {
+	/* Params checking */
+	var msgs []string
+	if *identifier == "" {
+		msgs = append(msgs, "Identifier parameter must be specified")
+	}
+	gcInterval, err := time.ParseDuration(*orphanGCInterval)
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("Invalid orphan-gc-interval: %v", err))
+	}
+	gcGracePeriod, err := time.ParseDuration(*orphanGCGracePeriod)
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("Invalid orphan-gc-grace-period: %v", err))
+	}
+	preflightCheckInterval, err := time.ParseDuration(*preflightInterval)
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("Invalid preflight-interval: %v", err))
+	}
+	initiatorInterval, err := time.ParseDuration(*initiatorSyncInterval)
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("Invalid initiator-sync-interval: %v", err))
+	}
+	attachmentInterval, err := time.ParseDuration(*attachmentSyncInterval)
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("Invalid attachment-sync-interval: %v", err))
+	}
+	discoveryInterval, err := time.ParseDuration(*discoveryAuthInterval)
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("Invalid discovery-auth-interval: %v", err))
+	}
+	driftInterval, err := time.ParseDuration(*driftCheckInterval)
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("Invalid drift-check-interval: %v", err))
+	}
+	capacityInterval, err := time.ParseDuration(*capacityPublishInterval)
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("Invalid capacity-publish-interval: %v", err))
+	}
+	usageCollectionInterval, err := time.ParseDuration(*usageInterval)
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("Invalid usage-interval: %v", err))
+	}
+	var capacityConfigMapNamespace, capacityConfigMapName string
+	if len(*capacityConfigMap) > 0 {
+		parts := strings.SplitN(*capacityConfigMap, "/", 2)
+		if len(parts) != 2 || len(parts[0]) < 1 || len(parts[1]) < 1 {
+			msgs = append(msgs, "capacity-configmap must be given as namespace/name")
+		} else {
+			capacityConfigMapNamespace, capacityConfigMapName = parts[0], parts[1]
+		}
+	}
+
+	// Print all parameters' error and exist if need be
+	if len(msgs) > 0 {
+		fmt.Fprintf(os.Stderr, "The following error(s) occured:\n")
+		for _, m := range msgs {
+			fmt.Fprintf(os.Stderr, "  - %s\n", m)
+		}
+		os.Exit(1)
+	}
+	/* End params checking */
+
+	clientset := getClientset()
+
 	// The controller needs to know what the server version is because out-of-tree
 	// provisioners aren't officially supported until 1.5
 	serverVersion, err := clientset.Discovery().ServerVersion()
@@ -167,6 +651,7 @@ func execute() {
 	clientFreenasProvisioner := freenasProvisioner.New(
 		clientset,
 		*identifier,
+		attachmentInterval > 0,
 	)
 
 	pc := controller.NewProvisionController(
@@ -182,5 +667,289 @@ func execute() {
 		controller.MetricsPort(int32(*controllerMetricsPort)),
 	)
 
-	pc.Run(context.Background())
+	ctx := context.Background()
+
+	leaderElection := freenasProvisioner.LeaderElection{
+		LeaseDuration: time.Duration(*controllerLeaseDuration) * time.Second,
+		RenewDeadline: time.Duration(*controllerRenewDeadline) * time.Second,
+		RetryPeriod:   time.Duration(*controllerRetryPeriod) * time.Second,
+	}
+
+	checker := freenasProvisioner.NewPreflightChecker(clientset, *provisionerName)
+	if preflightCheckInterval > 0 {
+		go checker.Run(ctx, preflightCheckInterval)
+	} else {
+		// an unreachable server must not hold up the controller
+		go func() {
+			_, err := checker.Check(ctx)
+			if err != nil {
+				glog.Errorf("preflight check failed: %v", err)
+			}
+		}()
+	}
+
+	if gcInterval > 0 {
+		collector := freenasProvisioner.NewOrphanCollector(clientset, *provisionerName, gcGracePeriod, *orphanGCDryRun)
+		// every replica runs the collector, only the one holding the lock scans
+		go leaderElection.RunLeading(ctx, clientset, *provisionerName+"-orphan-gc", func(ctx context.Context) {
+			collector.Run(ctx, gcInterval)
+		})
+	}
+
+	if initiatorInterval > 0 {
+		initiatorSync := freenasProvisioner.NewInitiatorSync(clientset, *provisionerName, *initiatorIQNKey)
+		go leaderElection.RunLeading(ctx, clientset, *provisionerName+"-initiator-sync", func(ctx context.Context) {
+			initiatorSync.Run(ctx, initiatorInterval)
+		})
+	}
+
+	if attachmentInterval > 0 {
+		attachmentSync := freenasProvisioner.NewAttachmentSync(clientset, *provisionerName, *initiatorIQNKey)
+		go leaderElection.RunLeading(ctx, clientset, *provisionerName+"-attachment-sync", func(ctx context.Context) {
+			attachmentSync.Run(ctx, attachmentInterval)
+		})
+	}
+
+	if discoveryInterval > 0 {
+		discoveryAuthSync := freenasProvisioner.NewDiscoveryAuthSync(clientset, *provisionerName)
+		go leaderElection.RunLeading(ctx, clientset, *provisionerName+"-discovery-auth", func(ctx context.Context) {
+			discoveryAuthSync.Run(ctx, discoveryInterval)
+		})
+	}
+
+	if driftInterval > 0 {
+		detector := freenasProvisioner.NewDriftDetector(clientset, *provisionerName, *driftRepair)
+		go leaderElection.RunLeading(ctx, clientset, *provisionerName+"-drift", func(ctx context.Context) {
+			detector.Run(ctx, driftInterval)
+		})
+	}
+
+	if capacityInterval > 0 {
+		publisher := freenasProvisioner.NewCapacityPublisher(clientset, *provisionerName, capacityConfigMapNamespace, capacityConfigMapName)
+		go leaderElection.RunLeading(ctx, clientset, *provisionerName+"-capacity", func(ctx context.Context) {
+			publisher.Run(ctx, capacityInterval)
+		})
+	}
+
+	if usageCollectionInterval > 0 {
+		usageCollector := freenasProvisioner.NewUsageCollector(clientset, *provisionerName, *usageAnnotations)
+		go leaderElection.RunLeading(ctx, clientset, *provisionerName+"-usage", func(ctx context.Context) {
+			usageCollector.Run(ctx, usageCollectionInterval)
+		})
+	}
+
+	pc.Run(ctx)
+}
+
+func cmdWebhook(cmd *cli.Cmd) {
+	cmd.Spec = "[--listen] [--tls-cert-file] [--tls-key-file] [-f...] [REVIEW...]"
+
+	listen := cmd.String(cli.StringOpt{
+		Name:   "listen",
+		Value:  ":8443",
+		Desc:   "address to serve the webhook on",
+		EnvVar: "WEBHOOK_LISTEN",
+	})
+	certFile := cmd.String(cli.StringOpt{
+		Name:   "tls-cert-file",
+		Value:  "/etc/webhook/certs/tls.crt",
+		Desc:   "TLS certificate",
+		EnvVar: "WEBHOOK_TLS_CERT_FILE",
+	})
+	keyFile := cmd.String(cli.StringOpt{
+		Name:   "tls-key-file",
+		Value:  "/etc/webhook/certs/tls.key",
+		Desc:   "TLS private key",
+		EnvVar: "WEBHOOK_TLS_KEY_FILE",
+	})
+	classFiles := cmd.Strings(cli.StringsOpt{
+		Name: "f storage-class-file",
+		Desc: "StorageClass manifest(s) claims are validated against when reviewing offline",
+	})
+	reviews := cmd.Strings(cli.StringsArg{
+		Name: "REVIEW",
+		Desc: "answer AdmissionReview file(s) offline and exit instead of serving",
+	})
+
+	cmd.Action = func() {
+		ctx := context.Background()
+
+		if len(*reviews) > 0 {
+			os.Exit(reviewOffline(ctx, *reviews, *classFiles))
+		}
+
+		validator := freenasProvisioner.NewAdmissionValidator(getClientset(), *provisionerName)
+		mux := http.NewServeMux()
+		mux.Handle("/validate", validator)
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+
+		glog.Infof("serving admission webhook on %s", *listen)
+		server := &http.Server{
+			Addr:    *listen,
+			Handler: mux,
+		}
+		glog.Fatal(server.ListenAndServeTLS(*certFile, *keyFile))
+	}
+}
+
+// reviewOffline answers AdmissionReview files using the given StorageClass
+// manifests, the responses are printed and 1 is returned if any is denied
+func reviewOffline(ctx context.Context, reviews, classFiles []string) int {
+	classes := map[string]*storagev1.StorageClass{}
+	for _, path := range classFiles {
+		documents, err := readManifests(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 2
+		}
+		for _, document := range documents {
+			class := &storagev1.StorageClass{}
+			err = yaml.Unmarshal(document, class)
+			if err != nil || class.Kind != "StorageClass" {
+				continue
+			}
+			classes[class.Name] = class
+		}
+	}
+
+	validator := freenasProvisioner.NewAdmissionValidator(nil, *provisionerName)
+	validator.GetStorageClass = func(ctx context.Context, name string) (*storagev1.StorageClass, error) {
+		class, ok := classes[name]
+		if !ok {
+			return nil, apierrors.NewNotFound(storagev1.Resource("storageclasses"), name)
+		}
+		return class, nil
+	}
+
+	status := 0
+	for _, path := range reviews {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 2
+		}
+		review := &admissionv1.AdmissionReview{}
+		err = yaml.Unmarshal(data, review)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 2
+		}
+
+		response := validator.Review(ctx, review).Response
+		if response.Allowed {
+			fmt.Printf("%s: allowed\n", path)
+			continue
+		}
+		fmt.Printf("%s: denied: %s\n", path, response.Result.Message)
+		status = 1
+	}
+
+	return status
+}
+
+// readManifests reads all YAML (or JSON) documents of a file
+func readManifests(path string) ([][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var documents [][]byte
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(file))
+	for {
+		document, err := reader.Read()
+		if err == io.EOF {
+			return documents, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(strings.TrimSpace(string(document))) > 0 {
+			documents = append(documents, document)
+		}
+	}
+}
+
+func cmdLint(cmd *cli.Cmd) {
+	cmd.Spec = "-f..."
+
+	files := cmd.Strings(cli.StringsOpt{
+		Name: "f file",
+		Desc: "StorageClass and Secret manifest(s) to check",
+	})
+
+	cmd.Action = func() {
+		type manifest struct {
+			path  string
+			class *storagev1.StorageClass
+		}
+
+		var classes []manifest
+		secrets := map[string]*v1.Secret{}
+		for _, path := range *files {
+			documents, err := readManifests(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+				os.Exit(2)
+			}
+			for _, document := range documents {
+				meta := metav1.TypeMeta{}
+				err = yaml.Unmarshal(document, &meta)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+					os.Exit(2)
+				}
+
+				switch meta.Kind {
+				case "StorageClass":
+					class := &storagev1.StorageClass{}
+					err = yaml.Unmarshal(document, class)
+					if err == nil && class.Provisioner == *provisionerName {
+						classes = append(classes, manifest{path: path, class: class})
+					}
+				case "Secret":
+					secret := &v1.Secret{}
+					err = yaml.Unmarshal(document, secret)
+					if err == nil {
+						namespace := secret.Namespace
+						if len(namespace) < 1 {
+							namespace = metav1.NamespaceDefault
+						}
+						secrets[namespace+"/"+secret.Name] = secret
+					}
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+					os.Exit(2)
+				}
+			}
+		}
+
+		if len(classes) < 1 {
+			fmt.Fprintf(os.Stderr, "no StorageClass using provisioner %s found\n", *provisionerName)
+			os.Exit(2)
+		}
+
+		failed := false
+		for _, m := range classes {
+			findings := freenasProvisioner.LintStorageClass(m.class, secrets)
+			if len(findings) < 1 {
+				fmt.Printf("%s: StorageClass/%s: ok\n", m.path, m.class.Name)
+				continue
+			}
+			for _, finding := range findings {
+				fmt.Printf("%s: StorageClass/%s: %s: %s\n", m.path, m.class.Name, finding.Severity, finding.Message)
+				if finding.Severity == freenasProvisioner.LintError {
+					failed = true
+				}
+			}
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	}
 }
@@ -1,6 +1,7 @@
 package freenas
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -16,7 +17,7 @@ var (
 // AuthCredential represents an ISCSI credential
 type AuthCredential struct {
 	ID         int    `json:"id,omitempty"`
-	Tag        int    `json:"tag,omitempty"`
+	Tag        int    `json:"iscsi_target_auth_tag,omitempty"`
 	User       string `json:"iscsi_target_auth_user,omitempty"`
 	Secret     string `json:"iscsi_target_auth_secret,omitempty"`
 	Peeruser   string `json:"iscsi_target_auth_peeruser,omitempty"`
@@ -53,6 +54,27 @@ func (a *AuthCredential) Get(server *Server) (*http.Response, error) {
 	return resp, nil
 }
 
+// ListAuthCredentials lists all AuthCredential instances, targetgroups refer to
+// them by tag so several credentials may form one auth group
+func ListAuthCredentials(server *Server) ([]AuthCredential, *http.Response, error) {
+	endpoint := "/api/v1.0/services/iscsi/authcredential/?limit=1000"
+	var list []AuthCredential
+	var e interface{}
+	resp, err := server.getSlingConnection().Get(endpoint).Receive(&list, &e)
+
+	if err != nil {
+		glog.Warningln(err)
+		return nil, resp, err
+	}
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return nil, resp, fmt.Errorf("Error listing authcredentials - message: %v, status: %d", string(body), resp.StatusCode)
+	}
+
+	return list, resp, nil
+}
+
 // Create creates an AuthCredential instance
 func (a *AuthCredential) Create(server *Server) (*http.Response, error) {
 	endpoint := "/api/v1.0/services/iscsi/authcredential/"
@@ -73,6 +95,39 @@ func (a *AuthCredential) Create(server *Server) (*http.Response, error) {
 	return resp, nil
 }
 
+// Update updates the users and secrets of an AuthCredential instance
+func (a *AuthCredential) Update(server *Server) (*http.Response, error) {
+	endpoint := fmt.Sprintf("/api/v1.0/services/iscsi/authcredential/%d/", a.ID)
+	body := struct {
+		Tag        int    `json:"iscsi_target_auth_tag"`
+		User       string `json:"iscsi_target_auth_user"`
+		Secret     string `json:"iscsi_target_auth_secret"`
+		Peeruser   string `json:"iscsi_target_auth_peeruser"`
+		Peersecret string `json:"iscsi_target_auth_peersecret"`
+	}{
+		Tag:        a.Tag,
+		User:       a.User,
+		Secret:     a.Secret,
+		Peeruser:   a.Peeruser,
+		Peersecret: a.Peersecret,
+	}
+	var authCredential AuthCredential
+	resp, err := server.getSlingConnection().Put(endpoint).BodyJSON(body).Receive(&authCredential, nil)
+	if err != nil {
+		glog.Warningln(err)
+		return resp, err
+	}
+
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, fmt.Errorf("Error updating authcredential %d - message: %v, status: %d", a.ID, body, resp.StatusCode)
+	}
+
+	a.CopyFrom(&authCredential)
+
+	return resp, nil
+}
+
 // Delete deletes an AuthCredential instance
 func (a *AuthCredential) Delete(server *Server) (*http.Response, error) {
 	endpoint := fmt.Sprintf("/api/v1.0/services/iscsi/authcredential/%d/", a.ID)
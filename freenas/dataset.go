@@ -17,12 +17,15 @@ var (
 // Dataset represents an zfs dataset
 type Dataset struct {
 	Avail          int64  `json:"avail,omitempty"`
+	Compression    string `json:"compression,omitempty"`
 	Mountpoint     string `json:"mountpoint,omitempty"`
 	Name           string `json:"name"`
 	Pool           string `json:"pool"`
+	Quota          int64  `json:"quota,omitempty"`
 	Recordsize     int64  `json:"recordsize,omitempty"`
 	Refquota       int64  `json:"refquota,omitempty"`
 	Refreservation int64  `json:"refreservation,omitempty"`
+	Reservation    int64  `json:"reservation,omitempty"`
 	Refer          int64  `json:"refer,omitempty"`
 	Used           int64  `json:"used,omitempty"`
 	Comments       string `json:"comments,omitempty"`
@@ -37,12 +40,15 @@ func (d *Dataset) CopyFrom(source Resource) error {
 	src, ok := source.(*Dataset)
 	if ok {
 		d.Avail = src.Avail
+		d.Compression = src.Compression
 		d.Mountpoint = src.Mountpoint
 		d.Name = src.Name
 		d.Pool = src.Pool
+		d.Quota = src.Quota
 		d.Recordsize = src.Recordsize
 		d.Refquota = src.Refquota
 		d.Refreservation = src.Refreservation
+		d.Reservation = src.Reservation
 		d.Refer = src.Refer
 		d.Used = src.Used
 		d.Comments = src.Comments
@@ -100,6 +106,33 @@ func (d *Dataset) Create(server *Server) (*http.Response, error) {
 	return resp, nil
 }
 
+// Update updates the mutable properties of a Dataset instance
+func (d *Dataset) Update(server *Server) (*http.Response, error) {
+	endpoint := fmt.Sprintf("/api/v1.0/storage/dataset/%s/", d.Name)
+	body := struct {
+		Quota    int64  `json:"quota"`
+		Comments string `json:"comments,omitempty"`
+	}{
+		Quota:    d.Quota,
+		Comments: d.Comments,
+	}
+	var dataset Dataset
+	resp, err := server.getSlingConnection().Put(endpoint).BodyJSON(body).Receive(&dataset, nil)
+	if err != nil {
+		glog.Warningln(err)
+		return resp, err
+	}
+
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, fmt.Errorf("Error updating dataset \"%s\" - message: %v, status: %d", d.Name, body, resp.StatusCode)
+	}
+
+	d.CopyFrom(&dataset)
+
+	return resp, nil
+}
+
 // Delete deletes a Dataset instance
 func (d *Dataset) Delete(server *Server) (*http.Response, error) {
 	endpoint := fmt.Sprintf("/api/v1.0/storage/dataset/%s/", d.Name)
@@ -49,6 +49,7 @@ func (e *Extent) CopyFrom(source Resource) error {
 		e.Naa = src.Naa
 		e.Name = src.Name
 		e.Path = src.Path
+		e.Disk = src.Disk
 		e.Pblocksize = src.Pblocksize
 		e.Ro = src.Ro
 		e.Rpm = src.Rpm
@@ -78,19 +79,9 @@ func (e *Extent) Get(server *Server) (*http.Response, error) {
 
 	// find by name
 	if len(e.Name) > 0 {
-		endpoint := "/api/v1.0/services/iscsi/extent/?limit=1000"
-		var list []Extent
-		var es interface{}
-		resp, err := server.getSlingConnection().Get(endpoint).Receive(&list, &es)
-
+		list, resp, err := ListExtents(server)
 		if err != nil {
-			glog.Warningln(err)
-			return nil, err
-		}
-
-		if resp.StatusCode != 200 {
-			body, _ := json.Marshal(es)
-			return resp, fmt.Errorf("Error getting Extent \"%s\" - message: %v, status: %d", e.Name, string(body), resp.StatusCode)
+			return resp, err
 		}
 
 		for _, item := range list {
@@ -106,6 +97,26 @@ func (e *Extent) Get(server *Server) (*http.Response, error) {
 	return nil, errors.New("no Extent has been found")
 }
 
+// ListExtents lists all Extent instances
+func ListExtents(server *Server) ([]Extent, *http.Response, error) {
+	endpoint := "/api/v1.0/services/iscsi/extent/?limit=1000"
+	var list []Extent
+	var es interface{}
+	resp, err := server.getSlingConnection().Get(endpoint).Receive(&list, &es)
+
+	if err != nil {
+		glog.Warningln(err)
+		return nil, resp, err
+	}
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(es)
+		return nil, resp, fmt.Errorf("Error listing extents - message: %v, status: %d", string(body), resp.StatusCode)
+	}
+
+	return list, resp, nil
+}
+
 // Create creates an Extent instance
 func (e *Extent) Create(server *Server) (*http.Response, error) {
 	endpoint := "/api/v1.0/services/iscsi/extent/"
@@ -1,6 +1,7 @@
 package freenas
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -18,7 +19,7 @@ type Initiator struct {
 	ID          int    `json:"id,omitempty"`
 	Tag         int    `json:"iscsi_target_initiator_tag,omitempty"`
 	AuthNetwork string `json:"iscsi_target_initiator_auth_network,omitempty"`
-	Comment     string `json:"iscsi_target_Initiator_comment,omitempty"`
+	Comment     string `json:"iscsi_target_initiator_comment,omitempty"`
 	Initiators  string `json:"iscsi_target_initiator_initiators,omitempty"`
 }
 
@@ -51,6 +52,26 @@ func (i *Initiator) Get(server *Server) (*http.Response, error) {
 	return resp, nil
 }
 
+// ListInitiators lists all Initiator instances
+func ListInitiators(server *Server) ([]Initiator, *http.Response, error) {
+	endpoint := "/api/v1.0/services/iscsi/authorizedinitiator/?limit=1000"
+	var list []Initiator
+	var e interface{}
+	resp, err := server.getSlingConnection().Get(endpoint).Receive(&list, &e)
+
+	if err != nil {
+		glog.Warningln(err)
+		return nil, resp, err
+	}
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return nil, resp, fmt.Errorf("Error listing initiators - message: %v, status: %d", string(body), resp.StatusCode)
+	}
+
+	return list, resp, nil
+}
+
 // Create creates an Initiator instance
 func (i *Initiator) Create(server *Server) (*http.Response, error) {
 	endpoint := "/api/v1.0/services/iscsi/authorizedinitiator/"
@@ -71,6 +92,36 @@ func (i *Initiator) Create(server *Server) (*http.Response, error) {
 	return resp, nil
 }
 
+// Update updates the initiators, authorized networks and comment of an
+// Initiator instance
+func (i *Initiator) Update(server *Server) (*http.Response, error) {
+	endpoint := fmt.Sprintf("/api/v1.0/services/iscsi/authorizedinitiator/%d/", i.ID)
+	body := struct {
+		AuthNetwork string `json:"iscsi_target_initiator_auth_network"`
+		Comment     string `json:"iscsi_target_initiator_comment"`
+		Initiators  string `json:"iscsi_target_initiator_initiators"`
+	}{
+		AuthNetwork: i.AuthNetwork,
+		Comment:     i.Comment,
+		Initiators:  i.Initiators,
+	}
+	var initiator Initiator
+	resp, err := server.getSlingConnection().Put(endpoint).BodyJSON(body).Receive(&initiator, nil)
+	if err != nil {
+		glog.Warningln(err)
+		return resp, err
+	}
+
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, fmt.Errorf("Error updating initiator %d - message: %v, status: %d", i.ID, body, resp.StatusCode)
+	}
+
+	i.CopyFrom(&initiator)
+
+	return resp, nil
+}
+
 // Delete deletes an Initiator instance
 func (i *Initiator) Delete(server *Server) (*http.Response, error) {
 	endpoint := fmt.Sprintf("/api/v1.0/services/iscsi/authorizedinitiator/%d/", i.ID)
@@ -73,6 +73,33 @@ func (p *Portal) Create(server *Server) (*http.Response, error) {
 	return resp, nil
 }
 
+// Update updates the discovery authentication of a Portal instance
+func (p *Portal) Update(server *Server) (*http.Response, error) {
+	endpoint := fmt.Sprintf("/api/v1.0/services/iscsi/portal/%d/", p.ID)
+	body := struct {
+		Discoveryauthgroup  string `json:"iscsi_target_portal_discoveryauthgroup"`
+		Discoveryauthmethod string `json:"iscsi_target_portal_discoveryauthmethod"`
+	}{
+		Discoveryauthgroup:  p.Discoveryauthgroup,
+		Discoveryauthmethod: p.Discoveryauthmethod,
+	}
+	var portal Portal
+	resp, err := server.getSlingConnection().Put(endpoint).BodyJSON(body).Receive(&portal, nil)
+	if err != nil {
+		glog.Warningln(err)
+		return resp, err
+	}
+
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, fmt.Errorf("Error updating portal %d - message: %v, status: %d", p.ID, body, resp.StatusCode)
+	}
+
+	p.CopyFrom(&portal)
+
+	return resp, nil
+}
+
 // Delete deletes an Portal instance
 func (p *Portal) Delete(server *Server) (*http.Response, error) {
 	endpoint := fmt.Sprintf("/api/v1.0/services/iscsi/portal/%d/", p.ID)
@@ -8,6 +8,9 @@ import (
 	"github.com/dghubble/sling"
 )
 
+// APIVersion is the FreeNAS API version all resources are managed through
+const APIVersion = "v1.0"
+
 // Resource basic interface for http interactions with various FreeNAS resources
 type Resource interface {
 	CopyFrom(source Resource) error
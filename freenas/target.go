@@ -53,21 +53,11 @@ func (t *Target) Get(server *Server) (*http.Response, error) {
 
 	// find by name
 	if len(t.Name) > 0 {
-		endpoint := "/api/v1.0/services/iscsi/target/?limit=1000"
-		var list []Target
-		var e interface{}
-		resp, err := server.getSlingConnection().Get(endpoint).Receive(&list, &e)
-
+		list, resp, err := ListTargets(server)
 		if err != nil {
-			glog.Warningln(err)
 			return resp, err
 		}
 
-		if resp.StatusCode != 200 {
-			body, _ := json.Marshal(e)
-			return resp, fmt.Errorf("Error getting target \"%s\" - message: %v, status: %d", t.Name, string(body), resp.StatusCode)
-		}
-
 		for _, item := range list {
 			if item.Name == t.Name {
 				t.CopyFrom(&item)
@@ -81,6 +71,26 @@ func (t *Target) Get(server *Server) (*http.Response, error) {
 	return nil, errors.New("no Target has been found")
 }
 
+// ListTargets lists all Target instances
+func ListTargets(server *Server) ([]Target, *http.Response, error) {
+	endpoint := "/api/v1.0/services/iscsi/target/?limit=1000"
+	var list []Target
+	var e interface{}
+	resp, err := server.getSlingConnection().Get(endpoint).Receive(&list, &e)
+
+	if err != nil {
+		glog.Warningln(err)
+		return nil, resp, err
+	}
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return nil, resp, fmt.Errorf("Error listing targets - message: %v, status: %d", string(body), resp.StatusCode)
+	}
+
+	return list, resp, nil
+}
+
 // GetByName gets a Target instance
 func (t *Target) GetByName(server *Server) (*http.Response, error) {
 	endpoint := fmt.Sprintf("/api/v1.0/services/iscsi/target/%d/", t.ID)
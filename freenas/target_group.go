@@ -87,6 +87,26 @@ func (t *TargetGroup) Get(server *Server) (*http.Response, error) {
 	return nil, errors.New("no Target has been found")
 }
 
+// ListTargetGroups lists all TargetGroup instances
+func ListTargetGroups(server *Server) ([]TargetGroup, *http.Response, error) {
+	endpoint := "/api/v1.0/services/iscsi/targetgroup/?limit=1000"
+	var list []TargetGroup
+	var e interface{}
+	resp, err := server.getSlingConnection().Get(endpoint).Receive(&list, &e)
+
+	if err != nil {
+		glog.Warningln(err)
+		return nil, resp, err
+	}
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return nil, resp, fmt.Errorf("Error listing targetgroups - message: %v, status: %d", string(body), resp.StatusCode)
+	}
+
+	return list, resp, nil
+}
+
 // Create creates a TargetGroup instance
 func (t *TargetGroup) Create(server *Server) (*http.Response, error) {
 	endpoint := "/api/v1.0/services/iscsi/targetgroup/"
@@ -52,21 +52,11 @@ func (t *TargetToExtent) Get(server *Server) (*http.Response, error) {
 
 	// find target/extent/lun ID
 	if t.Extent > 0 && t.Target > 0 && *t.Lunid >= 0 {
-		endpoint := "/api/v1.0/services/iscsi/targettoextent/?limit=1000"
-		var list []TargetToExtent
-		var e interface{}
-		resp, err := server.getSlingConnection().Get(endpoint).Receive(&list, &e)
-
+		list, resp, err := ListTargetToExtents(server)
 		if err != nil {
-			glog.Warningln(err)
 			return resp, err
 		}
 
-		if resp.StatusCode != 200 {
-			body, _ := json.Marshal(e)
-			return resp, fmt.Errorf("Error getting TargetToExtent extent ID: %d, lunid ID: %d, target ID: %d - message: %v, status: %d", t.Extent, *t.Lunid, t.Target, string(body), resp.StatusCode)
-		}
-
 		for _, item := range list {
 			if item.Target == t.Target && item.Extent == t.Extent && *item.Lunid == *t.Lunid {
 				t.CopyFrom(&item)
@@ -80,6 +70,26 @@ func (t *TargetToExtent) Get(server *Server) (*http.Response, error) {
 	return nil, errors.New("no TargetToExtent has been found")
 }
 
+// ListTargetToExtents lists all TargetToExtent instances
+func ListTargetToExtents(server *Server) ([]TargetToExtent, *http.Response, error) {
+	endpoint := "/api/v1.0/services/iscsi/targettoextent/?limit=1000"
+	var list []TargetToExtent
+	var e interface{}
+	resp, err := server.getSlingConnection().Get(endpoint).Receive(&list, &e)
+
+	if err != nil {
+		glog.Warningln(err)
+		return nil, resp, err
+	}
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return nil, resp, fmt.Errorf("Error listing TargetToExtents - message: %v, status: %d", string(body), resp.StatusCode)
+	}
+
+	return list, resp, nil
+}
+
 // Create creates a TargetToExtent instance
 func (t *TargetToExtent) Create(server *Server) (*http.Response, error) {
 	endpoint := "/api/v1.0/services/iscsi/targettoextent/"
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/golang/glog"
 )
@@ -13,6 +14,9 @@ var (
 	_ Resource = &Zvol{}
 )
 
+// number of zvols requested at once when listing
+const zvolPageSize = 1000
+
 // Zvol represents a zvol instance
 type Zvol struct {
 	Name        string `json:"name,omitempty"`
@@ -23,11 +27,38 @@ type Zvol struct {
 	Refer       int64  `json:"refer,omitempty"`
 	Used        int64  `json:"used,omitempty"`
 	//Volsize     int64  `json:"volsize,omitempty"`
-	Volsize   string  `json:"volsize,omitempty,"`
-	Sparse    bool    `json:"sparse,omitempty"`
-	Force     bool    `json:"force,omitempty"`
-	Blocksize string  `json:"blocksize,omitempty"`
-	Dataset   Dataset `json:"-"`
+	Volsize      string  `json:"volsize,omitempty,"`
+	VolsizeBytes int64   `json:"-"`
+	Sparse       bool    `json:"sparse,omitempty"`
+	Force        bool    `json:"force,omitempty"`
+	Blocksize    string  `json:"blocksize,omitempty"`
+	Dataset      Dataset `json:"-"`
+}
+
+// UnmarshalJSON copes with volsize being sent as a string but returned as an int
+func (z *Zvol) UnmarshalJSON(data []byte) error {
+	type zvolAlias Zvol
+	aux := struct {
+		*zvolAlias
+		Volsize interface{} `json:"volsize,omitempty"`
+	}{
+		zvolAlias: (*zvolAlias)(z),
+	}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	switch v := aux.Volsize.(type) {
+	case float64:
+		z.VolsizeBytes = int64(v)
+		z.Volsize = strconv.FormatInt(z.VolsizeBytes, 10)
+	case string:
+		z.Volsize = v
+		z.VolsizeBytes, _ = strconv.ParseInt(v, 10, 64)
+	}
+
+	return nil
 }
 
 // CopyFrom copies data from a response into an existing resource instance
@@ -42,6 +73,7 @@ func (z *Zvol) CopyFrom(source Resource) error {
 		z.Refer = src.Refer
 		z.Used = src.Used
 		z.Volsize = src.Volsize
+		z.VolsizeBytes = src.VolsizeBytes
 		z.Sparse = src.Sparse
 		z.Force = src.Force
 		z.Blocksize = src.Blocksize
@@ -65,6 +97,40 @@ func (z *Zvol) Get(server *Server) (*http.Response, error) {
 	return resp, nil
 }
 
+// ListZvols lists all Zvol instances of a pool, names are relative to the pool.
+// Results are fetched in pages of zvolPageSize.
+func ListZvols(server *Server, pool string) ([]Zvol, *http.Response, error) {
+	var list []Zvol
+	var resp *http.Response
+	for offset := 0; ; offset += zvolPageSize {
+		endpoint := fmt.Sprintf("/api/v1.0/storage/volume/%s/zvols/?limit=%d&offset=%d", pool, zvolPageSize, offset)
+		var page []Zvol
+		var e interface{}
+		var err error
+		resp, err = server.getSlingConnection().Get(endpoint).Receive(&page, &e)
+		if err != nil {
+			glog.Warningln(err)
+			return nil, resp, err
+		}
+
+		if resp.StatusCode != 200 {
+			body, _ := json.Marshal(e)
+			return nil, resp, fmt.Errorf("Error listing zvols of pool \"%s\" - message: %v, status: %d", pool, string(body), resp.StatusCode)
+		}
+
+		list = append(list, page...)
+		if len(page) < zvolPageSize {
+			break
+		}
+	}
+
+	for i := range list {
+		list[i].Dataset = Dataset{Pool: pool}
+	}
+
+	return list, resp, nil
+}
+
 // Create creates a Zvol instance
 func (z *Zvol) Create(server *Server) (*http.Response, error) {
 	endpoint := fmt.Sprintf("/api/v1.0/storage/volume/%s/zvols/", z.Dataset.Pool)
@@ -87,6 +153,25 @@ func (z *Zvol) Create(server *Server) (*http.Response, error) {
 	return resp, nil
 }
 
+// SetProperties sets zfs properties of a Zvol which the zvol endpoint does not
+// take through the dataset endpoint
+func (z *Zvol) SetProperties(server *Server, properties map[string]string) (*http.Response, error) {
+	endpoint := fmt.Sprintf("/api/v1.0/storage/dataset/%s/%s/", z.Dataset.Pool, z.Name)
+	var e interface{}
+	resp, err := server.getSlingConnection().Put(endpoint).BodyJSON(properties).Receive(nil, &e)
+	if err != nil {
+		glog.Warningln(err)
+		return resp, err
+	}
+
+	if resp.StatusCode != 200 {
+		body, _ := json.Marshal(e)
+		return resp, fmt.Errorf("Error setting properties of zvol \"%s/%s\" - message: %s, status: %d", z.Dataset.Pool, z.Name, string(body), resp.StatusCode)
+	}
+
+	return resp, nil
+}
+
 // Delete deletes a Zvol instance
 func (z *Zvol) Delete(server *Server) (*http.Response, error) {
 	endpoint := fmt.Sprintf("/api/v1.0/storage/volume/%s/zvols/%s/", z.Dataset.Pool, z.Name)
@@ -0,0 +1,169 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/glog"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// AdmissionValidator validates StorageClasses of the provisioner using the
+// same rules as GetConfig, and claims against the limits of their class
+type AdmissionValidator struct {
+	ProvisionerName string
+	// GetStorageClass looks up the class of a claim
+	GetStorageClass func(ctx context.Context, name string) (*storagev1.StorageClass, error)
+
+	provisioner *freenasProvisioner
+}
+
+// NewAdmissionValidator creates a new validator, without a client profiles
+// are not resolved and classes must be supplied through GetStorageClass
+func NewAdmissionValidator(client kubernetes.Interface, provisionerName string) *AdmissionValidator {
+	a := &AdmissionValidator{
+		ProvisionerName: provisionerName,
+		provisioner: &freenasProvisioner{
+			Client: client,
+		},
+	}
+	if client != nil {
+		a.GetStorageClass = func(ctx context.Context, name string) (*storagev1.StorageClass, error) {
+			return client.StorageV1().StorageClasses().Get(ctx, name, metav1.GetOptions{})
+		}
+	}
+	return a
+}
+
+// ValidateStorageClass checks the parameters of a StorageClass
+func (a *AdmissionValidator) ValidateStorageClass(ctx context.Context, class *storagev1.StorageClass) error {
+	_, err := a.getConfig(ctx, class, nil)
+	return err
+}
+
+// ValidateClaim checks a claim against the limits of its StorageClass, claims
+// of other provisioners and of classes which do not exist yet are always valid
+func (a *AdmissionValidator) ValidateClaim(ctx context.Context, claim *v1.PersistentVolumeClaim) error {
+	if claim.Spec.StorageClassName == nil || len(*claim.Spec.StorageClassName) < 1 || a.GetStorageClass == nil {
+		return nil
+	}
+
+	class, err := a.GetStorageClass(ctx, *claim.Spec.StorageClassName)
+	if apierrors.IsNotFound(err) {
+		// the claim stays pending until the class is created
+		glog.Infof("StorageClass \"%s\" of claim %s/%s does not exist, allowing it", *claim.Spec.StorageClassName, claim.Namespace, claim.Name)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get StorageClass \"%s\": %v", *claim.Spec.StorageClassName, err)
+	}
+	if class.Provisioner != a.ProvisionerName {
+		return nil
+	}
+
+	config, err := a.getConfig(ctx, class, claim)
+	if err != nil {
+		return err
+	}
+	return validateClaim(config, claim)
+}
+
+func (a *AdmissionValidator) getConfig(ctx context.Context, class *storagev1.StorageClass, claim *v1.PersistentVolumeClaim) (*freenasProvisionerConfig, error) {
+	parameters := class.Parameters
+	if a.provisioner.Client != nil {
+		var err error
+		parameters, err = a.provisioner.resolveProfile(ctx, class.Parameters, claim)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parseParameters(parameters)
+}
+
+// Review answers an AdmissionReview request
+func (a *AdmissionValidator) Review(ctx context.Context, review *admissionv1.AdmissionReview) *admissionv1.AdmissionReview {
+	response := &admissionv1.AdmissionResponse{
+		Allowed: true,
+	}
+	if review.Request != nil {
+		response.UID = review.Request.UID
+		err := a.validate(ctx, review.Request)
+		if err != nil {
+			response.Allowed = false
+			response.Result = &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Reason:  metav1.StatusReasonInvalid,
+				Message: err.Error(),
+				Code:    http.StatusUnprocessableEntity,
+			}
+		}
+	}
+
+	return &admissionv1.AdmissionReview{
+		TypeMeta: review.TypeMeta,
+		Response: response,
+	}
+}
+
+func (a *AdmissionValidator) validate(ctx context.Context, request *admissionv1.AdmissionRequest) error {
+	if request.Operation == admissionv1.Delete {
+		return nil
+	}
+
+	switch request.Kind.Kind {
+	case "StorageClass":
+		class := &storagev1.StorageClass{}
+		err := json.Unmarshal(request.Object.Raw, class)
+		if err != nil {
+			return err
+		}
+		if class.Provisioner != a.ProvisionerName {
+			return nil
+		}
+		return a.ValidateStorageClass(ctx, class)
+	case "PersistentVolumeClaim":
+		claim := &v1.PersistentVolumeClaim{}
+		err := json.Unmarshal(request.Object.Raw, claim)
+		if err != nil {
+			return err
+		}
+		return a.ValidateClaim(ctx, claim)
+	}
+
+	return nil
+}
+
+// ServeHTTP serves AdmissionReview requests
+func (a *AdmissionValidator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	review := &admissionv1.AdmissionReview{}
+	err = json.Unmarshal(body, review)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := a.Review(r.Context(), review)
+	if !response.Response.Allowed {
+		glog.Infof("denied %s %s/%s: %s", review.Request.Kind.Kind, review.Request.Namespace, review.Request.Name, response.Response.Result.Message)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		glog.Errorf("failed to write admission response: %v", err)
+	}
+}
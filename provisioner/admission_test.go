@@ -0,0 +1,187 @@
+package provisioner
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/yaml"
+)
+
+const testProvisionerName = "freenas.org/iscsi"
+
+func newTestClass(name, provisioner string, parameters map[string]string) *storagev1.StorageClass {
+	return &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: name},
+		Provisioner: provisioner,
+		Parameters:  parameters,
+	}
+}
+
+func newTestClaim(class, size string, modes []v1.PersistentVolumeAccessMode, annotations map[string]string) *v1.PersistentVolumeClaim {
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "data", Annotations: annotations},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: modes,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse(size)},
+			},
+		},
+	}
+	if len(class) > 0 {
+		claim.Spec.StorageClassName = &class
+	}
+	return claim
+}
+
+func TestValidateStorageClass(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		err        string
+	}{
+		{"defaults", nil, ""},
+		{"valid", map[string]string{"datasetParentName": "tank/k8s", "pvcMaxSize": "100Gi"}, ""},
+		{"empty values", map[string]string{"targetGroupPortalgroup": "", "targetGroupInitiatorgroup": ""}, ""},
+		{"unknown parameter", map[string]string{"datasetParent": "tank"}, "unknown parameter datasetParent"},
+		{"invalid size", map[string]string{"pvcMaxSize": "huge"}, "pvcMaxSize must be a quantity"},
+	}
+
+	a := NewAdmissionValidator(fake.NewSimpleClientset(), testProvisionerName)
+	for _, test := range tests {
+		err := a.ValidateStorageClass(context.Background(), newTestClass("class", testProvisionerName, test.parameters))
+		checkError(t, test.name, err, test.err)
+	}
+}
+
+func TestValidateClaim(t *testing.T) {
+	rwo := []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}
+	rwx := []v1.PersistentVolumeAccessMode{v1.ReadWriteMany}
+
+	client := fake.NewSimpleClientset(
+		newTestClass("limited", testProvisionerName, map[string]string{
+			"pvcMinSize":             "1Gi",
+			"pvcMaxSize":             "100Gi",
+			"pvcAccessModes":         "ReadWriteOnce",
+			"pvcAnnotationAllowlist": "compression",
+		}),
+		newTestClass("invalid", testProvisionerName, map[string]string{"zvolSparse": "maybe"}),
+		newTestClass("other", "example.com/nfs", map[string]string{"anything": "goes"}),
+	)
+	a := NewAdmissionValidator(client, testProvisionerName)
+
+	tests := []struct {
+		name  string
+		claim *v1.PersistentVolumeClaim
+		err   string
+	}{
+		{"no class", newTestClaim("", "10Gi", rwo, nil), ""},
+		{"missing class", newTestClaim("later", "10Gi", rwx, nil), ""},
+		{"other provisioner", newTestClaim("other", "1Ti", rwx, nil), ""},
+		{"within limits", newTestClaim("limited", "10Gi", rwo, map[string]string{"freenas.org/compression": "lz4"}), ""},
+		{"too small", newTestClaim("limited", "100Mi", rwo, nil), "below the minimum of 1Gi"},
+		{"too large", newTestClaim("limited", "1Ti", rwo, nil), "exceeds the maximum of 100Gi"},
+		{"access mode", newTestClaim("limited", "10Gi", rwx, nil), "access modes [ReadWriteMany] are not allowed"},
+		{"annotation not allowed", newTestClaim("limited", "10Gi", rwo, map[string]string{"freenas.org/dedup": "on"}), "annotation freenas.org/dedup is not allowed"},
+		{"invalid annotation value", newTestClaim("limited", "10Gi", rwo, map[string]string{"freenas.org/compression": "best"}), "invalid value (best)"},
+		{"invalid class", newTestClaim("invalid", "10Gi", rwo, nil), "zvolSparse must be true or false"},
+	}
+
+	for _, test := range tests {
+		err := a.ValidateClaim(context.Background(), test.claim)
+		checkError(t, test.name, err, test.err)
+	}
+}
+
+// TestAdmissionFixtures answers fixtures/admission like `make test-webhook`,
+// each must be allowed or denied as its name says
+func TestAdmissionFixtures(t *testing.T) {
+	dir := filepath.Join("..", "fixtures", "admission")
+	classes := map[string]*storagev1.StorageClass{}
+	for _, document := range readTestManifests(t, filepath.Join(dir, "storageclasses.yaml")) {
+		class := &storagev1.StorageClass{}
+		if err := yaml.Unmarshal(document, class); err == nil && class.Kind == "StorageClass" {
+			classes[class.Name] = class
+		}
+	}
+
+	a := NewAdmissionValidator(fake.NewSimpleClientset(), testProvisionerName)
+	a.GetStorageClass = func(ctx context.Context, name string) (*storagev1.StorageClass, error) {
+		if class, ok := classes[name]; ok {
+			return class, nil
+		}
+		return a.provisioner.Client.StorageV1().StorageClasses().Get(ctx, name, metav1.GetOptions{})
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(paths) < 1 {
+		t.Fatalf("no fixtures found: %v", err)
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		review := &admissionv1.AdmissionReview{}
+		if err := json.Unmarshal(data, review); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+
+		response := a.Review(context.Background(), review)
+		expected := strings.HasSuffix(path, "-allowed.json")
+		if response.Response.Allowed != expected {
+			t.Errorf("%s: expected allowed %v, got %+v", filepath.Base(path), expected, response.Response.Result)
+		}
+		if response.Response.UID != review.Request.UID {
+			t.Errorf("%s: response UID %s does not match the request", filepath.Base(path), response.Response.UID)
+		}
+	}
+}
+
+func readTestManifests(t *testing.T, path string) [][]byte {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var documents [][]byte
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(file))
+	for {
+		document, err := reader.Read()
+		if err == io.EOF {
+			return documents
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		documents = append(documents, document)
+	}
+}
+
+// checkError fails unless err contains expected, or is nil when expected is empty
+func checkError(t *testing.T, name string, err error, expected string) {
+	t.Helper()
+	if len(expected) < 1 {
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+		return
+	}
+	if err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("%s: expected error %q, got %v", name, expected, err)
+	}
+}
@@ -0,0 +1,287 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// AttachmentSync restricts the dedicated initiator group of each volume
+// provisioned with initiatorGroupPerVolume to the nodes currently using it.
+// A node uses a volume while a VolumeAttachment for it exists or a pod
+// scheduled to the node mounts its claim.
+type AttachmentSync struct {
+	Client          kubernetes.Interface
+	ProvisionerName string
+	IQNKey          string
+
+	provisioner *freenasProvisioner
+	recorder    record.EventRecorder
+	trigger     chan struct{}
+
+	volumes     listersv1.PersistentVolumeLister
+	pods        listersv1.PodLister
+	nodes       listersv1.NodeLister
+	attachments storagelistersv1.VolumeAttachmentLister
+
+	// initiators last applied per volume and initiator group
+	applied map[string]string
+}
+
+// NewAttachmentSync creates a new synchroniser instance, iqnKey is the node
+// annotation (or label) holding the initiator name
+func NewAttachmentSync(client kubernetes.Interface, provisionerName, iqnKey string) *AttachmentSync {
+	return &AttachmentSync{
+		Client:          client,
+		ProvisionerName: provisionerName,
+		IQNKey:          iqnKey,
+		provisioner: &freenasProvisioner{
+			Client: client,
+		},
+		recorder: newEventRecorder(client, "freenas-iscsi-attachment-sync"),
+		trigger:  make(chan struct{}, 1),
+		applied:  map[string]string{},
+	}
+}
+
+// Run synchronises whenever pods, VolumeAttachments, volumes or nodes change,
+// and verifies every initiator group each interval until the context is done
+func (s *AttachmentSync) Run(ctx context.Context, interval time.Duration) {
+	factory := informers.NewSharedInformerFactory(s.Client, 0)
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			s.enqueue()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			s.enqueue()
+		},
+		DeleteFunc: func(obj interface{}) {
+			s.enqueue()
+		},
+	}
+
+	volumes := factory.Core().V1().PersistentVolumes()
+	pods := factory.Core().V1().Pods()
+	nodes := factory.Core().V1().Nodes()
+	attachments := factory.Storage().V1().VolumeAttachments()
+	synced := []cache.InformerSynced{}
+	for _, informer := range []cache.SharedIndexInformer{volumes.Informer(), pods.Informer(), nodes.Informer(), attachments.Informer()} {
+		informer.AddEventHandler(handler)
+		synced = append(synced, informer.HasSynced)
+	}
+	s.volumes = volumes.Lister()
+	s.pods = pods.Lister()
+	s.nodes = nodes.Lister()
+	s.attachments = attachments.Lister()
+
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		glog.Errorf("attachment sync stopped before the caches synced")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := s.Sync(ctx)
+		if err != nil {
+			glog.Errorf("attachment sync failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.trigger:
+		case <-ticker.C:
+			// forget what was applied so edits on FreeNAS are reverted
+			s.applied = map[string]string{}
+		}
+	}
+}
+
+// enqueue requests a sync, requests arriving during a sync are coalesced
+func (s *AttachmentSync) enqueue() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Sync runs a single pass over all volumes with a dedicated initiator group
+func (s *AttachmentSync) Sync(ctx context.Context) error {
+	if s.volumes == nil {
+		return fmt.Errorf("caches are not running")
+	}
+
+	volumes, err := s.volumes.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	users, err := s.volumeNodes()
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, volume := range volumes {
+		if volume.Annotations[annProvisionedBy] != s.ProvisionerName {
+			continue
+		}
+		initiatorGroupID, _ := strconv.Atoi(volume.Annotations[annInitiatorGroupID])
+		if initiatorGroupID < 1 {
+			continue
+		}
+
+		var initiators []string
+		for _, nodeName := range sortedKeys(users[volume.Name]) {
+			node, err := s.nodes.Get(nodeName)
+			if err != nil {
+				glog.Warningf("volume %s is used on unknown node %s: %v", volume.Name, nodeName, err)
+				continue
+			}
+			iqn := nodeIQN(node, s.IQNKey)
+			if len(iqn) < 1 {
+				glog.Warningf("volume %s is used on node %s without an initiator name (%s)", volume.Name, nodeName, s.IQNKey)
+				s.recorder.Eventf(volume, v1.EventTypeWarning, "InitiatorUnknown", "node %s has no initiator name (%s) and cannot log in", nodeName, s.IQNKey)
+				continue
+			}
+			initiators = append(initiators, iqn)
+		}
+		sort.Strings(initiators)
+		if len(initiators) < 1 {
+			initiators = []string{noInitiator}
+		}
+
+		key := volume.Name + "/" + strconv.Itoa(initiatorGroupID)
+		seen[key] = true
+		value := strings.Join(initiators, " ")
+		if s.applied[key] == value {
+			continue
+		}
+
+		err = s.syncVolume(ctx, volume, initiatorGroupID, initiators)
+		if err != nil {
+			glog.Errorf("failed to sync initiator group %d of volume %s: %v", initiatorGroupID, volume.Name, err)
+			s.recorder.Eventf(volume, v1.EventTypeWarning, "InitiatorSyncFailed", "initiator group %d: %v", initiatorGroupID, err)
+			continue
+		}
+		s.applied[key] = value
+	}
+
+	// drop deleted volumes
+	for key := range s.applied {
+		if !seen[key] {
+			delete(s.applied, key)
+		}
+	}
+
+	return nil
+}
+
+// volumeNodes returns the names of the nodes using each volume
+func (s *AttachmentSync) volumeNodes() (map[string]map[string]bool, error) {
+	users := map[string]map[string]bool{}
+	add := func(volumeName, nodeName string) {
+		if len(volumeName) < 1 || len(nodeName) < 1 {
+			return
+		}
+		if users[volumeName] == nil {
+			users[volumeName] = map[string]bool{}
+		}
+		users[volumeName][nodeName] = true
+	}
+
+	attachments, err := s.attachments.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, attachment := range attachments {
+		if attachment.Spec.Source.PersistentVolumeName != nil {
+			add(*attachment.Spec.Source.PersistentVolumeName, attachment.Spec.NodeName)
+		}
+	}
+
+	// pods keep their node until the volume is unmounted and they are gone
+	pods, err := s.pods.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	claims := map[string][]string{}
+	for _, pod := range pods {
+		if len(pod.Spec.NodeName) < 1 || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil {
+				key := pod.Namespace + "/" + volume.PersistentVolumeClaim.ClaimName
+				claims[key] = append(claims[key], pod.Spec.NodeName)
+			}
+		}
+	}
+
+	volumes, err := s.volumes.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, volume := range volumes {
+		if volume.Spec.ClaimRef == nil {
+			continue
+		}
+		for _, nodeName := range claims[volume.Spec.ClaimRef.Namespace+"/"+volume.Spec.ClaimRef.Name] {
+			add(volume.Name, nodeName)
+		}
+	}
+
+	return users, nil
+}
+
+// syncVolume sets the initiators of the dedicated initiator group of a volume
+func (s *AttachmentSync) syncVolume(ctx context.Context, volume *v1.PersistentVolume, initiatorGroupID int, initiators []string) error {
+	config, err := s.provisioner.GetConfigFromVolume(ctx, volume)
+	if err != nil {
+		return err
+	}
+
+	freenasServer, err := s.provisioner.GetServer(*config)
+	if err != nil {
+		return err
+	}
+
+	initiator := freenas.Initiator{ID: initiatorGroupID}
+	resp, err := initiator.Get(freenasServer)
+	found, err := checkFound(resp, err)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("initiator %d does not exist", initiatorGroupID)
+	}
+
+	if sameFields(initiator.Initiators, initiators) {
+		return nil
+	}
+
+	initiator.Initiators = strings.Join(initiators, "\n")
+	_, err = initiator.Update(freenasServer)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("initiator group %d of volume %s now admits %s", initiatorGroupID, volume.Name, strings.Join(initiators, ", "))
+	s.recorder.Eventf(volume, v1.EventTypeNormal, "InitiatorGroupUpdated", "initiator group %d now admits %s", initiatorGroupID, strings.Join(initiators, ", "))
+	return nil
+}
@@ -0,0 +1,97 @@
+package provisioner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// InsufficientCapacityError is returned when provisioning a volume would violate
+// the capacity policy of the StorageClass
+type InsufficientCapacityError struct {
+	Reason string
+}
+
+func (e *InsufficientCapacityError) Error() string {
+	return "insufficient capacity: " + e.Reason
+}
+
+// provisionedBytes sums the volsize of all zvols below a dataset
+func provisionedBytes(freenasServer *freenas.Server, dataset *freenas.Dataset) (int64, error) {
+	zvols, _, err := freenas.ListZvols(freenasServer, dataset.Pool)
+	if err != nil {
+		return 0, err
+	}
+
+	prefix := zvolPath(*dataset, "")
+	var total int64
+	for _, zvol := range zvols {
+		if strings.HasPrefix(zvol.Name, prefix) {
+			total += zvol.VolsizeBytes
+		}
+	}
+	return total, nil
+}
+
+// checkCapacity evaluates the capacity policy of a StorageClass before a
+// volume of size bytes is created below the parent dataset.
+//
+// capacityOvercommitRatio limits the volsize of all zvols (including the new
+// one) to ratio times the space of the dataset (used + available).
+// capacityMinFree is the free space which must remain on the dataset, sparse
+// zvols are not deducted from it.
+func checkCapacity(freenasServer *freenas.Server, config *freenasProvisionerConfig, parentDs *freenas.Dataset, size int64) error {
+	if len(config.CapacityOvercommitRatio) < 1 && len(config.CapacityMinFree) < 1 {
+		return nil
+	}
+
+	if len(config.CapacityMinFree) > 0 {
+		minFree, err := resource.ParseQuantity(config.CapacityMinFree)
+		if err != nil {
+			return fmt.Errorf("invalid capacityMinFree (%s): %v", config.CapacityMinFree, err)
+		}
+
+		free := parentDs.Avail
+		if !config.ZvolSparse {
+			free -= size
+		}
+		if free < minFree.Value() {
+			return &InsufficientCapacityError{
+				Reason: fmt.Sprintf("dataset %s would have %s free, at least %s is required", config.DatasetParentName, formatBytes(free), config.CapacityMinFree),
+			}
+		}
+	}
+
+	if len(config.CapacityOvercommitRatio) > 0 {
+		ratio, err := strconv.ParseFloat(config.CapacityOvercommitRatio, 64)
+		if err != nil || ratio <= 0 {
+			return fmt.Errorf("invalid capacityOvercommitRatio (%s), must be a positive number", config.CapacityOvercommitRatio)
+		}
+
+		provisioned, err := provisionedBytes(freenasServer, parentDs)
+		if err != nil {
+			return err
+		}
+
+		space := parentDs.Used + parentDs.Avail
+		limit := int64(ratio * float64(space))
+		if provisioned+size > limit {
+			return &InsufficientCapacityError{
+				Reason: fmt.Sprintf("dataset %s would have %s provisioned, the overcommit ratio %s allows %s", config.DatasetParentName, formatBytes(provisioned+size), config.CapacityOvercommitRatio, formatBytes(limit)),
+			}
+		}
+
+		glog.V(2).Infof("dataset %s has %s of %s provisioned", config.DatasetParentName, formatBytes(provisioned+size), formatBytes(limit))
+	}
+
+	return nil
+}
+
+// formatBytes formats a byte count as a binary quantity
+func formatBytes(value int64) string {
+	return resource.NewQuantity(value, resource.BinarySI).String()
+}
@@ -0,0 +1,249 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// FreeNAS requires CHAP secrets of 12 to 16 characters
+const chapSecretLength = 16
+
+const chapSecretAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// serialises auth group tag allocation within the process, other replicas and
+// the chap-rotate command are handled by createAuthGroup
+var authTagMutex sync.Mutex
+
+// attempts to find a tag no other auth group uses
+const maxAuthTagAttempts = 5
+
+// type and keys of iscsi CHAP Secrets
+const (
+	chapSecretType        = "kubernetes.io/iscsi-chap"
+	chapSessionUsername   = "node.session.auth.username"
+	chapSessionPassword   = "node.session.auth.password"
+	chapSessionUsernameIn = "node.session.auth.username_in"
+	chapSessionPasswordIn = "node.session.auth.password_in"
+	chapDiscoveryPrefix   = "discovery.sendtargets.auth."
+)
+
+// generateCHAPSecret returns a random CHAP secret
+func generateCHAPSecret() (string, error) {
+	max := big.NewInt(int64(len(chapSecretAlphabet)))
+	secret := make([]byte, chapSecretLength)
+	for i := range secret {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		secret[i] = chapSecretAlphabet[n.Int64()]
+	}
+	return string(secret), nil
+}
+
+// volumeAuthSecretName is the name of the Secret holding the CHAP credentials
+// of a volume
+func volumeAuthSecretName(pvName string) string {
+	return TruncateString(pvName, 253-len("-chap")) + "-chap"
+}
+
+// ensureVolumeCredential creates the auth group of a volume with generated
+// credentials or returns the existing one, credentials are found by user
+func (p *freenasProvisioner) ensureVolumeCredential(freenasServer *freenas.Server, config *freenasProvisionerConfig, pvName string) (*freenas.AuthCredential, error) {
+	// tags are allocated from the existing credentials
+	authTagMutex.Lock()
+	defer authTagMutex.Unlock()
+
+	list, _, err := freenas.ListAuthCredentials(freenasServer)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		if list[i].User == pvName {
+			return &list[i], nil
+		}
+	}
+
+	credential := freenas.AuthCredential{
+		User: pvName,
+	}
+	credential.Secret, err = generateCHAPSecret()
+	if err != nil {
+		return nil, err
+	}
+	if config.TargetGroupAuthtype == "CHAP Mutual" {
+		credential.Peeruser = pvName + "-target"
+		credential.Peersecret, err = generateCHAPSecret()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = createAuthGroup(freenasServer, &credential, list)
+	if err != nil {
+		return nil, err
+	}
+
+	return &credential, nil
+}
+
+// createAuthGroup creates a credential in a new auth group. The tag is the
+// highest one in use plus one, which other processes may pick at the same
+// time: once created, the credential moves on to the next tag as long as a
+// credential with a lower id has the same tag. The credential is deleted again
+// when no tag could be settled on.
+func createAuthGroup(freenasServer *freenas.Server, credential *freenas.AuthCredential, list []freenas.AuthCredential) error {
+	credential.Tag = nextAuthTag(list)
+	_, err := credential.Create(freenasServer)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		list, _, err = freenas.ListAuthCredentials(freenasServer)
+		if err != nil {
+			rollback(freenasServer, credential)
+			return err
+		}
+
+		taken := false
+		for _, other := range list {
+			if other.Tag == credential.Tag && other.ID < credential.ID {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			return nil
+		}
+
+		if attempt >= maxAuthTagAttempts {
+			rollback(freenasServer, credential)
+			return fmt.Errorf("no unused auth group tag found after %d attempts", attempt)
+		}
+
+		glog.Infof("auth group tag %d was taken concurrently, moving credential %d", credential.Tag, credential.ID)
+		credential.Tag = nextAuthTag(list)
+		_, err = credential.Update(freenasServer)
+		if err != nil {
+			rollback(freenasServer, credential)
+			return err
+		}
+	}
+}
+
+// nextAuthTag returns an unused auth group tag
+func nextAuthTag(credentials []freenas.AuthCredential) int {
+	tag := 0
+	for _, credential := range credentials {
+		if credential.Tag > tag {
+			tag = credential.Tag
+		}
+	}
+	return tag + 1
+}
+
+// ensureVolumeAuthSecret stores the credentials of a volume in a
+// kubernetes.io/iscsi-chap Secret next to the shared one, discovery
+// credentials are copied from the shared Secret
+func (p *freenasProvisioner) ensureVolumeAuthSecret(ctx context.Context, config *freenasProvisionerConfig, pvName string, credential *freenas.AuthCredential) (*v1.SecretReference, error) {
+	data := map[string][]byte{
+		chapSessionUsername: []byte(credential.User),
+		chapSessionPassword: []byte(credential.Secret),
+	}
+	if len(credential.Peeruser) > 0 {
+		data[chapSessionUsernameIn] = []byte(credential.Peeruser)
+		data[chapSessionPasswordIn] = []byte(credential.Peersecret)
+	}
+
+	if config.DiscoveryCHAPAuth {
+		shared, err := p.GetSecret(ctx, config.AuthSecretRef.Namespace, config.AuthSecretRef.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read discovery credentials: %v", err)
+		}
+		for k, v := range shared.Data {
+			if strings.HasPrefix(k, chapDiscoveryPrefix) {
+				data[k] = v
+			}
+		}
+	}
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: config.AuthSecretRef.Namespace,
+			Name:      volumeAuthSecretName(pvName),
+			Annotations: map[string]string{
+				annIdentity: p.Identifier,
+			},
+		},
+		Type: chapSecretType,
+		Data: data,
+	}
+
+	secrets := p.Client.CoreV1().Secrets(secret.Namespace)
+	_, err := secrets.Create(ctx, secret, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.SecretReference{
+		Namespace: secret.Namespace,
+		Name:      secret.Name,
+	}, nil
+}
+
+// deleteVolumeAuthGroup deletes the credentials of a volume sharing the tag of
+// the given one, credentials of other users (the tag may have been reused)
+// are left alone
+func deleteVolumeAuthGroup(freenasServer *freenas.Server, credentialID int) error {
+	credential := freenas.AuthCredential{
+		ID: credentialID,
+	}
+	resp, err := credential.Get(freenasServer)
+	found, err := checkFound(resp, err)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return nil
+	}
+
+	credentials, _, err := freenas.ListAuthCredentials(freenasServer)
+	if err != nil {
+		return err
+	}
+	user := rotatedUserSuffix.ReplaceAllString(credential.User, "")
+	for i := range credentials {
+		if credentials[i].Tag != credential.Tag || rotatedUserSuffix.ReplaceAllString(credentials[i].User, "") != user {
+			continue
+		}
+		resp, err = credentials[i].Delete(freenasServer)
+		if err != nil && (resp == nil || resp.StatusCode != 404) {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteVolumeAuthSecret deletes the credentials Secret of a volume
+func (p *freenasProvisioner) deleteVolumeAuthSecret(ctx context.Context, ref *v1.SecretReference) error {
+	err := p.Client.CoreV1().Secrets(ref.Namespace).Delete(ctx, ref.Name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	glog.Infof("deleted CHAP secret %s/%s", ref.Namespace, ref.Name)
+	return nil
+}
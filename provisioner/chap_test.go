@@ -0,0 +1,126 @@
+package provisioner
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+)
+
+func TestNextAuthTag(t *testing.T) {
+	tests := []struct {
+		tags     []int
+		expected int
+	}{
+		{nil, 1},
+		{[]int{1}, 2},
+		{[]int{3, 1, 3}, 4},
+	}
+
+	for _, test := range tests {
+		var list []freenas.AuthCredential
+		for _, tag := range test.tags {
+			list = append(list, freenas.AuthCredential{Tag: tag})
+		}
+		if actual := nextAuthTag(list); actual != test.expected {
+			t.Errorf("nextAuthTag(%v): expected %d, got %d", test.tags, test.expected, actual)
+		}
+	}
+}
+
+// credentialTags returns the tags of the credentials on the fake by user
+func credentialTags(f *fakeFreenas) map[string]int {
+	tags := map[string]int{}
+	for _, credential := range f.list("authcredential") {
+		tags[credential["iscsi_target_auth_user"].(string)] = int(credential["iscsi_target_auth_tag"].(float64))
+	}
+	return tags
+}
+
+func TestCreateAuthGroup(t *testing.T) {
+	tests := []struct {
+		name string
+		// tags of the credentials existing before
+		existing []int
+		// whether the caller listed the existing credentials, a stale list
+		// stands for another process allocating at the same time
+		listed   bool
+		failures map[string]int
+		// moves the first credential onto the tag of the new one after every update
+		chase    bool
+		expected int
+		err      string
+	}{
+		{name: "first", listed: true, expected: 1},
+		{name: "next", existing: []int{1, 3}, listed: true, expected: 4},
+		{name: "taken concurrently", existing: []int{1}, expected: 2},
+		{name: "taken concurrently twice", existing: []int{1, 2}, expected: 3},
+		{name: "create fails", listed: true, failures: map[string]int{"POST authcredential": http.StatusInternalServerError}, err: "Error creating authcredential"},
+		{name: "list fails", existing: []int{1}, failures: map[string]int{"GET authcredential": http.StatusInternalServerError}, err: "Error listing authcredentials"},
+		{name: "move fails", existing: []int{1}, failures: map[string]int{"PUT authcredential": http.StatusInternalServerError}, err: "Error updating authcredential"},
+		{name: "attempts exhausted", existing: []int{1}, chase: true, err: "no unused auth group tag found"},
+	}
+
+	for _, test := range tests {
+		f := newFakeFreenas(t)
+		for _, tag := range test.existing {
+			f.add("authcredential", map[string]interface{}{
+				"iscsi_target_auth_tag":  float64(tag),
+				"iscsi_target_auth_user": "other-" + string(rune('a'+tag)),
+			})
+		}
+		before := credentialTags(f)
+		var list []freenas.AuthCredential
+		if test.listed {
+			for _, tag := range test.existing {
+				list = append(list, freenas.AuthCredential{Tag: tag})
+			}
+		}
+		for k, v := range test.failures {
+			f.failures[k] = v
+		}
+		if test.chase {
+			f.afterRequest = func(method, kind string) {
+				if method != http.MethodPut || kind != "authcredential" {
+					return
+				}
+				f.mutex.Lock()
+				defer f.mutex.Unlock()
+				credentials := f.sorted(kind)
+				credentials[0]["iscsi_target_auth_tag"] = credentials[len(credentials)-1]["iscsi_target_auth_tag"]
+			}
+		}
+
+		credential := &freenas.AuthCredential{User: "pvc-1", Secret: "0123456789abcdef"}
+		err := createAuthGroup(f.server(), credential, list)
+		f.afterRequest = nil
+		for k := range test.failures {
+			delete(f.failures, k)
+		}
+		tags := credentialTags(f)
+
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			if _, ok := tags["pvc-1"]; ok {
+				t.Errorf("%s: credential was not rolled back", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		if credential.Tag != test.expected || tags["pvc-1"] != test.expected {
+			t.Errorf("%s: expected tag %d, got %d (server %d)", test.name, test.expected, credential.Tag, tags["pvc-1"])
+		}
+		for user, tag := range before {
+			if tags[user] != tag {
+				t.Errorf("%s: credential %s moved from tag %d to %d", test.name, user, tag, tags[user])
+			}
+		}
+	}
+}
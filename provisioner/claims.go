@@ -0,0 +1,85 @@
+package provisioner
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// ClaimError lists all problems found validating a claim against the limits
+// of its StorageClass
+type ClaimError struct {
+	Problems []string
+}
+
+func (e *ClaimError) Error() string {
+	return "invalid claim: " + strings.Join(e.Problems, "; ")
+}
+
+// validateClaim checks the size, access modes and property annotations of a
+// claim against the limits of its StorageClass
+func validateClaim(config *freenasProvisionerConfig, claim *v1.PersistentVolumeClaim) error {
+	var problems []string
+
+	// access modes
+	var allowedModes []v1.PersistentVolumeAccessMode
+	for _, mode := range splitList(config.PVCAccessModes) {
+		allowedModes = append(allowedModes, v1.PersistentVolumeAccessMode(mode))
+	}
+	if len(allowedModes) < 1 {
+		allowedModes = (&freenasProvisioner{}).getAccessModes()
+	}
+	if !AccessModesContainedInAll(allowedModes, claim.Spec.AccessModes) {
+		problems = append(problems, fmt.Sprintf("access modes %v are not allowed, allowed are %v", claim.Spec.AccessModes, allowedModes))
+	}
+
+	// size
+	size, ok := claim.Spec.Resources.Requests[v1.ResourceStorage]
+	if !ok {
+		problems = append(problems, "no storage size requested")
+	} else {
+		if len(config.PVCMinSize) > 0 {
+			if min, err := resource.ParseQuantity(config.PVCMinSize); err == nil && size.Cmp(min) < 0 {
+				problems = append(problems, fmt.Sprintf("requested size %s is below the minimum of %s", size.String(), config.PVCMinSize))
+			}
+		}
+		if len(config.PVCMaxSize) > 0 {
+			if max, err := resource.ParseQuantity(config.PVCMaxSize); err == nil && size.Cmp(max) > 0 {
+				problems = append(problems, fmt.Sprintf("requested size %s exceeds the maximum of %s", size.String(), config.PVCMaxSize))
+			}
+		}
+	}
+
+	// property overrides
+	allowed := map[string]bool{}
+	for _, key := range splitList(config.PVCAnnotationAllowlist) {
+		allowed[key] = true
+	}
+	c := *config
+	for annotation, value := range claim.Annotations {
+		if !strings.HasPrefix(annotation, propertyAnnotationPrefix) {
+			continue
+		}
+		key := strings.TrimPrefix(annotation, propertyAnnotationPrefix)
+		if _, ok := volumeProperties[key]; !ok && key != "profile" {
+			continue
+		}
+		if !allowed[key] {
+			problems = append(problems, fmt.Sprintf("annotation %s is not allowed by the StorageClass", annotation))
+			continue
+		}
+		if key == "profile" {
+			continue
+		}
+		if err := setVolumeProperty(&c, key, value); err != nil {
+			problems = append(problems, fmt.Sprintf("annotation %s: %v", annotation, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ClaimError{Problems: problems}
+	}
+	return nil
+}
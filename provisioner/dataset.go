@@ -0,0 +1,102 @@
+package provisioner
+
+import (
+	"fmt"
+
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// datasets are mounted below this path unless configured otherwise
+const datasetMountRoot = "/mnt/"
+
+// ensureParentDataset creates the parent dataset (and any missing parents) on
+// first use with the properties configured on the StorageClass
+func (p *freenasProvisioner) ensureParentDataset(freenasServer *freenas.Server, config *freenasProvisionerConfig) (*freenas.Dataset, error) {
+	comments := config.DatasetParentComments
+	if len(comments) < 1 {
+		comments = fmt.Sprintf("kubernetes volumes provisioned by %s", p.Identifier)
+		if len(config.ProvisionerClusterID) > 0 {
+			comments = fmt.Sprintf("kubernetes cluster %s volumes provisioned by %s", config.ProvisionerClusterID, p.Identifier)
+		}
+	}
+
+	dataset := freenas.Dataset{
+		Name:        config.DatasetParentName,
+		Compression: config.DatasetParentCompression,
+		Comments:    TruncateString(comments, 1024),
+	}
+
+	var err error
+	dataset.Quota, err = parseSize("datasetParentQuota", config.DatasetParentQuota)
+	if err != nil {
+		return nil, err
+	}
+	dataset.Reservation, err = parseSize("datasetParentReservation", config.DatasetParentReservation)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ensureDataset(freenasServer, &dataset)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkDatasetMountpoint(config.DatasetParentName, &dataset)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dataset, nil
+}
+
+// checkDatasetMountpoint makes sure a dataset is mounted where FreeNAS mounts
+// it by default, anything else indicates the name refers to something the
+// provisioner should not touch
+func checkDatasetMountpoint(name string, dataset *freenas.Dataset) error {
+	if len(dataset.Mountpoint) < 1 {
+		return nil
+	}
+	expected := datasetMountRoot + name
+	if dataset.Mountpoint != expected {
+		return fmt.Errorf("dataset %s is mounted at %s, expected %s", name, dataset.Mountpoint, expected)
+	}
+	return nil
+}
+
+// checkParentDataset checks the parent dataset of a StorageClass on one
+// server, a missing dataset is only a problem if it will not be created
+func checkParentDataset(freenasServer *freenas.Server, config *freenasProvisionerConfig) (string, error) {
+	dataset := freenas.Dataset{
+		Name: config.DatasetParentName,
+	}
+	resp, err := dataset.Get(freenasServer)
+	found, err := checkFound(resp, err)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		if !config.DatasetParentCreate {
+			return fmt.Sprintf("dataset %s does not exist", config.DatasetParentName), nil
+		}
+		return "", nil
+	}
+
+	err = checkDatasetMountpoint(config.DatasetParentName, &dataset)
+	if err != nil {
+		return err.Error(), nil
+	}
+	return "", nil
+}
+
+// parseSize parses an optional size parameter into bytes
+func parseSize(parameter, value string) (int64, error) {
+	if len(value) < 1 {
+		return 0, nil
+	}
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s (%s): %v", parameter, value, err)
+	}
+	return q.Value(), nil
+}
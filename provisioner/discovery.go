@@ -0,0 +1,448 @@
+package provisioner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// discovery credential keys of iscsi CHAP Secrets
+const (
+	chapDiscoveryUsername   = chapDiscoveryPrefix + "username"
+	chapDiscoveryPassword   = chapDiscoveryPrefix + "password"
+	chapDiscoveryUsernameIn = chapDiscoveryPrefix + "username_in"
+	chapDiscoveryPasswordIn = chapDiscoveryPrefix + "password_in"
+)
+
+// discovery user last written to the portals managed with a CHAP Secret,
+// recorded on the Secret so the credential it replaced can be removed
+const annDiscoveryCHAPUser = "freenasDiscoveryCHAPUser"
+
+// discoveryPortal is a portal whose discovery authentication is managed,
+// several StorageClasses may share a portal as long as they share the Secret
+type discoveryPortal struct {
+	config  *freenasProvisionerConfig
+	classes []*storagev1.StorageClass
+}
+
+// DiscoveryAuthSync keeps the discovery auth group and method of the portals
+// of StorageClasses with targetDiscoveryCHAPManage set in line with the
+// discovery credentials of their CHAP Secret, and copies those credentials to
+// the Secrets of volumes with targetGroupAuthPerVolume
+type DiscoveryAuthSync struct {
+	Client          kubernetes.Interface
+	ProvisionerName string
+
+	provisioner *freenasProvisioner
+	recorder    record.EventRecorder
+	trigger     chan struct{}
+
+	// Secrets (namespace/name) the last sync read, changes trigger a sync
+	watchedMutex sync.Mutex
+	watched      map[string]bool
+}
+
+// NewDiscoveryAuthSync creates a new synchroniser instance
+func NewDiscoveryAuthSync(client kubernetes.Interface, provisionerName string) *DiscoveryAuthSync {
+	return &DiscoveryAuthSync{
+		Client:          client,
+		ProvisionerName: provisionerName,
+		provisioner: &freenasProvisioner{
+			Client: client,
+		},
+		recorder: newEventRecorder(client, "freenas-iscsi-discovery-auth"),
+		trigger:  make(chan struct{}, 1),
+		watched:  map[string]bool{},
+	}
+}
+
+// Run synchronises whenever a CHAP Secret in use changes, and every interval
+// until the context is done
+func (s *DiscoveryAuthSync) Run(ctx context.Context, interval time.Duration) {
+	factory := informers.NewSharedInformerFactory(s.Client, 0)
+	informer := factory.Core().V1().Secrets().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			s.secretChanged(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			s.secretChanged(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			s.secretChanged(obj)
+		},
+	})
+
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		glog.Errorf("discovery auth sync stopped before the secret cache synced")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := s.Sync(ctx)
+		if err != nil {
+			glog.Errorf("discovery auth sync failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.trigger:
+		case <-ticker.C:
+		}
+	}
+}
+
+// secretChanged requests a sync if the last sync read the Secret
+func (s *DiscoveryAuthSync) secretChanged(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+
+	s.watchedMutex.Lock()
+	watched := s.watched[key]
+	s.watchedMutex.Unlock()
+
+	if watched {
+		select {
+		case s.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Sync runs a single pass over all StorageClasses using this provisioner
+func (s *DiscoveryAuthSync) Sync(ctx context.Context) error {
+	classes, err := listStorageClasses(ctx, s.Client, s.ProvisionerName)
+	if err != nil {
+		return err
+	}
+
+	portals := map[string]*discoveryPortal{}
+	var keys []string
+	// shared Secrets of classes whose volumes get their own Secret
+	sources := map[string]*v1.SecretReference{}
+	watched := map[string]bool{}
+	for i := range classes {
+		class := &classes[i]
+		configs, err := s.provisioner.GetConfigs(ctx, class.Name, nil)
+		if err != nil {
+			glog.Warningf("skipping StorageClass \"%s\" for discovery auth sync: %v", class.Name, err)
+			continue
+		}
+
+		for _, config := range configs {
+			if config.AuthPerVolume && config.DiscoveryCHAPAuth {
+				sources[class.Name] = config.AuthSecretRef
+				watched[secretKey(config.AuthSecretRef)] = true
+			}
+			if !config.DiscoveryCHAPManage {
+				continue
+			}
+			watched[secretKey(config.AuthSecretRef)] = true
+
+			key := serverKey(config) + "/" + strconv.Itoa(config.TargetGroupPortalgroup)
+			portal, ok := portals[key]
+			if !ok {
+				portal = &discoveryPortal{config: config}
+				portals[key] = portal
+				keys = append(keys, key)
+			} else if *portal.config.AuthSecretRef != *config.AuthSecretRef {
+				glog.Errorf("StorageClass \"%s\" manages discovery auth of portal %s with a different secret than StorageClass \"%s\"", class.Name, key, portal.classes[0].Name)
+				s.recorder.Eventf(class, v1.EventTypeWarning, "DiscoveryAuthConflict", "portal %d on %s is managed with secret %s/%s by StorageClass \"%s\"", config.TargetGroupPortalgroup, serverKey(config), portal.config.AuthSecretRef.Namespace, portal.config.AuthSecretRef.Name, portal.classes[0].Name)
+				continue
+			}
+			portal.classes = append(portal.classes, class)
+		}
+	}
+
+	s.watchedMutex.Lock()
+	s.watched = watched
+	s.watchedMutex.Unlock()
+
+	// each Secret is read once per pass
+	secrets := map[string]*v1.Secret{}
+	getSecret := func(ref *v1.SecretReference) (*v1.Secret, error) {
+		if secret, ok := secrets[secretKey(ref)]; ok {
+			return secret, nil
+		}
+		secret, err := s.provisioner.GetSecret(ctx, ref.Namespace, ref.Name)
+		if err != nil {
+			return nil, err
+		}
+		secrets[secretKey(ref)] = secret
+		return secret, nil
+	}
+
+	sort.Strings(keys)
+	failed := map[string]bool{}
+	for _, key := range keys {
+		portal := portals[key]
+		changed := false
+		secret, err := getSecret(portal.config.AuthSecretRef)
+		if err == nil {
+			changed, err = s.syncPortal(key, portal.config, secret)
+		}
+		for _, class := range portal.classes {
+			if err != nil {
+				s.recorder.Eventf(class, v1.EventTypeWarning, "DiscoveryAuthFailed", "portal %d on %s: %v", portal.config.TargetGroupPortalgroup, serverKey(portal.config), err)
+			} else if changed {
+				s.recorder.Eventf(class, v1.EventTypeNormal, "DiscoveryAuthUpdated", "portal %d on %s now uses the discovery credentials of %s/%s", portal.config.TargetGroupPortalgroup, serverKey(portal.config), portal.config.AuthSecretRef.Namespace, portal.config.AuthSecretRef.Name)
+			}
+		}
+		if err != nil {
+			glog.Errorf("failed to sync discovery auth of portal %s: %v", key, err)
+			failed[secretKey(portal.config.AuthSecretRef)] = true
+		}
+	}
+
+	// the replaced user is forgotten once every portal of the Secret is updated
+	for _, key := range keys {
+		ref := portals[key].config.AuthSecretRef
+		if failed[secretKey(ref)] {
+			continue
+		}
+		err = s.recordUser(ctx, secrets[secretKey(ref)])
+		if err != nil {
+			glog.Errorf("failed to record the discovery user of secret %s: %v", secretKey(ref), err)
+		}
+	}
+
+	return s.syncVolumeSecrets(ctx, sources, getSecret)
+}
+
+// recordUser stores the discovery user of a Secret as applied
+func (s *DiscoveryAuthSync) recordUser(ctx context.Context, secret *v1.Secret) error {
+	user := string(secret.Data[chapDiscoveryUsername])
+	if secret.Annotations[annDiscoveryCHAPUser] == user {
+		return nil
+	}
+
+	metav1.SetMetaDataAnnotation(&secret.ObjectMeta, annDiscoveryCHAPUser, user)
+	_, err := s.Client.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	return err
+}
+
+// syncVolumeSecrets copies the discovery credentials of shared Secrets to the
+// Secrets of volumes with generated credentials
+func (s *DiscoveryAuthSync) syncVolumeSecrets(ctx context.Context, sources map[string]*v1.SecretReference, getSecret func(ref *v1.SecretReference) (*v1.Secret, error)) error {
+	if len(sources) < 1 {
+		return nil
+	}
+
+	volumes, err := listVolumes(ctx, s.Client, s.ProvisionerName)
+	if err != nil {
+		return err
+	}
+
+	for i := range volumes {
+		volume := &volumes[i]
+		iscsi := volume.Spec.PersistentVolumeSource.ISCSI
+		source, ok := sources[volume.Spec.StorageClassName]
+		if !ok || iscsi == nil || !iscsi.DiscoveryCHAPAuth || iscsi.SecretRef == nil || len(volume.Annotations[annAuthCredentialID]) < 1 {
+			continue
+		}
+		if secretKey(iscsi.SecretRef) == secretKey(source) {
+			continue
+		}
+
+		shared, err := getSecret(source)
+		if err != nil {
+			return err
+		}
+		secret, err := s.provisioner.GetSecret(ctx, iscsi.SecretRef.Namespace, iscsi.SecretRef.Name)
+		if err != nil {
+			glog.Errorf("failed to read the CHAP secret of volume %s: %v", volume.Name, err)
+			continue
+		}
+
+		if !copyDiscoveryCredentials(shared, secret) {
+			continue
+		}
+		_, err = s.Client.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
+		if err != nil {
+			glog.Errorf("failed to update the discovery credentials of volume %s: %v", volume.Name, err)
+			s.recorder.Eventf(volume, v1.EventTypeWarning, "DiscoveryAuthFailed", "secret %s: %v", secretKey(iscsi.SecretRef), err)
+			continue
+		}
+		glog.Infof("updated the discovery credentials of volume %s from secret %s", volume.Name, secretKey(source))
+	}
+
+	return nil
+}
+
+// copyDiscoveryCredentials replaces the discovery credentials of a Secret with
+// the ones of another, reporting whether anything changed
+func copyDiscoveryCredentials(from, to *v1.Secret) bool {
+	changed := false
+	for k := range to.Data {
+		if _, ok := from.Data[k]; strings.HasPrefix(k, chapDiscoveryPrefix) && !ok {
+			delete(to.Data, k)
+			changed = true
+		}
+	}
+	for k, v := range from.Data {
+		if strings.HasPrefix(k, chapDiscoveryPrefix) && !bytes.Equal(to.Data[k], v) {
+			if to.Data == nil {
+				to.Data = map[string][]byte{}
+			}
+			to.Data[k] = v
+			changed = true
+		}
+	}
+	return changed
+}
+
+// secretKey returns namespace/name of a Secret reference
+func secretKey(ref *v1.SecretReference) string {
+	return ref.Namespace + "/" + ref.Name
+}
+
+// syncPortal applies the discovery credentials of the Secret to the auth group
+// of a portal, creating the group if the portal has none
+func (s *DiscoveryAuthSync) syncPortal(key string, config *freenasProvisionerConfig, secret *v1.Secret) (bool, error) {
+	desired, method, err := discoveryCredential(secret)
+	if err != nil {
+		return false, err
+	}
+
+	freenasServer, err := s.provisioner.GetServer(*config)
+	if err != nil {
+		return false, err
+	}
+
+	portal := freenas.Portal{ID: config.TargetGroupPortalgroup}
+	resp, err := portal.Get(freenasServer)
+	found, err := checkFound(resp, err)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		return false, fmt.Errorf("portal %d (targetGroupPortalgroup) does not exist", portal.ID)
+	}
+
+	authTagMutex.Lock()
+	defer authTagMutex.Unlock()
+
+	credentials, _, err := freenas.ListAuthCredentials(freenasServer)
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	var current *freenas.AuthCredential
+	desired.Tag, _ = strconv.Atoi(portal.Discoveryauthgroup)
+	if desired.Tag < 1 {
+		err = createAuthGroup(freenasServer, desired, credentials)
+		if err != nil {
+			return changed, err
+		}
+		current = desired
+		changed = true
+		credentials = nil
+	}
+
+	for i := range credentials {
+		credential := &credentials[i]
+		if credential.Tag != desired.Tag {
+			continue
+		}
+		if credential.User == desired.User {
+			current = credential
+			continue
+		}
+		// only the credential replaced through the Secret is removed, the group
+		// may hold credentials managed elsewhere
+		if previous := secret.Annotations[annDiscoveryCHAPUser]; len(previous) > 0 && credential.User == previous {
+			_, err = credential.Delete(freenasServer)
+			if err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+	}
+
+	if current == nil {
+		_, err = desired.Create(freenasServer)
+		if err != nil {
+			return changed, err
+		}
+		changed = true
+	} else if current.Secret != desired.Secret || current.Peeruser != desired.Peeruser || current.Peersecret != desired.Peersecret {
+		desired.ID = current.ID
+		_, err = desired.Update(freenasServer)
+		if err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+
+	tag := strconv.Itoa(desired.Tag)
+	if portal.Discoveryauthgroup != tag || portal.Discoveryauthmethod != method {
+		portal.Discoveryauthgroup = tag
+		portal.Discoveryauthmethod = method
+		_, err = portal.Update(freenasServer)
+		if err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+
+	if changed {
+		glog.Infof("updated discovery auth of portal %s to auth group %s (%s)", key, tag, method)
+	}
+	return changed, nil
+}
+
+// discoveryCredential reads the discovery credentials from a CHAP Secret,
+// mutual CHAP is used when the target credentials are present
+func discoveryCredential(secret *v1.Secret) (*freenas.AuthCredential, string, error) {
+	credential := &freenas.AuthCredential{
+		User:       string(secret.Data[chapDiscoveryUsername]),
+		Secret:     string(secret.Data[chapDiscoveryPassword]),
+		Peeruser:   string(secret.Data[chapDiscoveryUsernameIn]),
+		Peersecret: string(secret.Data[chapDiscoveryPasswordIn]),
+	}
+
+	if len(credential.User) < 1 || len(credential.Secret) < 1 {
+		return nil, "", fmt.Errorf("secret %s/%s has no %s and %s", secret.Namespace, secret.Name, chapDiscoveryUsername, chapDiscoveryPassword)
+	}
+	if len(credential.Secret) < 12 || len(credential.Secret) > 16 {
+		return nil, "", fmt.Errorf("%s of secret %s/%s must be 12 to 16 characters", chapDiscoveryPassword, secret.Namespace, secret.Name)
+	}
+
+	method := "CHAP"
+	if len(credential.Peeruser) > 0 || len(credential.Peersecret) > 0 {
+		if len(credential.Peeruser) < 1 || len(credential.Peersecret) < 1 {
+			return nil, "", fmt.Errorf("secret %s/%s must set both %s and %s for mutual CHAP", secret.Namespace, secret.Name, chapDiscoveryUsernameIn, chapDiscoveryPasswordIn)
+		}
+		if len(credential.Peersecret) < 12 || len(credential.Peersecret) > 16 {
+			return nil, "", fmt.Errorf("%s of secret %s/%s must be 12 to 16 characters", chapDiscoveryPasswordIn, secret.Namespace, secret.Name)
+		}
+		if credential.Peersecret == credential.Secret {
+			return nil, "", fmt.Errorf("%s and %s of secret %s/%s must differ", chapDiscoveryPassword, chapDiscoveryPasswordIn, secret.Namespace, secret.Name)
+		}
+		method = "CHAP Mutual"
+	}
+
+	return credential, method, nil
+}
@@ -0,0 +1,395 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+// drift status values stored in the annDriftStatus annotation
+const (
+	DriftStatusInSync   = "InSync"
+	DriftStatusDrifted  = "Drifted"
+	DriftStatusRepaired = "Repaired"
+)
+
+// DriftResult is the outcome of checking a single volume
+type DriftResult struct {
+	Volume   string
+	Status   string
+	Problems []string
+}
+
+// DriftDetector verifies that the FreeNAS resources recorded on PVs still exist
+// and match, optionally recreating the iscsi resources of intact zvols
+type DriftDetector struct {
+	Client          kubernetes.Interface
+	ProvisionerName string
+	Repair          bool
+
+	provisioner *freenasProvisioner
+	recorder    record.EventRecorder
+}
+
+// NewDriftDetector creates a new detector instance
+func NewDriftDetector(client kubernetes.Interface, provisionerName string, repair bool) *DriftDetector {
+	return &DriftDetector{
+		Client:          client,
+		ProvisionerName: provisionerName,
+		Repair:          repair,
+		provisioner: &freenasProvisioner{
+			Client: client,
+		},
+		recorder: newEventRecorder(client, "freenas-iscsi-drift-detector"),
+	}
+}
+
+// Run checks all volumes every interval until the context is done
+func (d *DriftDetector) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		_, err := d.Check(ctx)
+		if err != nil {
+			glog.Errorf("drift detection failed: %v", err)
+		}
+	}, interval)
+}
+
+// Check runs a single pass over all volumes provisioned by this provisioner
+func (d *DriftDetector) Check(ctx context.Context) ([]DriftResult, error) {
+	volumes, err := listVolumes(ctx, d.Client, d.ProvisionerName)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []DriftResult
+	for i := range volumes {
+		volume := &volumes[i]
+		result, err := d.CheckVolume(ctx, volume)
+		if err != nil {
+			glog.Errorf("failed to check volume %s for drift: %v", volume.Name, err)
+			continue
+		}
+		results = append(results, *result)
+	}
+
+	return results, nil
+}
+
+// CheckVolume checks (and optionally repairs) a single volume
+func (d *DriftDetector) CheckVolume(ctx context.Context, volume *v1.PersistentVolume) (*DriftResult, error) {
+	config, err := d.provisioner.GetConfigFromVolume(ctx, volume)
+	if err != nil {
+		return nil, err
+	}
+
+	freenasServer, err := d.provisioner.GetServer(*config)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DriftResult{
+		Volume: volume.Name,
+		Status: DriftStatusInSync,
+	}
+
+	zvolOk, problems, err := d.checkResources(freenasServer, volume)
+	if err != nil {
+		return nil, err
+	}
+	result.Problems = problems
+
+	if len(problems) > 0 {
+		result.Status = DriftStatusDrifted
+		d.recorder.Event(volume, v1.EventTypeWarning, "ResourceDrift", strings.Join(problems, "; "))
+
+		if d.Repair && zvolOk {
+			err = d.repair(ctx, freenasServer, volume)
+			if err != nil {
+				d.recorder.Event(volume, v1.EventTypeWarning, "ResourceRepairFailed", err.Error())
+			} else {
+				result.Status = DriftStatusRepaired
+				d.recorder.Event(volume, v1.EventTypeNormal, "ResourceRepaired", "recreated iscsi resources for intact zvol")
+			}
+		}
+	}
+
+	message := strings.Join(result.Problems, "; ")
+	if volume.Annotations[annDriftStatus] != result.Status || volume.Annotations[annDriftMessage] != message {
+		err = patchVolumeAnnotations(ctx, d.Client, volume.Name, map[string]*string{
+			annDriftStatus:  &result.Status,
+			annDriftMessage: &message,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// checkResources returns whether the zvol is intact and a list of problems found
+func (d *DriftDetector) checkResources(freenasServer *freenas.Server, volume *v1.PersistentVolume) (bool, []string, error) {
+	var problems []string
+
+	pool := volume.Annotations[annPool]
+	zvolName := volume.Annotations[annZvol]
+	iscsiName := volume.Annotations[annISCSIName]
+	targetID, _ := strconv.Atoi(volume.Annotations[annTargetID])
+	targetGroupID, _ := strconv.Atoi(volume.Annotations[annTargetGroupID])
+	extentID, _ := strconv.Atoi(volume.Annotations[annExtentID])
+	targetToExtentID, _ := strconv.Atoi(volume.Annotations[annTargetToExtentID])
+
+	// zvol
+	zvol := freenas.Zvol{
+		Name:    zvolName,
+		Dataset: freenas.Dataset{Pool: pool},
+	}
+	resp, err := zvol.Get(freenasServer)
+	zvolOk, err := checkFound(resp, err)
+	if err != nil {
+		return false, nil, err
+	}
+	if !zvolOk {
+		problems = append(problems, fmt.Sprintf("zvol %s/%s is missing", pool, zvolName))
+	}
+
+	// target
+	var found bool
+	target := freenas.Target{ID: targetID}
+	if targetID > 0 {
+		resp, err = target.Get(freenasServer)
+		found, err = checkFound(resp, err)
+		if err != nil {
+			return false, nil, err
+		}
+	}
+	if !found {
+		problems = append(problems, fmt.Sprintf("target %d is missing", targetID))
+	} else if target.Name != iscsiName {
+		problems = append(problems, fmt.Sprintf("target %d is named %s, expected %s", targetID, target.Name, iscsiName))
+	}
+
+	// targetgroup, 0 when provisioned by older releases
+	if targetGroupID > 0 {
+		targetGroup := freenas.TargetGroup{ID: targetGroupID}
+		resp, err = targetGroup.Get(freenasServer)
+		found, err = checkFound(resp, err)
+		if err != nil {
+			return false, nil, err
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("targetgroup %d is missing", targetGroupID))
+		} else if targetGroup.Target != targetID {
+			problems = append(problems, fmt.Sprintf("targetgroup %d belongs to target %d, expected %d", targetGroupID, targetGroup.Target, targetID))
+		}
+	}
+
+	// extent
+	extentDiskName := "zvol/" + pool + "/" + zvolName
+	extent := freenas.Extent{ID: extentID}
+	found = false
+	if extentID > 0 {
+		resp, err = extent.Get(freenasServer)
+		found, err = checkFound(resp, err)
+		if err != nil {
+			return false, nil, err
+		}
+	}
+	if !found {
+		problems = append(problems, fmt.Sprintf("extent %d is missing", extentID))
+	} else if extent.Disk != extentDiskName {
+		problems = append(problems, fmt.Sprintf("extent %d points at %s, expected %s", extentID, extent.Disk, extentDiskName))
+	}
+
+	// targettoextent
+	targetToExtent := freenas.TargetToExtent{ID: targetToExtentID}
+	found = false
+	if targetToExtentID > 0 {
+		resp, err = targetToExtent.Get(freenasServer)
+		found, err = checkFound(resp, err)
+		if err != nil {
+			return false, nil, err
+		}
+	}
+	if !found {
+		problems = append(problems, fmt.Sprintf("targettoextent %d is missing", targetToExtentID))
+	} else if targetToExtent.Target != targetID || targetToExtent.Extent != extentID {
+		problems = append(problems, fmt.Sprintf("targettoextent %d maps target %d to extent %d, expected target %d to extent %d", targetToExtentID, targetToExtent.Target, targetToExtent.Extent, targetID, extentID))
+	}
+
+	return zvolOk, problems, nil
+}
+
+// repairConfig builds the settings the iscsi resources of a volume are
+// recreated with. Settings recorded on the volume take precedence, the
+// StorageClass (which may have been edited or deleted since) is only used for
+// the targetgroup and extent settings which are not recorded.
+func (d *DriftDetector) repairConfig(ctx context.Context, volume *v1.PersistentVolume) (*freenasProvisionerConfig, error) {
+	config, err := d.provisioner.GetConfigFromVolume(ctx, volume)
+	if err != nil {
+		return nil, err
+	}
+
+	classConfig, err := d.provisioner.GetConfig(ctx, volume.Spec.StorageClassName)
+	if err == nil {
+		config.TargetGroupAuthgroup = classConfig.TargetGroupAuthgroup
+		config.TargetGroupAuthtype = classConfig.TargetGroupAuthtype
+		config.TargetGroupInitiatorgroup = classConfig.TargetGroupInitiatorgroup
+		config.TargetGroupPortalgroup = classConfig.TargetGroupPortalgroup
+		config.ExtentBlocksize = classConfig.ExtentBlocksize
+		config.ExtentDisablePhysicalBlocksize = classConfig.ExtentDisablePhysicalBlocksize
+		config.ExtentAvailThreshold = classConfig.ExtentAvailThreshold
+		config.ExtentInsecureTpc = classConfig.ExtentInsecureTpc
+		config.ExtentXen = classConfig.ExtentXen
+		config.ExtentRpm = classConfig.ExtentRpm
+		config.ExtentReadOnly = classConfig.ExtentReadOnly
+	} else if apierrors.IsNotFound(err) {
+		glog.Warningf("StorageClass \"%s\" of volume %s no longer exists, repairing with the recorded settings only", volume.Spec.StorageClassName, volume.Name)
+	} else {
+		return nil, err
+	}
+
+	settings, err := parseProperties(volume.Annotations[annExtentSettings])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %v", annExtentSettings, err)
+	}
+	for key, value := range settings {
+		err = setVolumeProperty(config, key, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %v", annExtentSettings, err)
+		}
+	}
+
+	// volumes provisioned with a dedicated initiator group record it
+	config.InitiatorGroupPerVolume = len(volume.Annotations[annInitiatorGroupID]) > 0
+
+	if config.TargetGroupPortalgroup < 1 {
+		return nil, fmt.Errorf("the portal group of volume %s is not recorded and StorageClass \"%s\" is not available", volume.Name, volume.Spec.StorageClassName)
+	}
+
+	return config, nil
+}
+
+// repair recreates the target, targetgroup, extent and lun mapping of an intact zvol
+func (d *DriftDetector) repair(ctx context.Context, freenasServer *freenas.Server, volume *v1.PersistentVolume) error {
+	config, err := d.repairConfig(ctx, volume)
+	if err != nil {
+		return err
+	}
+
+	pool := volume.Annotations[annPool]
+	zvolName := volume.Annotations[annZvol]
+	iscsiName := volume.Annotations[annISCSIName]
+	extentDiskName := "zvol/" + pool + "/" + zvolName
+
+	target, err := ensureTarget(freenasServer, iscsiName)
+	if err != nil {
+		return err
+	}
+
+	annotations := map[string]*string{}
+	if config.InitiatorGroupPerVolume {
+		initiatorGroup, err := ensureVolumeInitiatorGroup(freenasServer, iscsiName)
+		if err != nil {
+			return err
+		}
+		config.TargetGroupInitiatorgroup = initiatorGroup.ID
+		initiatorGroupIDValue := strconv.Itoa(initiatorGroup.ID)
+		annotations[annInitiatorGroupID] = &initiatorGroupIDValue
+	}
+
+	// generated credentials are kept, the targetgroup refers to their tag
+	credentialID, _ := strconv.Atoi(volume.Annotations[annAuthCredentialID])
+	if credentialID > 0 {
+		credential := freenas.AuthCredential{ID: credentialID}
+		_, err = credential.Get(freenasServer)
+		if err != nil {
+			return fmt.Errorf("failed to get authcredential %d: %v", credentialID, err)
+		}
+		config.TargetGroupAuthgroup = credential.Tag
+	}
+
+	targetGroup, err := ensureTargetGroup(freenasServer, config, target.ID)
+	if err != nil {
+		return err
+	}
+
+	comment := ""
+	if volume.Spec.ClaimRef != nil {
+		comment = fmt.Sprintf("%s/%s", volume.Spec.ClaimRef.Namespace, volume.Spec.ClaimRef.Name)
+	}
+	extent, err := ensureExtent(freenasServer, config, iscsiName, extentDiskName, comment)
+	if err != nil {
+		return err
+	}
+	if extent.Disk != extentDiskName {
+		return fmt.Errorf("extent %d (\"%s\") points at %s, refusing to reuse it", extent.ID, iscsiName, extent.Disk)
+	}
+
+	targetToExtent, err := ensureTargetToExtent(freenasServer, target.ID, extent.ID)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("repaired volume %s: target %d, targetgroup %d, extent %d, targettoextent %d", volume.Name, target.ID, targetGroup.ID, extent.ID, targetToExtent.ID)
+
+	targetIDValue := strconv.Itoa(target.ID)
+	targetGroupIDValue := strconv.Itoa(targetGroup.ID)
+	extentIDValue := strconv.Itoa(extent.ID)
+	targetToExtentIDValue := strconv.Itoa(targetToExtent.ID)
+	annotations[annTargetID] = &targetIDValue
+	annotations[annTargetGroupID] = &targetGroupIDValue
+	annotations[annExtentID] = &extentIDValue
+	annotations[annTargetToExtentID] = &targetToExtentIDValue
+	return patchVolumeAnnotations(ctx, d.Client, volume.Name, annotations)
+}
+
+// checkFound interprets the result of a Get, only unexpected failures are errors
+func checkFound(resp *http.Response, err error) (bool, error) {
+	if resp != nil && resp.StatusCode == 404 {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if resp == nil || resp.StatusCode != 200 {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		return false, fmt.Errorf("unexpected status %d", status)
+	}
+	return true, nil
+}
+
+// listVolumes lists all PVs provisioned by the named provisioner
+func listVolumes(ctx context.Context, client kubernetes.Interface, provisionerName string) ([]v1.PersistentVolume, error) {
+	list, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var volumes []v1.PersistentVolume
+	for _, volume := range list.Items {
+		if volume.Annotations[annProvisionedBy] != provisionerName {
+			continue
+		}
+		if _, ok := volume.Annotations[annIdentity]; !ok {
+			continue
+		}
+		volumes = append(volumes, volume)
+	}
+	return volumes, nil
+}
@@ -0,0 +1,243 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeFreenas is an in-memory FreeNAS v1.0 API serving the endpoints used by
+// the freenas package
+type fakeFreenas struct {
+	*httptest.Server
+
+	mutex  sync.Mutex
+	nextID int
+	// dataset name (including the pool) -> dataset
+	datasets map[string]map[string]interface{}
+	// pool/name -> zvol
+	zvols map[string]map[string]interface{}
+	// iscsi resource kind -> id -> resource
+	resources map[string]map[int]map[string]interface{}
+	// "METHOD kind" -> status returned instead of handling the request
+	failures map[string]int
+	// called after every handled request
+	afterRequest func(method, kind string)
+}
+
+const fakeISCSIPrefix = "/api/v1.0/services/iscsi/"
+
+// body of injected failures
+var fakeFailure = map[string]string{"error": "injected failure"}
+
+func newFakeFreenas(t *testing.T) *fakeFreenas {
+	f := &fakeFreenas{
+		nextID:    1,
+		datasets:  map[string]map[string]interface{}{},
+		zvols:     map[string]map[string]interface{}{},
+		resources: map[string]map[int]map[string]interface{}{},
+		failures:  map[string]int{},
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// secret returns a server secret pointing at the fake
+func (f *fakeFreenas) secret(namespace, name string) *v1.Secret {
+	u, _ := url.Parse(f.URL)
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Data: map[string][]byte{
+			"protocol": []byte("http"),
+			"host":     []byte(u.Hostname()),
+			"port":     []byte(u.Port()),
+			"username": []byte("root"),
+			"password": []byte("secret"),
+		},
+	}
+}
+
+// server returns a client of the fake
+func (f *fakeFreenas) server() *freenas.Server {
+	u, _ := url.Parse(f.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return freenas.NewFreenasServer("http", u.Hostname(), port, "root", "secret", false)
+}
+
+func (f *fakeFreenas) addDataset(name string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.datasets[name] = map[string]interface{}{
+		"name": name,
+		"pool": strings.SplitN(name, "/", 2)[0],
+	}
+}
+
+func (f *fakeFreenas) addZvol(pool, name string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.zvols[pool+"/"+name] = map[string]interface{}{
+		"name":    name,
+		"volsize": 1 << 30,
+	}
+}
+
+// add stores an iscsi resource of the given kind (e.g. "target") and returns its id
+func (f *fakeFreenas) add(kind string, resource map[string]interface{}) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.store(kind, resource)
+}
+
+func (f *fakeFreenas) store(kind string, resource map[string]interface{}) int {
+	id := f.nextID
+	f.nextID++
+	resource["id"] = id
+	if f.resources[kind] == nil {
+		f.resources[kind] = map[int]map[string]interface{}{}
+	}
+	f.resources[kind][id] = resource
+	return id
+}
+
+// list returns the resources of a kind ordered by id
+func (f *fakeFreenas) list(kind string) []map[string]interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.sorted(kind)
+}
+
+func (f *fakeFreenas) sorted(kind string) []map[string]interface{} {
+	var ids []int
+	for id := range f.resources[kind] {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	list := []map[string]interface{}{}
+	for _, id := range ids {
+		list = append(list, f.resources[kind][id])
+	}
+	return list
+}
+
+func (f *fakeFreenas) serve(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	kind, status, body := f.handle(r)
+	after := f.afterRequest
+	f.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if body != nil {
+		json.NewEncoder(w).Encode(body)
+	}
+
+	if after != nil {
+		after(r.Method, kind)
+	}
+}
+
+func (f *fakeFreenas) handle(r *http.Request) (string, int, interface{}) {
+	path := r.URL.Path
+	var request map[string]interface{}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&request)
+	}
+
+	switch {
+	case strings.HasPrefix(path, "/api/v1.0/storage/dataset/"):
+		name := strings.Trim(strings.TrimPrefix(path, "/api/v1.0/storage/dataset/"), "/")
+		if status, ok := f.failures[r.Method+" dataset"]; ok {
+			return "dataset", status, fakeFailure
+		}
+		dataset, ok := f.datasets[name]
+		if r.Method != http.MethodGet {
+			return "dataset", http.StatusMethodNotAllowed, nil
+		}
+		if !ok {
+			return "dataset", http.StatusNotFound, map[string]string{"error": "not found"}
+		}
+		return "dataset", http.StatusOK, dataset
+
+	case strings.HasPrefix(path, "/api/v1.0/storage/volume/"):
+		parts := strings.SplitN(strings.TrimPrefix(path, "/api/v1.0/storage/volume/"), "/zvols/", 2)
+		if len(parts) != 2 {
+			return "zvol", http.StatusNotFound, nil
+		}
+		if status, ok := f.failures[r.Method+" zvol"]; ok {
+			return "zvol", status, fakeFailure
+		}
+		name := strings.Trim(parts[1], "/")
+		if len(name) < 1 {
+			var list []map[string]interface{}
+			for key, zvol := range f.zvols {
+				if strings.HasPrefix(key, parts[0]+"/") {
+					list = append(list, zvol)
+				}
+			}
+			return "zvol", http.StatusOK, list
+		}
+		zvol, ok := f.zvols[parts[0]+"/"+name]
+		if !ok {
+			return "zvol", http.StatusNotFound, map[string]string{"error": "not found"}
+		}
+		switch r.Method {
+		case http.MethodGet:
+			return "zvol", http.StatusOK, zvol
+		case http.MethodDelete:
+			delete(f.zvols, parts[0]+"/"+name)
+			return "zvol", http.StatusNoContent, nil
+		}
+		return "zvol", http.StatusMethodNotAllowed, nil
+
+	case strings.HasPrefix(path, fakeISCSIPrefix):
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(path, fakeISCSIPrefix), "/"), "/")
+		kind := parts[0]
+		if status, ok := f.failures[r.Method+" "+kind]; ok {
+			return kind, status, fakeFailure
+		}
+		if len(parts) == 1 {
+			switch r.Method {
+			case http.MethodGet:
+				return kind, http.StatusOK, f.sorted(kind)
+			case http.MethodPost:
+				f.store(kind, request)
+				return kind, http.StatusCreated, request
+			}
+			return kind, http.StatusMethodNotAllowed, nil
+		}
+
+		id, _ := strconv.Atoi(parts[1])
+		resource, ok := f.resources[kind][id]
+		if !ok {
+			return kind, http.StatusNotFound, map[string]string{"error": "not found"}
+		}
+		switch r.Method {
+		case http.MethodGet:
+			return kind, http.StatusOK, resource
+		case http.MethodPut:
+			for k, v := range request {
+				resource[k] = v
+			}
+			return kind, http.StatusOK, resource
+		case http.MethodDelete:
+			delete(f.resources[kind], id)
+			return kind, http.StatusNoContent, nil
+		}
+		return kind, http.StatusMethodNotAllowed, nil
+	}
+
+	return "", http.StatusNotFound, map[string]string{"error": fmt.Sprintf("unknown endpoint %s", path)}
+}
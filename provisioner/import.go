@@ -0,0 +1,387 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ImportOptions describe an existing zvol to be managed as a statically provisioned PV
+type ImportOptions struct {
+	ProvisionerName       string
+	Identifier            string
+	StorageClassName      string
+	ServerSecretNamespace string
+	ServerSecretName      string
+	// Zvol is the full path of the zvol including the pool
+	Zvol           string
+	PVName         string
+	ClaimNamespace string
+	ClaimName      string
+	AccessModes    []v1.PersistentVolumeAccessMode
+	VolumeMode     *v1.PersistentVolumeMode
+	// ConfigureAccess applies the targetgroup, initiator group and credential
+	// settings of the StorageClass to an existing target instead of reusing its
+	// targetgroup
+	ConfigureAccess bool
+}
+
+// ImportVolume discovers (or creates) the iscsi resources of an existing zvol
+// and returns a PV annotated exactly like Provision would, so it can later be
+// deleted normally
+func ImportVolume(ctx context.Context, client kubernetes.Interface, options ImportOptions) (*v1.PersistentVolume, error) {
+	p := &freenasProvisioner{
+		Client:     client,
+		Identifier: options.Identifier,
+	}
+
+	class, err := client.StorageV1().StorageClasses().Get(ctx, options.StorageClassName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	parameters, err := p.resolveProfile(ctx, class.Parameters, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := parseParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+	config.ReclaimPolicy = class.ReclaimPolicy
+
+	// classes listing several servers default to the first one
+	entries, err := serverEntries(config)
+	if err != nil {
+		return nil, err
+	}
+	config = entries[0].apply(config)
+	if len(options.ServerSecretNamespace) > 0 {
+		config.ServerSecretNamespace = options.ServerSecretNamespace
+	}
+	if len(options.ServerSecretName) > 0 {
+		config.ServerSecretName = options.ServerSecretName
+	}
+	err = p.applyServerSecret(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	freenasServer, err := p.GetServer(*config)
+	if err != nil {
+		return nil, err
+	}
+
+	iscsiConfig := freenas.ISCSIConfig{}
+	_, err = iscsiConfig.Get(freenasServer)
+	if err != nil {
+		return nil, err
+	}
+
+	err = applyGroupPortals(freenasServer, config)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(options.Zvol, "/", 2)
+	if len(parts) != 2 || len(parts[1]) < 1 {
+		return nil, fmt.Errorf("zvol (%s) must be given as pool/path", options.Zvol)
+	}
+	pool := parts[0]
+	zvolName := parts[1]
+	extentDiskName := "zvol/" + options.Zvol
+
+	if len(extentDiskName) > 63 {
+		return nil, fmt.Errorf("extent zvol name (%s) cannot be longer than 63 chars", extentDiskName)
+	}
+
+	pvName := options.PVName
+	if len(pvName) < 1 {
+		pvName = strings.Trim(strings.Replace(sanitizeName(filepath.Base(zvolName)), ":", "-", -1), "-.")
+	}
+	if msgs := validation.IsDNS1123Subdomain(pvName); len(msgs) > 0 {
+		return nil, fmt.Errorf("invalid PV name (%s), use --pv-name: %s", pvName, strings.Join(msgs, ", "))
+	}
+
+	zvol := freenas.Zvol{
+		Name:    zvolName,
+		Dataset: freenas.Dataset{Pool: pool},
+	}
+	resp, err := zvol.Get(freenasServer)
+	found, err := checkFound(resp, err)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("zvol %s does not exist", options.Zvol)
+	}
+
+	resources := volumeResources{
+		DatasetParent: filepath.Dir(options.Zvol),
+		Pool:          pool,
+		Zvol:          zvolName,
+	}
+
+	// discover an existing extent and target for the zvol
+	extents, _, err := freenas.ListExtents(freenasServer)
+	if err != nil {
+		return nil, err
+	}
+	for i := range extents {
+		if extents[i].Disk == extentDiskName {
+			resources.Extent = &extents[i]
+			break
+		}
+	}
+
+	if resources.Extent != nil {
+		glog.Infof("found extent %d (\"%s\") for zvol %s", resources.Extent.ID, resources.Extent.Name, options.Zvol)
+
+		targetToExtents, _, err := freenas.ListTargetToExtents(freenasServer)
+		if err != nil {
+			return nil, err
+		}
+		for i := range targetToExtents {
+			if targetToExtents[i].Extent == resources.Extent.ID {
+				resources.TargetToExtent = &targetToExtents[i]
+				break
+			}
+		}
+	}
+
+	if resources.TargetToExtent != nil {
+		target := freenas.Target{ID: resources.TargetToExtent.Target}
+		_, err = target.Get(freenasServer)
+		if err != nil {
+			return nil, err
+		}
+		glog.Infof("found target %d (\"%s\") for zvol %s", target.ID, target.Name, options.Zvol)
+		resources.Target = &target
+		resources.ISCSIName = target.Name
+	} else {
+		names, err := resolveNames(config, resources.DatasetParent, nameContext{
+			PVName:       pvName,
+			PVCNamespace: options.ClaimNamespace,
+			PVCName:      options.ClaimName,
+			ClusterID:    config.ProvisionerClusterID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		resources.ISCSIName = names.ISCSIName
+	}
+
+	// nothing is created before the zvol is known to be unclaimed
+	err = checkNotImported(ctx, client, pvName, options.Zvol, resources.ISCSIName)
+	if err != nil {
+		return nil, err
+	}
+
+	// everything created from here on is removed again on failure
+	var created []freenas.Resource
+	var authSecretRef *v1.SecretReference
+	rollbackImport := func() {
+		for i, j := 0, len(created)-1; i < j; i, j = i+1, j-1 {
+			created[i], created[j] = created[j], created[i]
+		}
+		rollback(freenasServer, created...)
+		if authSecretRef != nil {
+			err := p.deleteVolumeAuthSecret(ctx, authSecretRef)
+			if err != nil {
+				glog.Warningf("failed to rollback CHAP secret %s/%s: %v", authSecretRef.Namespace, authSecretRef.Name, err)
+			}
+		}
+	}
+
+	if resources.Target == nil {
+		// a target of that name not mapped to the zvol belongs to something else
+		targets, _, err := freenas.ListTargets(freenasServer)
+		if err != nil {
+			return nil, err
+		}
+		for _, target := range targets {
+			if target.Name == resources.ISCSIName {
+				return nil, fmt.Errorf("target %d (\"%s\") already exists but is not mapped to zvol %s", target.ID, target.Name, options.Zvol)
+			}
+		}
+
+		resources.Target, err = ensureTarget(freenasServer, resources.ISCSIName)
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, resources.Target)
+	}
+
+	// access to a target made by hand is left alone unless asked for
+	if resources.TargetToExtent != nil && !options.ConfigureAccess {
+		resources.TargetGroup, err = existingTargetGroup(freenasServer, config, resources.Target.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.InitiatorGroupPerVolume && resources.TargetGroup == nil {
+		resources.InitiatorGroup, err = ensureVolumeInitiatorGroup(freenasServer, resources.ISCSIName)
+		if err != nil {
+			rollbackImport()
+			return nil, err
+		}
+		created = append(created, resources.InitiatorGroup)
+		config.TargetGroupInitiatorgroup = resources.InitiatorGroup.ID
+	}
+	if config.AuthPerVolume && resources.TargetGroup == nil {
+		resources.AuthCredential, err = p.ensureVolumeCredential(freenasServer, config, pvName)
+		if err != nil {
+			rollbackImport()
+			return nil, err
+		}
+		created = append(created, resources.AuthCredential)
+		config.TargetGroupAuthgroup = resources.AuthCredential.Tag
+		authSecretRef, err = p.ensureVolumeAuthSecret(ctx, config, pvName, resources.AuthCredential)
+		if err != nil {
+			rollbackImport()
+			return nil, err
+		}
+		config.AuthSecretRef = authSecretRef
+	}
+
+	if resources.TargetGroup == nil {
+		resources.TargetGroup, err = ensureTargetGroup(freenasServer, config, resources.Target.ID)
+		if err != nil {
+			rollbackImport()
+			return nil, err
+		}
+		created = append(created, resources.TargetGroup)
+	}
+
+	if resources.Extent == nil {
+		comment := ""
+		if len(options.ClaimName) > 0 {
+			comment = fmt.Sprintf("%s/%s", options.ClaimNamespace, options.ClaimName)
+		}
+		resources.Extent, err = ensureExtent(freenasServer, config, resources.ISCSIName, extentDiskName, comment)
+		if err != nil {
+			rollbackImport()
+			return nil, err
+		}
+		created = append(created, resources.Extent)
+	} else {
+		// record the settings of the extent found
+		config.ExtentBlocksize = resources.Extent.Blocksize
+		config.ExtentRpm = resources.Extent.Rpm
+		config.ExtentReadOnly = resources.Extent.Ro
+	}
+
+	if resources.TargetToExtent == nil {
+		resources.TargetToExtent, err = ensureTargetToExtent(freenasServer, resources.Target.ID, resources.Extent.ID)
+		if err != nil {
+			rollbackImport()
+			return nil, err
+		}
+	}
+
+	// record the properties the zvol actually has
+	config.ZvolCompression = zvol.Compression
+	config.ZvolDedup = zvol.Dedup
+	config.ZvolBlocksize = zvol.Blocksize
+	// properties set through the dataset endpoint are not read back
+	config.ZvolSync = ""
+	config.ZvolLogbias = ""
+	config.ZvolPrimarycache = ""
+	config.ZvolVolmode = ""
+
+	pv := p.newPersistentVolume(config, pvName, iscsiConfig.Basename, resources)
+	pv.Annotations[annProvisionedBy] = options.ProvisionerName
+	pv.Spec.StorageClassName = class.Name
+	pv.Spec.AccessModes = options.AccessModes
+	if len(pv.Spec.AccessModes) < 1 {
+		pv.Spec.AccessModes = []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}
+	}
+	pv.Spec.Capacity = v1.ResourceList{
+		v1.ResourceName(v1.ResourceStorage): *resource.NewQuantity(zvol.VolsizeBytes, resource.BinarySI),
+	}
+	pv.Spec.VolumeMode = options.VolumeMode
+
+	if len(options.ClaimName) > 0 {
+		pv.Spec.ClaimRef = &v1.ObjectReference{
+			Kind:       "PersistentVolumeClaim",
+			APIVersion: "v1",
+			Namespace:  options.ClaimNamespace,
+			Name:       options.ClaimName,
+		}
+	}
+
+	return pv, nil
+}
+
+// checkNotImported fails when a PV already uses the zvol or target, two PVs
+// on one zvol would destroy each other's data on delete
+func checkNotImported(ctx context.Context, client kubernetes.Interface, pvName, zvolPath, iscsiName string) error {
+	volumes, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for _, volume := range volumes.Items {
+		if volume.Name == pvName {
+			return fmt.Errorf("PV %s already exists", pvName)
+		}
+		if volume.Annotations[annPool]+"/"+volume.Annotations[annZvol] == zvolPath {
+			return fmt.Errorf("zvol %s is already used by PV %s", zvolPath, volume.Name)
+		}
+		iscsi := volume.Spec.PersistentVolumeSource.ISCSI
+		if iscsi != nil && (volume.Annotations[annISCSIName] == iscsiName || strings.HasSuffix(iscsi.IQN, ":"+iscsiName)) {
+			return fmt.Errorf("target %s of zvol %s is already used by PV %s", iscsiName, zvolPath, volume.Name)
+		}
+	}
+
+	return nil
+}
+
+// existingTargetGroup returns the targetgroup of an existing target, preferring
+// the portal group of the StorageClass, and takes its access settings over so
+// the PV matches what the target admits
+func existingTargetGroup(freenasServer *freenas.Server, config *freenasProvisionerConfig, targetID int) (*freenas.TargetGroup, error) {
+	targetGroups, _, err := freenas.ListTargetGroups(freenasServer)
+	if err != nil {
+		return nil, err
+	}
+
+	var targetGroup *freenas.TargetGroup
+	for i := range targetGroups {
+		if targetGroups[i].Target != targetID {
+			continue
+		}
+		if targetGroup == nil || targetGroups[i].Portalgroup == config.TargetGroupPortalgroup {
+			targetGroup = &targetGroups[i]
+		}
+	}
+	if targetGroup == nil {
+		return nil, fmt.Errorf("target %d has no targetgroup, use --configure-access to create one from the StorageClass", targetID)
+	}
+
+	glog.Infof("reusing targetgroup %d of target %d (portal group %d, initiator group %d, auth %s)", targetGroup.ID, targetID, targetGroup.Portalgroup, targetGroup.Initiatorgroup, targetGroup.Authtype)
+	config.TargetGroupPortalgroup = targetGroup.Portalgroup
+	config.TargetGroupInitiatorgroup = targetGroup.Initiatorgroup
+	config.TargetGroupAuthgroup = targetGroup.Authgroup
+	config.TargetGroupAuthtype = targetGroup.Authtype
+	config.SessionCHAPAuth = targetGroup.Authtype == "CHAP" || targetGroup.Authtype == "CHAP Mutual"
+	if config.SessionCHAPAuth && config.AuthSecretRef == nil {
+		return nil, fmt.Errorf("targetgroup %d requires CHAP but the StorageClass has no auth secret", targetGroup.ID)
+	}
+	if config.SessionCHAPAuth {
+		glog.Warningf("secret %s/%s must hold the credentials of auth group %d", config.AuthSecretRef.Namespace, config.AuthSecretRef.Name, targetGroup.Authgroup)
+	}
+
+	return targetGroup, nil
+}
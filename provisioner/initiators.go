@@ -0,0 +1,311 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// initiatorGroupNetworks values
+const (
+	initiatorNetworksNode = "node"
+	initiatorNetworksAll  = "ALL"
+)
+
+// comment set on synchronised initiator groups
+const initiatorGroupComment = "managed by freenas-iscsi-provisioner"
+
+// initiatorGroup is the desired content of one initiator group, several
+// StorageClasses may share a group
+type initiatorGroup struct {
+	config     *freenasProvisionerConfig
+	classes    []*storagev1.StorageClass
+	initiators map[string]bool
+	networks   map[string]bool
+}
+
+// InitiatorSync keeps the initiator groups of StorageClasses with
+// initiatorGroupSync set in line with the initiator names and addresses of
+// the nodes
+type InitiatorSync struct {
+	Client          kubernetes.Interface
+	ProvisionerName string
+	IQNKey          string
+
+	provisioner *freenasProvisioner
+	recorder    record.EventRecorder
+	nodes       listersv1.NodeLister
+	trigger     chan struct{}
+}
+
+// NewInitiatorSync creates a new synchroniser instance, iqnKey is the node
+// annotation (or label) holding the initiator name
+func NewInitiatorSync(client kubernetes.Interface, provisionerName, iqnKey string) *InitiatorSync {
+	return &InitiatorSync{
+		Client:          client,
+		ProvisionerName: provisionerName,
+		IQNKey:          iqnKey,
+		provisioner: &freenasProvisioner{
+			Client: client,
+		},
+		recorder: newEventRecorder(client, "freenas-iscsi-initiator-sync"),
+		trigger:  make(chan struct{}, 1),
+	}
+}
+
+// Run synchronises whenever a node is added, removed or changes its initiator
+// name or addresses, and every interval until the context is done
+func (s *InitiatorSync) Run(ctx context.Context, interval time.Duration) {
+	factory := informers.NewSharedInformerFactory(s.Client, 0)
+	informer := factory.Core().V1().Nodes()
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			s.enqueue()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode, ok := oldObj.(*v1.Node)
+			newNode, ok2 := newObj.(*v1.Node)
+			if !ok || !ok2 || s.nodeChanged(oldNode, newNode) {
+				s.enqueue()
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			s.enqueue()
+		},
+	})
+	s.nodes = informer.Lister()
+
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.Informer().HasSynced) {
+		glog.Errorf("initiator sync stopped before the node cache synced")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := s.Sync(ctx)
+		if err != nil {
+			glog.Errorf("initiator sync failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.trigger:
+		case <-ticker.C:
+		}
+	}
+}
+
+// enqueue requests a sync, requests arriving during a sync are coalesced
+func (s *InitiatorSync) enqueue() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// nodeChanged reports whether an update affects any initiator group
+func (s *InitiatorSync) nodeChanged(oldNode, newNode *v1.Node) bool {
+	if nodeIQN(oldNode, s.IQNKey) != nodeIQN(newNode, s.IQNKey) {
+		return true
+	}
+	if !labels.Equals(oldNode.Labels, newNode.Labels) {
+		return true
+	}
+	return strings.Join(nodeNetworks(oldNode), ",") != strings.Join(nodeNetworks(newNode), ",")
+}
+
+// Sync runs a single pass over all StorageClasses using this provisioner
+func (s *InitiatorSync) Sync(ctx context.Context) error {
+	if s.nodes == nil {
+		return fmt.Errorf("node cache is not running")
+	}
+	nodes, err := s.nodes.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	classes, err := listStorageClasses(ctx, s.Client, s.ProvisionerName)
+	if err != nil {
+		return err
+	}
+
+	// collect the desired members of each group
+	groups := map[string]*initiatorGroup{}
+	var keys []string
+	for i := range classes {
+		class := &classes[i]
+		configs, err := s.provisioner.GetConfigs(ctx, class.Name, nil)
+		if err != nil {
+			glog.Warningf("skipping StorageClass \"%s\" for initiator sync: %v", class.Name, err)
+			continue
+		}
+
+		for _, config := range configs {
+			if !config.InitiatorGroupSync {
+				continue
+			}
+			selector, err := labels.Parse(config.InitiatorGroupNodeSelector)
+			if err != nil {
+				glog.Warningf("skipping StorageClass \"%s\" for initiator sync: %v", class.Name, err)
+				continue
+			}
+
+			key := serverKey(config) + "/" + strconv.Itoa(config.TargetGroupInitiatorgroup)
+			group, ok := groups[key]
+			if !ok {
+				group = &initiatorGroup{
+					config:     config,
+					initiators: map[string]bool{},
+					networks:   map[string]bool{},
+				}
+				groups[key] = group
+				keys = append(keys, key)
+			}
+			group.classes = append(group.classes, class)
+
+			for _, node := range nodes {
+				if !selector.Matches(labels.Set(node.Labels)) {
+					continue
+				}
+				iqn := nodeIQN(node, s.IQNKey)
+				if len(iqn) < 1 {
+					glog.V(2).Infof("node %s has no initiator name (%s), skipping it for StorageClass \"%s\"", node.Name, s.IQNKey, class.Name)
+					continue
+				}
+				group.initiators[iqn] = true
+				if config.InitiatorGroupNetworks == initiatorNetworksAll {
+					group.networks[initiatorNetworksAll] = true
+					continue
+				}
+				for _, network := range nodeNetworks(node) {
+					group.networks[network] = true
+				}
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		err := s.syncGroup(groups[key])
+		if err != nil {
+			glog.Errorf("failed to sync initiator group %s: %v", key, err)
+			for _, class := range groups[key].classes {
+				s.recorder.Eventf(class, v1.EventTypeWarning, "InitiatorSyncFailed", "initiator group %d on %s: %v", groups[key].config.TargetGroupInitiatorgroup, serverKey(groups[key].config), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// syncGroup updates one initiator group if its members differ
+func (s *InitiatorSync) syncGroup(group *initiatorGroup) error {
+	config := group.config
+	initiators := sortedKeys(group.initiators)
+	networks := sortedKeys(group.networks)
+
+	initiatorGroupMembers.WithLabelValues(serverKey(config), strconv.Itoa(config.TargetGroupInitiatorgroup)).Set(float64(len(initiators)))
+
+	// an empty group would admit every initiator, keep the last known members
+	if len(initiators) < 1 {
+		return fmt.Errorf("no node has an initiator name (%s), leaving the group unchanged", s.IQNKey)
+	}
+
+	freenasServer, err := s.provisioner.GetServer(*config)
+	if err != nil {
+		return err
+	}
+
+	initiator := freenas.Initiator{ID: config.TargetGroupInitiatorgroup}
+	resp, err := initiator.Get(freenasServer)
+	found, err := checkFound(resp, err)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("initiator %d (targetGroupInitiatorgroup) does not exist", initiator.ID)
+	}
+
+	if sameFields(initiator.Initiators, initiators) && sameFields(initiator.AuthNetwork, networks) {
+		return nil
+	}
+
+	initiator.Initiators = strings.Join(initiators, "\n")
+	initiator.AuthNetwork = strings.Join(networks, "\n")
+	initiator.Comment = initiatorGroupComment
+	_, err = initiator.Update(freenasServer)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("updated initiator group %d on %s to %d initiators", initiator.ID, serverKey(config), len(initiators))
+	for _, class := range group.classes {
+		s.recorder.Eventf(class, v1.EventTypeNormal, "InitiatorGroupSynced", "initiator group %d on %s now has %d initiators", initiator.ID, serverKey(config), len(initiators))
+	}
+	return nil
+}
+
+// nodeIQN returns the initiator name of a node from the annotation key,
+// falling back to a label
+func nodeIQN(node *v1.Node, key string) string {
+	if iqn, ok := node.Annotations[key]; ok {
+		return strings.TrimSpace(iqn)
+	}
+	return strings.TrimSpace(node.Labels[key])
+}
+
+// nodeNetworks returns the internal addresses of a node as host networks
+func nodeNetworks(node *v1.Node) []string {
+	var networks []string
+	for _, address := range node.Status.Addresses {
+		if address.Type != v1.NodeInternalIP {
+			continue
+		}
+		ip := net.ParseIP(address.Address)
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			networks = append(networks, ip.String()+"/32")
+		} else {
+			networks = append(networks, ip.String()+"/128")
+		}
+	}
+	sort.Strings(networks)
+	return networks
+}
+
+// sameFields compares a whitespace separated FreeNAS list with a sorted list
+func sameFields(value string, expected []string) bool {
+	fields := strings.Fields(value)
+	sort.Strings(fields)
+	return strings.Join(fields, " ") == strings.Join(expected, " ")
+}
+
+// sortedKeys returns the keys of a set in order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,73 @@
+package provisioner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// LeaderElection holds the timings of the leader election of background tasks,
+// the lock lives next to the one of the provision controller
+type LeaderElection struct {
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// RunLeading runs fn only while this replica holds the named lock, fn is
+// started again whenever the lock is re-acquired until the context is done
+func (e LeaderElection) RunLeading(ctx context.Context, client kubernetes.Interface, name string, fn func(ctx context.Context)) {
+	hostname, _ := os.Hostname()
+	lock, err := resourcelock.New(resourcelock.EndpointsResourceLock,
+		leaderElectionNamespace(),
+		strings.Replace(name, "/", "-", -1),
+		client.CoreV1(),
+		nil,
+		resourcelock.ResourceLockConfig{
+			Identity: hostname + "_" + string(uuid.NewUUID()),
+		})
+	if err != nil {
+		glog.Errorf("failed to create lock %s, not running it: %v", name, err)
+		return
+	}
+
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:          lock,
+			LeaseDuration: e.LeaseDuration,
+			RenewDeadline: e.RenewDeadline,
+			RetryPeriod:   e.RetryPeriod,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					glog.Infof("acquired lock %s", name)
+					fn(ctx)
+				},
+				OnStoppedLeading: func() {
+					glog.Infof("lost lock %s", name)
+				},
+			},
+		})
+	}
+}
+
+// leaderElectionNamespace returns the namespace the provisioner runs in, like
+// the provision controller does
+func leaderElectionNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	if data, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+		if ns := strings.TrimSpace(string(data)); len(ns) > 0 {
+			return ns
+		}
+	}
+	return "default"
+}
@@ -0,0 +1,139 @@
+package provisioner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+)
+
+// lint finding severities
+const (
+	LintError   = "error"
+	LintWarning = "warning"
+)
+
+// LintFinding is a problem found in a manifest
+type LintFinding struct {
+	Severity string
+	Message  string
+}
+
+// worst-case values names are checked with, the provisioner controller names
+// volumes pvc-<claim uid>. The namespace is only rendered into names by the
+// template, namespace datasets are shortened to maxNamespaceDatasetNameLength.
+var lintNameContext = nameContext{
+	PVName:       "pvc-00000000-0000-0000-0000-000000000000",
+	PVCNamespace: strings.Repeat("n", 63),
+	PVCName:      strings.Repeat("c", 253),
+	UID:          "00000000-0000-0000-0000-000000000000",
+}
+
+// LintStorageClass validates the parameters of a StorageClass offline and
+// checks the names of worst-case volumes against FreeNAS length limits.
+// Referenced server secrets are checked if present in secrets (keyed by
+// namespace/name).
+func LintStorageClass(class *storagev1.StorageClass, secrets map[string]*v1.Secret) []LintFinding {
+	var findings []LintFinding
+	add := func(severity, format string, args ...interface{}) {
+		findings = append(findings, LintFinding{Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+
+	config, err := parseParameters(class.Parameters)
+	if err != nil {
+		if e, ok := err.(*ParameterError); ok {
+			for _, problem := range e.Problems {
+				add(LintError, "%s", problem)
+			}
+		} else {
+			add(LintError, "%v", err)
+		}
+		return findings
+	}
+
+	if len(config.Profile) > 0 || strings.Contains(config.PVCAnnotationAllowlist, "profile") {
+		add(LintWarning, "profiles are not resolved offline, their parameters are not checked")
+	}
+
+	entries, _ := serverEntries(config)
+	for _, entry := range entries {
+		c := entry.apply(config)
+
+		data := lintNameContext
+		data.ClusterID = config.ProvisionerClusterID
+		datasetName := namespaceDatasetName(c, data.PVCNamespace)
+		names, err := resolveNames(c, datasetName, data)
+		if err != nil {
+			add(LintError, "%v", err)
+			continue
+		}
+
+		extentDiskName := "zvol/" + datasetName + "/" + names.Base
+		if len(extentDiskName) > maxExtentDiskNameLength {
+			add(LintError, "extent disk name %s of a worst-case volume exceeds %d chars", extentDiskName, maxExtentDiskNameLength)
+		}
+		if names.Shortened {
+			add(LintWarning, "worst-case volume names below %s are shortened (e.g. zvol %s, iscsi name %s)", datasetName, names.Base, names.ISCSIName)
+		}
+
+		key := entry.SecretNamespace + "/" + entry.SecretName
+		secret, ok := secrets[key]
+		if !ok {
+			add(LintWarning, "server secret %s is not part of the given manifests", key)
+			continue
+		}
+		for _, finding := range LintSecret(secret) {
+			add(finding.Severity, "server secret %s: %s", key, finding.Message)
+		}
+	}
+
+	return findings
+}
+
+// LintSecret checks the connection details of a server secret
+func LintSecret(secret *v1.Secret) []LintFinding {
+	var findings []LintFinding
+	add := func(severity, format string, args ...interface{}) {
+		findings = append(findings, LintFinding{Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+
+	data := map[string]string{}
+	for k, v := range secret.Data {
+		data[k] = string(v)
+	}
+	for k, v := range secret.StringData {
+		data[k] = v
+	}
+
+	for k, v := range data {
+		switch k {
+		case "protocol":
+			if v != "http" && v != "https" {
+				add(LintError, "protocol must be http or https, got %q", v)
+			}
+		case "port":
+			if port, err := strconv.Atoi(v); err != nil || port < 1 || port > 65535 {
+				add(LintError, "port must be a port number, got %q", v)
+			}
+		case "allowInsecure":
+			if _, err := strconv.ParseBool(v); err != nil {
+				add(LintError, "allowInsecure must be true or false, got %q", v)
+			}
+		case "host", "username", "password":
+		default:
+			add(LintWarning, "unknown key %s", k)
+		}
+	}
+
+	// the provisioner falls back to localhost
+	if len(data["host"]) < 1 {
+		add(LintWarning, "host is missing, localhost is used")
+	}
+	if len(data["password"]) < 1 {
+		add(LintError, "password is missing")
+	}
+
+	return findings
+}
@@ -0,0 +1,119 @@
+package provisioner
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func newLintSecret(data map[string]string) *v1.Secret {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "freenas-iscsi"},
+		Data:       map[string][]byte{},
+	}
+	for k, v := range data {
+		secret.Data[k] = []byte(v)
+	}
+	return secret
+}
+
+// checkFindings fails unless findings hold exactly the expected
+// "severity: message substring" entries
+func checkFindings(t *testing.T, name string, findings []LintFinding, expected []string) {
+	t.Helper()
+	if len(findings) != len(expected) {
+		t.Errorf("%s: expected %d findings, got %+v", name, len(expected), findings)
+		return
+	}
+	for _, e := range expected {
+		found := false
+		for _, finding := range findings {
+			if strings.Contains(finding.Severity+": "+finding.Message, e) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: expected finding %q, got %+v", name, e, findings)
+		}
+	}
+}
+
+func TestLintSecret(t *testing.T) {
+	valid := map[string]string{
+		"protocol": "https",
+		"host":     "freenas.example.com",
+		"port":     "443",
+		"username": "root",
+		"password": "secret",
+	}
+
+	tests := []struct {
+		name     string
+		data     map[string]string
+		expected []string
+	}{
+		{"valid", valid, nil},
+		{"password only", map[string]string{"password": "secret"}, []string{"warning: host is missing"}},
+		{"missing password", without(valid, "password"), []string{"error: password is missing"}},
+		{"empty password", with(valid, "password", ""), []string{"error: password is missing"}},
+		{"protocol", with(valid, "protocol", "ftp"), []string{"error: protocol must be http or https"}},
+		{"port", with(valid, "port", "70000"), []string{"error: port must be a port number"}},
+		{"allowInsecure", with(valid, "allowInsecure", "sure"), []string{"error: allowInsecure must be true or false"}},
+		{"unknown key", with(valid, "hostname", "freenas"), []string{"warning: unknown key hostname"}},
+	}
+
+	for _, test := range tests {
+		checkFindings(t, test.name, LintSecret(newLintSecret(test.data)), test.expected)
+	}
+}
+
+func TestLintStorageClass(t *testing.T) {
+	secrets := map[string]*v1.Secret{
+		"kube-system/freenas-iscsi": newLintSecret(map[string]string{"host": "freenas", "password": "secret"}),
+		"kube-system/broken":        newLintSecret(map[string]string{"host": "freenas"}),
+	}
+
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		expected   []string
+	}{
+		{"defaults", nil, nil},
+		{"secret not given", map[string]string{"serverSecretName": "other"}, []string{"warning: server secret kube-system/other is not part of the given manifests"}},
+		{"secret findings", map[string]string{"serverSecretName": "broken"}, []string{"error: server secret kube-system/broken: password is missing"}},
+		{"invalid parameter", map[string]string{"zvolSparse": "maybe"}, []string{"error: zvolSparse must be true or false"}},
+		{"shortened names", map[string]string{"datasetParentName": "tank/" + strings.Repeat("d", 40)}, []string{"warning: worst-case volume names below"}},
+		{"dataset too long", map[string]string{"datasetParentName": "tank/" + strings.Repeat("d", 60)}, []string{"error:"}},
+		{"profile", map[string]string{"profile": "fast"}, []string{"warning: profiles are not resolved offline"}},
+	}
+
+	for _, test := range tests {
+		class := &storagev1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: "freenas-iscsi"},
+			Provisioner: testProvisionerName,
+			Parameters:  test.parameters,
+		}
+		checkFindings(t, test.name, LintStorageClass(class, secrets), test.expected)
+	}
+}
+
+// the shipped example class must stay valid
+func TestLintDeployClass(t *testing.T) {
+	path := filepath.Join("..", "deploy", "class.yaml")
+	for _, document := range readTestManifests(t, path) {
+		class := &storagev1.StorageClass{}
+		if err := yaml.Unmarshal(document, class); err != nil || class.Kind != "StorageClass" {
+			continue
+		}
+		for _, finding := range LintStorageClass(class, nil) {
+			if finding.Severity == LintError {
+				t.Errorf("%s: %s", path, finding.Message)
+			}
+		}
+	}
+}
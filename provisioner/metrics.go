@@ -0,0 +1,76 @@
+package provisioner
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics are served by the controller on --controller-metrics-port
+var (
+	datasetAvailableBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "freenas_iscsi",
+		Name:      "dataset_available_bytes",
+		Help:      "Available bytes of the parent dataset of a StorageClass",
+	}, []string{"storageclass", "server", "dataset"})
+
+	datasetUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "freenas_iscsi",
+		Name:      "dataset_used_bytes",
+		Help:      "Used bytes of the parent dataset of a StorageClass",
+	}, []string{"storageclass", "server", "dataset"})
+
+	datasetProvisionedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "freenas_iscsi",
+		Name:      "dataset_provisioned_bytes",
+		Help:      "Sum of the volsize of all zvols below the parent dataset of a StorageClass",
+	}, []string{"storageclass", "server", "dataset"})
+
+	volumeUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "freenas_iscsi",
+		Name:      "volume_used_bytes",
+		Help:      "Used bytes of the zvol backing a PV",
+	}, []string{"persistentvolume", "namespace", "persistentvolumeclaim"})
+
+	volumeReferencedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "freenas_iscsi",
+		Name:      "volume_referenced_bytes",
+		Help:      "Referenced bytes of the zvol backing a PV",
+	}, []string{"persistentvolume", "namespace", "persistentvolumeclaim"})
+
+	volumeCapacityBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "freenas_iscsi",
+		Name:      "volume_capacity_bytes",
+		Help:      "Volsize of the zvol backing a PV",
+	}, []string{"persistentvolume", "namespace", "persistentvolumeclaim"})
+
+	preflightStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "freenas_iscsi",
+		Name:      "preflight_status",
+		Help:      "Outcome of a preflight check of a StorageClass, 1 passed and 0 failed",
+	}, []string{"storageclass", "server", "check"})
+
+	initiatorGroupMembers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "freenas_iscsi",
+		Name:      "initiator_group_initiators",
+		Help:      "Node initiators of a synchronised initiator group",
+	}, []string{"server", "initiatorgroup"})
+
+	preflightLastRun = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "freenas_iscsi",
+		Name:      "preflight_last_run_timestamp_seconds",
+		Help:      "Time the last preflight pass completed",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		datasetAvailableBytes,
+		datasetUsedBytes,
+		datasetProvisionedBytes,
+		volumeUsedBytes,
+		volumeReferencedBytes,
+		volumeCapacityBytes,
+		preflightStatus,
+		preflightLastRun,
+		initiatorGroupMembers,
+	)
+}
@@ -0,0 +1,91 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// namespace dataset names are shortened to leave room for the zvol names below
+// them within maxExtentDiskNameLength
+const maxNamespaceDatasetNameLength = 24
+
+// namespaceDatasetName returns the dataset zvols of a namespace are created in
+func namespaceDatasetName(config *freenasProvisionerConfig, namespace string) string {
+	if !config.DatasetPerNamespace || len(namespace) < 1 {
+		return config.DatasetParentName
+	}
+	return config.DatasetParentName + "/" + shortenName(sanitizeName(namespace), maxNamespaceDatasetNameLength)
+}
+
+// getNamespaceQuota resolves the quota of a namespace dataset in bytes, the
+// namespace annotation takes precedence over the ConfigMap and the default.
+// A quota of 0 leaves the dataset untouched.
+func (p *freenasProvisioner) getNamespaceQuota(ctx context.Context, config *freenasProvisionerConfig, namespace string) (int64, error) {
+	quota := config.DatasetNamespaceQuota
+
+	if len(config.DatasetNamespaceQuotaConfigMap) > 0 {
+		parts := strings.SplitN(config.DatasetNamespaceQuotaConfigMap, "/", 2)
+		if len(parts) != 2 {
+			return 0, fmt.Errorf("datasetNamespaceQuotaConfigMap (%s) must be given as namespace/name", config.DatasetNamespaceQuotaConfigMap)
+		}
+		configMap, err := p.Client.CoreV1().ConfigMaps(parts[0]).Get(ctx, parts[1], metav1.GetOptions{})
+		if err != nil {
+			return 0, err
+		}
+		if v, ok := configMap.Data[namespace]; ok {
+			quota = v
+		}
+	}
+
+	if len(config.DatasetNamespaceQuotaAnnotation) > 0 {
+		ns, err := p.Client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+		if err != nil {
+			return 0, err
+		}
+		if v, ok := ns.Annotations[config.DatasetNamespaceQuotaAnnotation]; ok {
+			quota = v
+		}
+	}
+
+	return parseSize(fmt.Sprintf("quota for namespace %s", namespace), quota)
+}
+
+// ensureNamespaceDataset creates the dataset of a namespace on demand and
+// keeps its quota in sync
+func (p *freenasProvisioner) ensureNamespaceDataset(ctx context.Context, freenasServer *freenas.Server, config *freenasProvisionerConfig, namespace string) (*freenas.Dataset, error) {
+	quota, err := p.getNamespaceQuota(ctx, config, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	name := namespaceDatasetName(config, namespace)
+	dataset := freenas.Dataset{
+		Name:     name,
+		Quota:    quota,
+		Comments: TruncateString(fmt.Sprintf("kubernetes namespace %s", namespace), 1024),
+	}
+	err = ensureDataset(freenasServer, &dataset)
+	if err != nil {
+		return nil, err
+	}
+
+	if quota > 0 && dataset.Quota != quota {
+		glog.Infof("Setting quota of dataset \"%s\" to %d", name, quota)
+		update := freenas.Dataset{
+			Name:  name,
+			Quota: quota,
+		}
+		_, err = update.Update(freenasServer)
+		if err != nil {
+			return nil, err
+		}
+		dataset.Quota = quota
+	}
+
+	return &dataset, nil
+}
@@ -0,0 +1,137 @@
+package provisioner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"text/template"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// whole path to zvol Disk including "zvol/" must be <= 63 chars
+	maxExtentDiskNameLength = 63
+
+	// FreeNAS limits target and extent names to 120 chars
+	maxISCSINameLength = 120
+
+	// length of the hash appended to shortened names
+	nameHashLength = 8
+
+	defaultNameTemplate = "{{ .PVName }}"
+)
+
+// nameContext holds the values available to the naming template
+type nameContext struct {
+	PVName       string
+	PVCNamespace string
+	PVCName      string
+	UID          string
+	ClusterID    string
+}
+
+// volumeNames are the resolved names of the resources backing a volume
+type volumeNames struct {
+	// Base is the last component of the zvol name
+	Base      string
+	ISCSIName string
+	// Shortened is set when the rendered name exceeded the limits
+	Shortened bool
+}
+
+func newNameContext(config *freenasProvisionerConfig, pvName string, claim *v1.PersistentVolumeClaim) nameContext {
+	data := nameContext{
+		PVName:    pvName,
+		ClusterID: config.ProvisionerClusterID,
+	}
+	if claim != nil {
+		data.PVCNamespace = claim.Namespace
+		data.PVCName = claim.Name
+		data.UID = string(claim.UID)
+	}
+	return data
+}
+
+func newNameContextFromVolume(config *freenasProvisionerConfig, volume *v1.PersistentVolume) nameContext {
+	data := nameContext{
+		PVName:    volume.Name,
+		ClusterID: config.ProvisionerClusterID,
+	}
+	if volume.Spec.ClaimRef != nil {
+		data.PVCNamespace = volume.Spec.ClaimRef.Namespace
+		data.PVCName = volume.Spec.ClaimRef.Name
+		data.UID = string(volume.Spec.ClaimRef.UID)
+	}
+	return data
+}
+
+// resolveNames renders the naming template and shortens the results so that
+// they stay within FreeNAS limits, datasetName is the dataset the zvol is
+// created in (including the pool)
+func resolveNames(config *freenasProvisionerConfig, datasetName string, data nameContext) (*volumeNames, error) {
+	nameTemplate := config.ProvisionerNameTemplate
+	if len(nameTemplate) < 1 {
+		nameTemplate = defaultNameTemplate
+	}
+
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name template (%s): %v", nameTemplate, err)
+	}
+
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name template (%s): %v", nameTemplate, err)
+	}
+
+	base := sanitizeName(rendered.String())
+	if len(base) < 1 {
+		return nil, fmt.Errorf("name template (%s) rendered an empty name", nameTemplate)
+	}
+
+	zvolBudget := maxExtentDiskNameLength - len("zvol/"+datasetName+"/")
+	if zvolBudget <= nameHashLength+1 {
+		return nil, fmt.Errorf("dataset name (%s) is too long to hold any zvol", datasetName)
+	}
+
+	iscsiBudget := maxISCSINameLength - len(config.ProvisionerISCSINamePrefix) - len(config.ProvisionerISCSINameSuffix)
+	if iscsiBudget <= nameHashLength+1 {
+		return nil, fmt.Errorf("iscsi name prefix (%s) and suffix (%s) are too long", config.ProvisionerISCSINamePrefix, config.ProvisionerISCSINameSuffix)
+	}
+
+	names := &volumeNames{
+		Base:      shortenName(base, zvolBudget),
+		ISCSIName: config.ProvisionerISCSINamePrefix + shortenName(base, iscsiBudget) + config.ProvisionerISCSINameSuffix,
+	}
+	names.Shortened = len(base) > zvolBudget || len(base) > iscsiBudget
+	return names, nil
+}
+
+// sanitizeName lowercases a name and replaces characters not allowed in
+// both zvol and iscsi names
+func sanitizeName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '.', r == ':':
+			return r
+		}
+		return '-'
+	}, name)
+}
+
+// shortenName deterministically truncates a name to max chars, a hash of the
+// full name is appended to keep truncated names unique
+func shortenName(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:nameHashLength]
+	return strings.TrimRight(name[:max-nameHashLength-1], "-.:") + "-" + hash
+}
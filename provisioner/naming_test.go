@@ -0,0 +1,188 @@
+package provisioner
+
+import (
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"pvc-1", "pvc-1"},
+		{"  PVC-1 ", "pvc-1"},
+		{"default/data_0", "default-data-0"},
+		{"iqn.2005-10.org:vol", "iqn.2005-10.org:vol"},
+		{"Ünïcode", "-n-code"},
+	}
+
+	for _, test := range tests {
+		if actual := sanitizeName(test.name); actual != test.expected {
+			t.Errorf("sanitizeName(%q): expected %q, got %q", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestShortenName(t *testing.T) {
+	long := strings.Repeat("a", 40)
+
+	tests := []struct {
+		name string
+		max  int
+	}{
+		{"short", 10},
+		{long, 40},
+		{long, 39},
+		{long, 20},
+		{strings.Repeat("a", 10) + "---" + strings.Repeat("b", 10), 20},
+	}
+
+	for _, test := range tests {
+		actual := shortenName(test.name, test.max)
+		if len(actual) > test.max {
+			t.Errorf("shortenName(%q, %d): %q is longer than %d", test.name, test.max, actual, test.max)
+		}
+		if len(test.name) <= test.max && actual != test.name {
+			t.Errorf("shortenName(%q, %d): expected the name unchanged, got %q", test.name, test.max, actual)
+		}
+		if shortenName(test.name, test.max) != actual {
+			t.Errorf("shortenName(%q, %d) is not deterministic", test.name, test.max)
+		}
+	}
+
+	// names only differing after the cut must stay apart
+	a := shortenName(long+"-a", 20)
+	b := shortenName(long+"-b", 20)
+	if a == b {
+		t.Errorf("shortened names of different names collide: %s", a)
+	}
+}
+
+func TestResolveNames(t *testing.T) {
+	data := nameContext{
+		PVName:       "pvc-0123456789",
+		PVCNamespace: "default",
+		PVCName:      "data",
+		UID:          "0123456789",
+		ClusterID:    "prod",
+	}
+
+	tests := []struct {
+		name      string
+		template  string
+		prefix    string
+		suffix    string
+		dataset   string
+		base      string
+		iscsiName string
+		shortened bool
+		err       string
+	}{
+		{
+			name:      "default",
+			dataset:   "tank/k8s",
+			base:      "pvc-0123456789",
+			iscsiName: "pvc-0123456789",
+		},
+		{
+			name:      "template",
+			template:  "{{ .ClusterID }}-{{ .PVCNamespace }}-{{ .PVCName }}-{{ .UID }}",
+			prefix:    "k8s-",
+			suffix:    "-lun",
+			dataset:   "tank/k8s",
+			base:      "prod-default-data-0123456789",
+			iscsiName: "k8s-prod-default-data-0123456789-lun",
+		},
+		{
+			name:      "sanitized",
+			template:  "{{ .PVCNamespace }}/{{ .PVCName }}_{{ .UID }}",
+			dataset:   "tank/k8s",
+			base:      "default-data-0123456789",
+			iscsiName: "default-data-0123456789",
+		},
+		{
+			name:      "shortened zvol",
+			dataset:   "tank/" + strings.Repeat("d", 40),
+			iscsiName: "pvc-0123456789",
+			shortened: true,
+		},
+		{
+			name:    "dataset too long",
+			dataset: "tank/" + strings.Repeat("d", 50),
+			err:     "too long to hold any zvol",
+		},
+		{
+			name:     "unknown field",
+			template: "{{ .Namespace }}",
+			dataset:  "tank/k8s",
+			err:      "invalid name template",
+		},
+		{
+			name:     "empty",
+			template: "{{ if false }}x{{ end }}",
+			dataset:  "tank/k8s",
+			err:      "rendered an empty name",
+		},
+		{
+			name:    "prefix too long",
+			prefix:  strings.Repeat("p", 115),
+			dataset: "tank/k8s",
+			err:     "too long",
+		},
+	}
+
+	for _, test := range tests {
+		config := &freenasProvisionerConfig{
+			ProvisionerNameTemplate:    test.template,
+			ProvisionerISCSINamePrefix: test.prefix,
+			ProvisionerISCSINameSuffix: test.suffix,
+		}
+		names, err := resolveNames(config, test.dataset, data)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		if len(test.base) > 0 && names.Base != test.base {
+			t.Errorf("%s: expected base %q, got %q", test.name, test.base, names.Base)
+		}
+		if names.ISCSIName != test.iscsiName {
+			t.Errorf("%s: expected iscsi name %q, got %q", test.name, test.iscsiName, names.ISCSIName)
+		}
+		if names.Shortened != test.shortened {
+			t.Errorf("%s: expected shortened %v, got %v", test.name, test.shortened, names.Shortened)
+		}
+		if disk := "zvol/" + test.dataset + "/" + names.Base; len(disk) > maxExtentDiskNameLength {
+			t.Errorf("%s: extent disk %s is longer than %d", test.name, disk, maxExtentDiskNameLength)
+		}
+	}
+}
+
+func TestUniqueTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		unique   bool
+	}{
+		{defaultNameTemplate, true},
+		{"{{ .UID }}", true},
+		{"{{ .PVCNamespace }}-{{ .PVCName }}-{{ .UID }}", true},
+		{"{{ .PVCNamespace }}-{{ .PVCName }}", false},
+		{"{{ .ClusterID }}", false},
+		{"static", false},
+	}
+
+	for _, test := range tests {
+		tmpl := template.Must(template.New("name").Option("missingkey=error").Parse(test.template))
+		if actual := uniqueTemplate(tmpl); actual != test.unique {
+			t.Errorf("uniqueTemplate(%q): expected %v, got %v", test.template, test.unique, actual)
+		}
+	}
+}
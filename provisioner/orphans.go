@@ -0,0 +1,398 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Orphan is a FreeNAS resource which is not referenced by any PersistentVolume
+type Orphan struct {
+	Server  string
+	Kind    string
+	Name    string
+	ID      int
+	Deleted bool
+}
+
+func (o Orphan) String() string {
+	if o.ID > 0 {
+		return fmt.Sprintf("%s %d (\"%s\") on %s", o.Kind, o.ID, o.Name, o.Server)
+	}
+	return fmt.Sprintf("%s \"%s\" on %s", o.Kind, o.Name, o.Server)
+}
+
+// orphanScan holds everything needed to scan a single FreeNAS server
+type orphanScan struct {
+	config   *freenasProvisionerConfig
+	parents  map[string]bool
+	prefixes map[string]bool
+	suffixes map[string]bool
+}
+
+// OrphanCollector finds (and optionally deletes) zvols, targets and extents
+// left behind by crashed provisioning or failed rollbacks
+type OrphanCollector struct {
+	Client          kubernetes.Interface
+	ProvisionerName string
+	GracePeriod     time.Duration
+	DryRun          bool
+
+	provisioner *freenasProvisioner
+	firstSeen   map[string]time.Time
+}
+
+// NewOrphanCollector creates a new collector instance
+func NewOrphanCollector(client kubernetes.Interface, provisionerName string, gracePeriod time.Duration, dryRun bool) *OrphanCollector {
+	return &OrphanCollector{
+		Client:          client,
+		ProvisionerName: provisionerName,
+		GracePeriod:     gracePeriod,
+		DryRun:          dryRun,
+		provisioner: &freenasProvisioner{
+			Client: client,
+		},
+		firstSeen: map[string]time.Time{},
+	}
+}
+
+// Run collects orphans every interval until the context is done
+func (c *OrphanCollector) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		_, err := c.Collect(ctx)
+		if err != nil {
+			glog.Errorf("orphan collection failed: %v", err)
+		}
+	}, interval)
+}
+
+// Collect runs a single pass, orphans are only deleted once they have been
+// seen continuously for the grace period
+func (c *OrphanCollector) Collect(ctx context.Context) ([]Orphan, error) {
+	classes, err := listStorageClasses(ctx, c.Client, c.ProvisionerName)
+	if err != nil {
+		return nil, err
+	}
+
+	scans := map[string]*orphanScan{}
+	classConfigs := map[string][]*freenasProvisionerConfig{}
+	for _, class := range classes {
+		configs, err := c.provisioner.GetConfigs(ctx, class.Name, nil)
+		if err != nil {
+			glog.Warningf("skipping StorageClass \"%s\" for orphan collection: %v", class.Name, err)
+			continue
+		}
+
+		classConfigs[class.Name] = configs
+
+		for _, config := range configs {
+			key := serverKey(config)
+			scan, ok := scans[key]
+			if !ok {
+				scan = &orphanScan{
+					config:   config,
+					parents:  map[string]bool{},
+					prefixes: map[string]bool{},
+					suffixes: map[string]bool{},
+				}
+				scans[key] = scan
+			}
+			scan.parents[config.DatasetParentName] = true
+			scan.prefixes[config.ProvisionerISCSINamePrefix] = true
+			scan.suffixes[config.ProvisionerISCSINameSuffix] = true
+		}
+	}
+
+	knownZvols, knownNames, err := c.getKnownNames(ctx, classConfigs)
+	if err != nil {
+		return nil, err
+	}
+
+	reservedZvols, reservedNames, err := c.getReservedNames(ctx, classConfigs)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []Orphan
+	for key, scan := range scans {
+		found, err := c.scanServer(key, scan, knownZvols, knownNames, reservedZvols, reservedNames)
+		if err != nil {
+			glog.Errorf("failed to scan %s for orphans: %v", key, err)
+			continue
+		}
+		orphans = append(orphans, found...)
+	}
+
+	now := time.Now()
+	seen := map[string]bool{}
+	for i := range orphans {
+		orphan := &orphans[i]
+		id := orphan.String()
+		seen[id] = true
+
+		first, ok := c.firstSeen[id]
+		if !ok {
+			first = now
+			c.firstSeen[id] = now
+		}
+
+		if now.Sub(first) < c.GracePeriod {
+			glog.Infof("orphaned %s found, within grace period", id)
+			continue
+		}
+
+		if c.DryRun {
+			glog.Infof("orphaned %s found, dry-run enabled", id)
+			continue
+		}
+
+		err = c.deleteOrphan(scans[orphan.Server].config, *orphan)
+		if err != nil {
+			glog.Errorf("failed to delete orphaned %s: %v", id, err)
+			continue
+		}
+		glog.Infof("deleted orphaned %s", id)
+		orphan.Deleted = true
+		delete(c.firstSeen, id)
+	}
+
+	// forget resources which are no longer orphaned
+	for id := range c.firstSeen {
+		if !seen[id] {
+			delete(c.firstSeen, id)
+		}
+	}
+
+	return orphans, nil
+}
+
+// getKnownNames returns the zvols (including pool) and iscsi names referenced by
+// PVs. Every PV with an iscsi source counts, PVs of this provisioner which lost
+// their annotations (e.g. restored from a backup) are mapped the way recovery
+// does, a PV which cannot be mapped fails the pass.
+func (c *OrphanCollector) getKnownNames(ctx context.Context, classConfigs map[string][]*freenasProvisionerConfig) (map[string]bool, map[string]bool, error) {
+	volumes, err := c.Client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	knownZvols := map[string]bool{}
+	knownNames := map[string]bool{}
+	for i := range volumes.Items {
+		volume := &volumes.Items[i]
+		iscsi := volume.Spec.PersistentVolumeSource.ISCSI
+		if iscsi == nil {
+			continue
+		}
+
+		// the iscsi name follows the base name, which may itself hold colons
+		for j, r := range iscsi.IQN {
+			if r == ':' && j+1 < len(iscsi.IQN) {
+				knownNames[iscsi.IQN[j+1:]] = true
+			}
+		}
+
+		_, hasIdentity := volume.Annotations[annIdentity]
+		_, hasClass := classConfigs[volume.Spec.StorageClassName]
+		if !hasIdentity && !hasClass && volume.Annotations[annProvisionedBy] != c.ProvisionerName {
+			continue
+		}
+
+		annotations := volume.Annotations
+		if needsRecovery(volume) {
+			recovered, err := c.provisioner.recoverAnnotations(ctx, volume)
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot map volume %s to its resources, not collecting orphans: %v", volume.Name, err)
+			}
+			annotations = map[string]string{}
+			for k, v := range volume.Annotations {
+				annotations[k] = v
+			}
+			for k, v := range recovered {
+				annotations[k] = v
+			}
+		}
+
+		pool := annotations[annPool]
+		zvol := annotations[annZvol]
+		if len(pool) < 1 || len(zvol) < 1 {
+			return nil, nil, fmt.Errorf("cannot map volume %s to its zvol, not collecting orphans", volume.Name)
+		}
+		knownZvols[pool+"/"+zvol] = true
+
+		iscsiName := annotations[annISCSIName]
+		if len(iscsiName) > 0 {
+			knownNames[iscsiName] = true
+		}
+	}
+
+	return knownZvols, knownNames, nil
+}
+
+// getReservedNames returns the zvol base names and iscsi names of volumes
+// currently being provisioned
+func (c *OrphanCollector) getReservedNames(ctx context.Context, classConfigs map[string][]*freenasProvisionerConfig) (map[string]bool, map[string]bool, error) {
+	claims, err := c.Client.CoreV1().PersistentVolumeClaims(v1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reservedZvols := map[string]bool{}
+	reservedNames := map[string]bool{}
+	for i := range claims.Items {
+		claim := &claims.Items[i]
+		if len(claim.Spec.VolumeName) > 0 || claim.Spec.StorageClassName == nil {
+			continue
+		}
+		// the volume may be placed on any server of the class
+		for _, config := range classConfigs[*claim.Spec.StorageClassName] {
+			// the provisioner controller names volumes after the claim UID
+			names, err := resolveNames(config, namespaceDatasetName(config, claim.Namespace), newNameContext(config, "pvc-"+string(claim.UID), claim))
+			if err != nil {
+				continue
+			}
+			reservedZvols[names.Base] = true
+			reservedNames[names.ISCSIName] = true
+		}
+	}
+
+	return reservedZvols, reservedNames, nil
+}
+
+func (c *OrphanCollector) scanServer(key string, scan *orphanScan, knownZvols, knownNames, reservedZvols, reservedNames map[string]bool) ([]Orphan, error) {
+	freenasServer, err := c.provisioner.GetServer(*scan.config)
+	if err != nil {
+		return nil, err
+	}
+
+	hasAffixes := func(name string) bool {
+		for prefix := range scan.prefixes {
+			for suffix := range scan.suffixes {
+				if len(prefix)+len(suffix) > 0 && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	underParent := func(path string) bool {
+		for parent := range scan.parents {
+			if strings.HasPrefix(path, parent+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	var zvolOrphans, extentOrphans, targetOrphans []Orphan
+
+	// zvols
+	pools := map[string]bool{}
+	for parent := range scan.parents {
+		pools[strings.Split(parent, "/")[0]] = true
+	}
+	for pool := range pools {
+		zvols, _, err := freenas.ListZvols(freenasServer, pool)
+		if err != nil {
+			return nil, err
+		}
+		for _, zvol := range zvols {
+			path := pool + "/" + zvol.Name
+			if !underParent(path) || knownZvols[path] {
+				continue
+			}
+			if reservedZvols[path[strings.LastIndex(path, "/")+1:]] {
+				continue
+			}
+			zvolOrphans = append(zvolOrphans, Orphan{Server: key, Kind: "zvol", Name: path})
+		}
+	}
+
+	// extents
+	extents, _, err := freenas.ListExtents(freenasServer)
+	if err != nil {
+		return nil, err
+	}
+	orphanedExtentNames := map[string]bool{}
+	for _, extent := range extents {
+		if knownNames[extent.Name] || reservedNames[extent.Name] {
+			continue
+		}
+		if !underParent(strings.TrimPrefix(extent.Disk, "zvol/")) && !hasAffixes(extent.Name) {
+			continue
+		}
+		orphanedExtentNames[extent.Name] = true
+		extentOrphans = append(extentOrphans, Orphan{Server: key, Kind: "extent", Name: extent.Name, ID: extent.ID})
+	}
+
+	// targets
+	targets, _, err := freenas.ListTargets(freenasServer)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range targets {
+		if knownNames[target.Name] || reservedNames[target.Name] {
+			continue
+		}
+		if !orphanedExtentNames[target.Name] && !hasAffixes(target.Name) {
+			continue
+		}
+		targetOrphans = append(targetOrphans, Orphan{Server: key, Kind: "target", Name: target.Name, ID: target.ID})
+	}
+
+	// ordered so that nothing is deleted while still being referenced
+	orphans := append(targetOrphans, extentOrphans...)
+	return append(orphans, zvolOrphans...), nil
+}
+
+func (c *OrphanCollector) deleteOrphan(config *freenasProvisionerConfig, orphan Orphan) error {
+	freenasServer, err := c.provisioner.GetServer(*config)
+	if err != nil {
+		return err
+	}
+
+	switch orphan.Kind {
+	case "target":
+		// NOTE: deleting a target inherently deletes associated targetgroup(s) and targettoextent(s)
+		target := freenas.Target{
+			ID: orphan.ID,
+		}
+		resp, err := target.Delete(freenasServer)
+		if err != nil && (resp == nil || resp.StatusCode != 404) {
+			return err
+		}
+	case "extent":
+		extent := freenas.Extent{
+			ID: orphan.ID,
+		}
+		resp, err := extent.Delete(freenasServer)
+		if err != nil && (resp == nil || resp.StatusCode != 404) {
+			return err
+		}
+	case "zvol":
+		parts := strings.SplitN(orphan.Name, "/", 2)
+		zvol := freenas.Zvol{
+			Name: parts[1],
+			Dataset: freenas.Dataset{
+				Pool: parts[0],
+			},
+		}
+		resp, err := zvol.Delete(freenasServer)
+		if err != nil && (resp == nil || resp.StatusCode != 404) {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown orphan kind %s", orphan.Kind)
+	}
+
+	return nil
+}
@@ -0,0 +1,365 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// server placement policies
+const (
+	placementMostFree   = "mostFree"
+	placementRoundRobin = "roundRobin"
+	placementWeighted   = "weighted"
+)
+
+// serverEntry is one of the servers (and its parent dataset) a StorageClass
+// may place volumes on
+type serverEntry struct {
+	Index           int
+	SecretNamespace string
+	SecretName      string
+	DatasetParent   string
+	Weight          int
+}
+
+// apply returns a copy of the config targeting the server
+func (e serverEntry) apply(config *freenasProvisionerConfig) *freenasProvisionerConfig {
+	c := *config
+	c.ServerSecretNamespace = e.SecretNamespace
+	c.ServerSecretName = e.SecretName
+	c.DatasetParentName = e.DatasetParent
+	c.ServerIndex = e.Index
+	return &c
+}
+
+// serverEntries lists the servers of a config, serverSecretNames entries are
+// given as name or namespace/name and datasetParentNames and serverWeights
+// are either empty or list one value per server
+func serverEntries(config *freenasProvisionerConfig) ([]serverEntry, error) {
+	if len(config.ServerSecretNames) < 1 {
+		return []serverEntry{{
+			SecretNamespace: config.ServerSecretNamespace,
+			SecretName:      config.ServerSecretName,
+			DatasetParent:   config.DatasetParentName,
+			Weight:          1,
+		}}, nil
+	}
+
+	secrets := splitList(config.ServerSecretNames)
+	datasets := splitList(config.DatasetParentNames)
+	weights := splitList(config.ServerWeights)
+	if len(datasets) > 0 && len(datasets) != len(secrets) {
+		return nil, fmt.Errorf("datasetParentNames lists %d datasets for %d servers", len(datasets), len(secrets))
+	}
+	if len(weights) > 0 && len(weights) != len(secrets) {
+		return nil, fmt.Errorf("serverWeights lists %d weights for %d servers", len(weights), len(secrets))
+	}
+
+	entries := make([]serverEntry, len(secrets))
+	for i, secret := range secrets {
+		entry := serverEntry{
+			Index:           i,
+			SecretNamespace: config.ServerSecretNamespace,
+			SecretName:      secret,
+			DatasetParent:   config.DatasetParentName,
+			Weight:          1,
+		}
+		if parts := strings.SplitN(secret, "/", 2); len(parts) == 2 {
+			entry.SecretNamespace = parts[0]
+			entry.SecretName = parts[1]
+		}
+		if len(datasets) > 0 {
+			entry.DatasetParent = datasets[i]
+		}
+		if len(weights) > 0 {
+			weight, err := strconv.Atoi(weights[i])
+			if err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid server weight (%s)", weights[i])
+			}
+			entry.Weight = weight
+		}
+		entries[i] = entry
+	}
+
+	return entries, nil
+}
+
+// splitList splits a comma separated parameter, ignoring whitespace
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// GetConfigs returns one config per server of a StorageClass, servers whose
+// secret cannot be read are skipped unless none remain. The profile of the
+// claim (if any) is applied.
+func (p *freenasProvisioner) GetConfigs(ctx context.Context, storageClassName string, claim *v1.PersistentVolumeClaim) ([]*freenasProvisionerConfig, error) {
+	return p.getConfigs(ctx, storageClassName, claim, true)
+}
+
+// getVolumeConfigs is GetConfigs for managing existing volumes, parameters are
+// parsed leniently
+func (p *freenasProvisioner) getVolumeConfigs(ctx context.Context, storageClassName string) ([]*freenasProvisionerConfig, error) {
+	return p.getConfigs(ctx, storageClassName, nil, false)
+}
+
+func (p *freenasProvisioner) getConfigs(ctx context.Context, storageClassName string, claim *v1.PersistentVolumeClaim, strict bool) ([]*freenasProvisionerConfig, error) {
+	class, err := p.Client.StorageV1().StorageClasses().Get(ctx, storageClassName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	parameters, err := p.resolveProfile(ctx, class.Parameters, claim)
+	if err != nil {
+		return nil, err
+	}
+
+	var config *freenasProvisionerConfig
+	if strict {
+		config, err = parseParameters(parameters)
+	} else {
+		config, err = parseParametersLenient(storageClassName, parameters)
+	}
+	if err != nil {
+		return nil, err
+	}
+	config.ReclaimPolicy = class.ReclaimPolicy
+
+	entries, err := serverEntries(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []*freenasProvisionerConfig
+	var errs []string
+	for _, entry := range entries {
+		c := entry.apply(config)
+		err = p.applyServerSecret(ctx, c)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s/%s: %v", entry.SecretNamespace, entry.SecretName, err))
+			continue
+		}
+		configs = append(configs, c)
+	}
+
+	if len(configs) < 1 {
+		return nil, fmt.Errorf("no usable server for StorageClass \"%s\": %s", storageClassName, strings.Join(errs, "; "))
+	}
+	for _, e := range errs {
+		glog.Warningf("skipping server of StorageClass \"%s\": %s", storageClassName, e)
+	}
+
+	return configs, nil
+}
+
+// placement is the server and parent dataset chosen for a new volume
+type placement struct {
+	config      *freenasProvisionerConfig
+	server      *freenas.Server
+	iscsiConfig *freenas.ISCSIConfig
+	parentDs    *freenas.Dataset
+
+	// the parent dataset does not exist yet, parentDs is its closest ancestor
+	createParent bool
+}
+
+// placeVolume chooses the server a volume of size bytes is created on.
+// Servers which cannot be reached, lack the parent dataset or violate the
+// capacity policy are skipped.
+func (p *freenasProvisioner) placeVolume(storageClassName string, configs []*freenasProvisionerConfig, size int64) (*placement, error) {
+	// a single server keeps its original errors
+	if len(configs) == 1 {
+		result, err := p.probeServer(configs[0], size)
+		if err != nil {
+			return nil, err
+		}
+		return result, p.createParent(result)
+	}
+
+	entries, err := serverEntries(configs[0])
+	if err != nil {
+		return nil, err
+	}
+	// a secret may be listed several times (e.g. with different datasets)
+	weights := map[int]int{}
+	for _, entry := range entries {
+		weights[entry.Index] = entry.Weight
+	}
+
+	choose := func(result *placement) (*placement, error) {
+		err := p.createParent(result)
+		if err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+
+	var errs []string
+	probe := func(config *freenasProvisionerConfig) *placement {
+		result, err := p.probeServer(config, size)
+		if err != nil {
+			glog.Warningf("skipping server %s for StorageClass \"%s\": %v", serverKey(config), storageClassName, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", serverKey(config), err))
+			return nil
+		}
+		return result
+	}
+
+	policy := configs[0].ServerPlacementPolicy
+	switch policy {
+	case placementMostFree:
+		var best *placement
+		for _, config := range configs {
+			result := probe(config)
+			if result != nil && (best == nil || result.parentDs.Avail > best.parentDs.Avail) {
+				best = result
+			}
+		}
+		if best != nil {
+			return choose(best)
+		}
+	case placementRoundRobin:
+		start := p.nextPlacement(storageClassName)
+		for i := range configs {
+			result := probe(configs[(start+i)%len(configs)])
+			if result != nil {
+				return choose(result)
+			}
+		}
+	case placementWeighted:
+		// weighted random order without replacement
+		candidates := make([]*freenasProvisionerConfig, 0, len(configs))
+		for _, config := range configs {
+			if weights[config.ServerIndex] > 0 {
+				candidates = append(candidates, config)
+			}
+		}
+		for len(candidates) > 0 {
+			total := 0
+			for _, config := range candidates {
+				total += weights[config.ServerIndex]
+			}
+			n := rand.Intn(total)
+			i := 0
+			for ; i < len(candidates)-1; i++ {
+				n -= weights[candidates[i].ServerIndex]
+				if n < 0 {
+					break
+				}
+			}
+			result := probe(candidates[i])
+			if result != nil {
+				return choose(result)
+			}
+			candidates = append(candidates[:i], candidates[i+1:]...)
+		}
+	default:
+		return nil, fmt.Errorf("invalid serverPlacementPolicy (%s), must be one of %s, %s or %s", policy, placementMostFree, placementRoundRobin, placementWeighted)
+	}
+
+	return nil, fmt.Errorf("no server of StorageClass \"%s\" can hold the volume: %s", storageClassName, strings.Join(errs, "; "))
+}
+
+// probeServer checks that a server is reachable, has the parent dataset (or
+// will create it) and satisfies the capacity policy. Nothing is created, a
+// missing parent dataset is measured on its closest existing ancestor.
+func (p *freenasProvisioner) probeServer(config *freenasProvisionerConfig, size int64) (*placement, error) {
+	freenasServer, err := p.GetServer(*config)
+	if err != nil {
+		return nil, err
+	}
+
+	// get iscsi configuration
+	iscsiConfig := freenas.ISCSIConfig{}
+	_, err = iscsiConfig.Get(freenasServer)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &placement{
+		config:      config,
+		server:      freenasServer,
+		iscsiConfig: &iscsiConfig,
+	}
+
+	// get parent dataset
+	name := config.DatasetParentName
+	for {
+		parentDs := &freenas.Dataset{
+			Name: name,
+		}
+		resp, err := parentDs.Get(freenasServer)
+		found, err := checkFound(resp, err)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			result.parentDs = parentDs
+			break
+		}
+
+		i := strings.LastIndex(name, "/")
+		if !config.DatasetParentCreate || i < 1 {
+			return nil, fmt.Errorf("dataset %s does not exist", config.DatasetParentName)
+		}
+		result.createParent = true
+		name = name[:i]
+	}
+
+	if config.DatasetParentCreate && !result.createParent {
+		err = checkDatasetMountpoint(config.DatasetParentName, result.parentDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// refuse to overcommit the parent dataset before anything is created
+	err = checkCapacity(freenasServer, config, result.parentDs, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// createParent creates the missing parent dataset of the chosen server
+func (p *freenasProvisioner) createParent(result *placement) error {
+	if !result.createParent {
+		return nil
+	}
+
+	parentDs, err := p.ensureParentDataset(result.server, result.config)
+	if err != nil {
+		return err
+	}
+	result.parentDs = parentDs
+	result.createParent = false
+	return nil
+}
+
+// nextPlacement returns the round-robin position of a StorageClass
+func (p *freenasProvisioner) nextPlacement(storageClassName string) int {
+	p.placementMutex.Lock()
+	defer p.placementMutex.Unlock()
+
+	if p.placementCounters == nil {
+		p.placementCounters = map[string]int{}
+	}
+	n := p.placementCounters[storageClassName]
+	p.placementCounters[storageClassName] = n + 1
+	return n
+}
@@ -0,0 +1,119 @@
+package provisioner
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+)
+
+// iscsi port used when a portal address does not carry one
+const defaultISCSIPort = "3260"
+
+// applyGroupPortals sets the target portal and multipath portals from the
+// addresses of the portal group referenced by targetGroupPortalgroup
+func applyGroupPortals(freenasServer *freenas.Server, config *freenasProvisionerConfig) error {
+	if !config.ProvisionerPortalsFromGroup {
+		return nil
+	}
+
+	portal := freenas.Portal{ID: config.TargetGroupPortalgroup}
+	resp, err := portal.Get(freenasServer)
+	found, err := checkFound(resp, err)
+	if err != nil {
+		return fmt.Errorf("failed to get portal %d: %v", portal.ID, err)
+	}
+	if !found {
+		return fmt.Errorf("portal %d (targetGroupPortalgroup) does not exist", portal.ID)
+	}
+
+	addresses, err := portalAddresses(&portal, config.ServerHost)
+	if err != nil {
+		return err
+	}
+
+	config.ProvisionerTargetPortal = addresses[0]
+	config.ProvisionerPortals = strings.Join(addresses[1:], ",")
+	return nil
+}
+
+// portalAddresses returns the host:port of each listen address of a portal.
+// Wildcard addresses are replaced by the host of the FreeNAS API as the portal
+// listens on every interface.
+func portalAddresses(portal *freenas.Portal, serverHost string) ([]string, error) {
+	serverHost = strings.TrimSuffix(strings.TrimPrefix(serverHost, "["), "]")
+
+	var addresses []string
+	seen := map[string]bool{}
+	for _, ip := range portal.Ips {
+		host, port, err := splitPortalAddress(ip)
+		if err != nil {
+			return nil, fmt.Errorf("portal %d: %v", portal.ID, err)
+		}
+		if addr := net.ParseIP(host); addr != nil && addr.IsUnspecified() {
+			host = serverHost
+		}
+
+		address := net.JoinHostPort(host, port)
+		if !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+
+	if len(addresses) < 1 {
+		return nil, fmt.Errorf("portal %d has no listen addresses", portal.ID)
+	}
+	return addresses, nil
+}
+
+// splitPortalAddress splits a portal listen address into host and port. IPv6
+// addresses may be given with or without brackets, the port is optional
+// unless that would be ambiguous.
+func splitPortalAddress(address string) (string, string, error) {
+	address = strings.TrimSpace(address)
+	host, port := address, defaultISCSIPort
+
+	switch {
+	case strings.HasPrefix(address, "["):
+		end := strings.Index(address, "]")
+		if end < 0 {
+			return "", "", fmt.Errorf("invalid portal address %s", address)
+		}
+		host = address[1:end]
+		rest := address[end+1:]
+		if len(rest) > 0 {
+			if !strings.HasPrefix(rest, ":") {
+				return "", "", fmt.Errorf("invalid portal address %s", address)
+			}
+			port = rest[1:]
+		}
+	case strings.Count(address, ":") == 1:
+		i := strings.Index(address, ":")
+		host, port = address[:i], address[i+1:]
+	case strings.Count(address, ":") > 1:
+		// FreeNAS appends the port to IPv6 addresses without brackets
+		i := strings.LastIndex(address, ":")
+		if net.ParseIP(address[:i]) != nil && isPort(address[i+1:]) {
+			host, port = address[:i], address[i+1:]
+		} else if net.ParseIP(address) == nil {
+			return "", "", fmt.Errorf("invalid portal address %s", address)
+		}
+	}
+
+	if len(host) < 1 {
+		return "", "", fmt.Errorf("invalid portal address %s", address)
+	}
+	if !isPort(port) {
+		return "", "", fmt.Errorf("invalid port in portal address %s", address)
+	}
+	return host, port, nil
+}
+
+// isPort reports whether value is a valid tcp port number
+func isPort(value string) bool {
+	n, err := strconv.Atoi(value)
+	return err == nil && n > 0 && n <= 65535
+}
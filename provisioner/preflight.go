@@ -0,0 +1,231 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+// names of the individual preflight checks, used as the check metric label
+const (
+	preflightServer         = "server"
+	preflightISCSIConfig    = "iscsi_config"
+	preflightPortalGroup    = "portal_group"
+	preflightInitiatorGroup = "initiator_group"
+	preflightAuthGroup      = "auth_group"
+	preflightDataset        = "dataset"
+)
+
+// PreflightResult is the outcome of checking a StorageClass on one server
+type PreflightResult struct {
+	StorageClass string
+	Server       string
+	Problems     []string
+}
+
+// PreflightChecker verifies that the iscsi resources and parent dataset
+// referenced by each StorageClass exist before they are needed to provision
+type PreflightChecker struct {
+	Client          kubernetes.Interface
+	ProvisionerName string
+
+	provisioner *freenasProvisioner
+	recorder    record.EventRecorder
+
+	mutex   sync.Mutex
+	failing map[string]bool
+}
+
+// NewPreflightChecker creates a new checker instance
+func NewPreflightChecker(client kubernetes.Interface, provisionerName string) *PreflightChecker {
+	return &PreflightChecker{
+		Client:          client,
+		ProvisionerName: provisionerName,
+		provisioner: &freenasProvisioner{
+			Client: client,
+		},
+		recorder: newEventRecorder(client, "freenas-iscsi-preflight"),
+		failing:  map[string]bool{},
+	}
+}
+
+// Run checks all StorageClasses every interval until the context is done
+func (c *PreflightChecker) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		_, err := c.Check(ctx)
+		if err != nil {
+			glog.Errorf("preflight check failed: %v", err)
+		}
+	}, interval)
+}
+
+// Check runs a single pass over all StorageClasses using this provisioner
+func (c *PreflightChecker) Check(ctx context.Context) ([]PreflightResult, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	classes, err := listStorageClasses(ctx, c.Client, c.ProvisionerName)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []PreflightResult
+	for i := range classes {
+		class := &classes[i]
+		configs, err := c.provisioner.GetConfigs(ctx, class.Name, nil)
+		if err != nil {
+			glog.Errorf("StorageClass \"%s\" failed preflight: %v", class.Name, err)
+			c.recorder.Eventf(class, v1.EventTypeWarning, "PreflightFailed", "%v", err)
+			continue
+		}
+
+		for _, config := range configs {
+			result := c.checkClass(class, config)
+			results = append(results, *result)
+		}
+	}
+	preflightLastRun.SetToCurrentTime()
+
+	return results, nil
+}
+
+// checkClass checks a StorageClass on one server, reporting the outcome as
+// events on the StorageClass and as metrics
+func (c *PreflightChecker) checkClass(class *storagev1.StorageClass, config *freenasProvisionerConfig) *PreflightResult {
+	result := &PreflightResult{
+		StorageClass: class.Name,
+		Server:       serverKey(config),
+	}
+
+	checks := c.checkConfig(config)
+	_, unreachable := checks[preflightServer]
+	for _, name := range []string{preflightServer, preflightISCSIConfig, preflightPortalGroup, preflightInitiatorGroup, preflightAuthGroup, preflightDataset} {
+		problem, failed := checks[name]
+		if unreachable && name != preflightServer {
+			// the check did not run, drop its last outcome
+			preflightStatus.DeleteLabelValues(class.Name, result.Server, name)
+			continue
+		}
+		status := 1.0
+		if failed {
+			status = 0
+			result.Problems = append(result.Problems, problem)
+		}
+		preflightStatus.WithLabelValues(class.Name, result.Server, name).Set(status)
+	}
+
+	key := class.Name + "|" + result.Server
+	if len(result.Problems) > 0 {
+		glog.Errorf("StorageClass \"%s\" failed preflight on %s: %s", class.Name, result.Server, strings.Join(result.Problems, "; "))
+		c.recorder.Eventf(class, v1.EventTypeWarning, "PreflightFailed", "%s: %s", result.Server, strings.Join(result.Problems, "; "))
+		c.failing[key] = true
+	} else if c.failing[key] {
+		glog.Infof("StorageClass \"%s\" passed preflight on %s", class.Name, result.Server)
+		c.recorder.Eventf(class, v1.EventTypeNormal, "PreflightPassed", "%s: all checks passed", result.Server)
+		delete(c.failing, key)
+	}
+
+	return result
+}
+
+// checkConfig runs the individual checks, returning a problem per failed check.
+// Checks which cannot run because the server is unreachable are not reported
+// separately.
+func (c *PreflightChecker) checkConfig(config *freenasProvisionerConfig) map[string]string {
+	problems := map[string]string{}
+
+	freenasServer, err := c.provisioner.GetServer(*config)
+	if err != nil {
+		problems[preflightServer] = err.Error()
+		return problems
+	}
+
+	iscsiConfig := freenas.ISCSIConfig{}
+	_, err = iscsiConfig.Get(freenasServer)
+	if err != nil {
+		problems[preflightServer] = fmt.Sprintf("failed to get iscsi configuration: %v", err)
+		return problems
+	}
+	if len(iscsiConfig.Basename) < 1 {
+		problems[preflightISCSIConfig] = "iscsi base name is not set"
+	} else if !strings.HasPrefix(iscsiConfig.Basename, "iqn.") && !strings.HasPrefix(iscsiConfig.Basename, "eui.") && !strings.HasPrefix(iscsiConfig.Basename, "naa.") {
+		problems[preflightISCSIConfig] = fmt.Sprintf("iscsi base name %s is not an iqn, eui or naa name", iscsiConfig.Basename)
+	}
+
+	if config.TargetGroupPortalgroup < 1 {
+		problems[preflightPortalGroup] = "targetGroupPortalgroup is not set"
+	} else {
+		portal := freenas.Portal{ID: config.TargetGroupPortalgroup}
+		resp, err := portal.Get(freenasServer)
+		found, err := checkFound(resp, err)
+		if err != nil {
+			problems[preflightPortalGroup] = fmt.Sprintf("failed to get portal %d: %v", portal.ID, err)
+		} else if !found {
+			problems[preflightPortalGroup] = fmt.Sprintf("portal %d (targetGroupPortalgroup) does not exist", portal.ID)
+		}
+	}
+
+	if config.TargetGroupInitiatorgroup > 0 {
+		initiator := freenas.Initiator{ID: config.TargetGroupInitiatorgroup}
+		resp, err := initiator.Get(freenasServer)
+		found, err := checkFound(resp, err)
+		if err != nil {
+			problems[preflightInitiatorGroup] = fmt.Sprintf("failed to get initiator %d: %v", initiator.ID, err)
+		} else if !found {
+			problems[preflightInitiatorGroup] = fmt.Sprintf("initiator %d (targetGroupInitiatorgroup) does not exist", initiator.ID)
+		}
+	}
+
+	if config.TargetGroupAuthgroup > 0 {
+		problem, err := checkAuthGroup(freenasServer, config)
+		if err != nil {
+			problems[preflightAuthGroup] = fmt.Sprintf("failed to list authcredentials: %v", err)
+		} else if len(problem) > 0 {
+			problems[preflightAuthGroup] = problem
+		}
+	}
+
+	problem, err := checkParentDataset(freenasServer, config)
+	if err != nil {
+		problems[preflightDataset] = fmt.Sprintf("failed to get dataset %s: %v", config.DatasetParentName, err)
+	} else if len(problem) > 0 {
+		problems[preflightDataset] = problem
+	}
+
+	return problems
+}
+
+// checkAuthGroup makes sure at least one credential carries the auth group tag
+// and that mutual CHAP has a peer to authenticate with
+func checkAuthGroup(freenasServer *freenas.Server, config *freenasProvisionerConfig) (string, error) {
+	credentials, _, err := freenas.ListAuthCredentials(freenasServer)
+	if err != nil {
+		return "", err
+	}
+
+	found := false
+	for _, credential := range credentials {
+		if credential.Tag != config.TargetGroupAuthgroup {
+			continue
+		}
+		found = true
+		if config.TargetGroupAuthtype != "CHAP Mutual" || len(credential.Peeruser) > 0 {
+			return "", nil
+		}
+	}
+
+	if !found {
+		return fmt.Sprintf("auth group %d (targetGroupAuthgroup) does not exist", config.TargetGroupAuthgroup), nil
+	}
+	return fmt.Sprintf("auth group %d has no credential with a peer user as required by CHAP Mutual", config.TargetGroupAuthgroup), nil
+}
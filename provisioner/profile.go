@@ -0,0 +1,78 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// profiles are read from this ConfigMap unless profileConfigMap is set
+const defaultProfileConfigMap = "kube-system/freenas-iscsi-profiles"
+
+// profileParameter checks if a StorageClass parameter may be set by a profile
+func profileParameter(key string) bool {
+	return key == "fsType" || key == "zfsProperties" || strings.HasPrefix(key, "zvol") || strings.HasPrefix(key, "extent")
+}
+
+// resolveProfile merges the parameters of the selected profile below the
+// StorageClass parameters. The profile is named by the profile parameter or,
+// when profile is listed in pvcAnnotationAllowlist, the freenas.org/profile
+// annotation of the claim. Profiles are stored in a ConfigMap keyed by name,
+// each value being a YAML map of StorageClass parameters.
+func (p *freenasProvisioner) resolveProfile(ctx context.Context, parameters map[string]string, claim *v1.PersistentVolumeClaim) (map[string]string, error) {
+	name := parameters["profile"]
+	if claim != nil {
+		if value, ok := claim.Annotations[propertyAnnotationPrefix+"profile"]; ok {
+			for _, key := range splitList(parameters["pvcAnnotationAllowlist"]) {
+				if key == "profile" {
+					name = value
+				}
+			}
+		}
+	}
+	if len(name) < 1 {
+		return parameters, nil
+	}
+
+	location := parameters["profileConfigMap"]
+	if len(location) < 1 {
+		location = defaultProfileConfigMap
+	}
+	parts := strings.SplitN(location, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("profileConfigMap (%s) must be given as namespace/name", location)
+	}
+
+	configMap, err := p.Client.CoreV1().ConfigMaps(parts[0]).Get(ctx, parts[1], metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get profiles from %s: %v", location, err)
+	}
+	data, ok := configMap.Data[name]
+	if !ok {
+		return nil, fmt.Errorf("profile %s does not exist in %s", name, location)
+	}
+
+	profile := map[string]string{}
+	err = yaml.Unmarshal([]byte(data), &profile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid profile %s in %s: %v", name, location, err)
+	}
+
+	merged := map[string]string{}
+	for k, v := range profile {
+		if !profileParameter(k) {
+			return nil, fmt.Errorf("invalid profile %s in %s: parameter %s cannot be set by a profile", name, location, k)
+		}
+		merged[k] = v
+	}
+	for k, v := range parameters {
+		merged[k] = v
+	}
+	merged["profile"] = name
+
+	return merged, nil
+}
@@ -0,0 +1,246 @@
+package provisioner
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	v1 "k8s.io/api/core/v1"
+)
+
+// PVC annotations overriding volume properties are prefixed with this
+const propertyAnnotationPrefix = "freenas.org/"
+
+// volumeProperty is a zvol property or extent setting which may be set per
+// volume, zfs properties the zvol endpoint of the FreeNAS v1.0 API does not
+// take are set through the dataset endpoint once the zvol exists
+type volumeProperty struct {
+	zfs     bool
+	dataset bool
+	values  []string
+	get     func(config *freenasProvisionerConfig) string
+	set     func(config *freenasProvisionerConfig, value string) error
+}
+
+var volumeProperties = map[string]volumeProperty{
+	"compression": {
+		zfs:    true,
+		values: []string{"inherit", "on", "off", "lz4", "lzjb", "zle", "gzip", "gzip-1", "gzip-2", "gzip-3", "gzip-4", "gzip-5", "gzip-6", "gzip-7", "gzip-8", "gzip-9"},
+		get:    func(c *freenasProvisionerConfig) string { return c.ZvolCompression },
+		set: func(c *freenasProvisionerConfig, v string) error {
+			c.ZvolCompression = v
+			return nil
+		},
+	},
+	"dedup": {
+		zfs:    true,
+		values: []string{"inherit", "on", "off", "verify"},
+		get:    func(c *freenasProvisionerConfig) string { return c.ZvolDedup },
+		set: func(c *freenasProvisionerConfig, v string) error {
+			c.ZvolDedup = v
+			return nil
+		},
+	},
+	"volblocksize": {
+		zfs:    true,
+		values: []string{"512", "1K", "2K", "4K", "8K", "16K", "32K", "64K", "128K"},
+		get:    func(c *freenasProvisionerConfig) string { return c.ZvolBlocksize },
+		set: func(c *freenasProvisionerConfig, v string) error {
+			c.ZvolBlocksize = v
+			return nil
+		},
+	},
+	"sync": {
+		zfs:     true,
+		dataset: true,
+		values:  []string{"standard", "always", "disabled"},
+		get:     func(c *freenasProvisionerConfig) string { return c.ZvolSync },
+		set: func(c *freenasProvisionerConfig, v string) error {
+			c.ZvolSync = v
+			return nil
+		},
+	},
+	"logbias": {
+		zfs:     true,
+		dataset: true,
+		values:  []string{"latency", "throughput"},
+		get:     func(c *freenasProvisionerConfig) string { return c.ZvolLogbias },
+		set: func(c *freenasProvisionerConfig, v string) error {
+			c.ZvolLogbias = v
+			return nil
+		},
+	},
+	"primarycache": {
+		zfs:     true,
+		dataset: true,
+		values:  []string{"all", "none", "metadata"},
+		get:     func(c *freenasProvisionerConfig) string { return c.ZvolPrimarycache },
+		set: func(c *freenasProvisionerConfig, v string) error {
+			c.ZvolPrimarycache = v
+			return nil
+		},
+	},
+	"volmode": {
+		zfs:     true,
+		dataset: true,
+		values:  []string{"default", "geom", "dev", "none"},
+		get:     func(c *freenasProvisionerConfig) string { return c.ZvolVolmode },
+		set: func(c *freenasProvisionerConfig, v string) error {
+			c.ZvolVolmode = v
+			return nil
+		},
+	},
+	"extentBlocksize": {
+		values: []string{"512", "1024", "2048", "4096"},
+		get:    func(c *freenasProvisionerConfig) string { return strconv.Itoa(c.ExtentBlocksize) },
+		set: func(c *freenasProvisionerConfig, v string) (err error) {
+			c.ExtentBlocksize, err = strconv.Atoi(v)
+			return err
+		},
+	},
+	"extentRpm": {
+		values: []string{"Unknown", "SSD", "5400", "7200", "10000", "15000"},
+		get:    func(c *freenasProvisionerConfig) string { return c.ExtentRpm },
+		set: func(c *freenasProvisionerConfig, v string) error {
+			c.ExtentRpm = v
+			return nil
+		},
+	},
+	"extentReadOnly": {
+		values: []string{"true", "false"},
+		get:    func(c *freenasProvisionerConfig) string { return strconv.FormatBool(c.ExtentReadOnly) },
+		set: func(c *freenasProvisionerConfig, v string) (err error) {
+			c.ExtentReadOnly, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+}
+
+// setVolumeProperty validates and sets a single property
+func setVolumeProperty(config *freenasProvisionerConfig, key, value string) error {
+	property, ok := volumeProperties[key]
+	if !ok {
+		return fmt.Errorf("unsupported volume property %s", key)
+	}
+	for _, v := range property.values {
+		if v == value {
+			return property.set(config, value)
+		}
+	}
+	return fmt.Errorf("invalid value (%s) for volume property %s, must be one of %s", value, key, strings.Join(property.values, ", "))
+}
+
+// parseProperties parses a list of key=value pairs
+func parseProperties(value string) (map[string]string, error) {
+	properties := map[string]string{}
+	for _, item := range splitList(value) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || len(parts[0]) < 1 {
+			return nil, fmt.Errorf("invalid property (%s), must be key=value", item)
+		}
+		properties[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return properties, nil
+}
+
+// applyVolumeProperties returns a copy of the config with the zfsProperties of
+// the StorageClass applied followed by the PVC annotations named in
+// pvcAnnotationAllowlist
+func applyVolumeProperties(config *freenasProvisionerConfig, claim *v1.PersistentVolumeClaim) (*freenasProvisionerConfig, error) {
+	c := *config
+
+	properties, err := parseProperties(config.ZFSProperties)
+	if err != nil {
+		return nil, fmt.Errorf("invalid zfsProperties: %v", err)
+	}
+	for key, value := range properties {
+		if property, ok := volumeProperties[key]; !ok || !property.zfs {
+			return nil, fmt.Errorf("invalid zfsProperties: zfs property %s cannot be set through the FreeNAS %s API, supported are %s", key, freenas.APIVersion, strings.Join(zfsPropertyNames(), ", "))
+		}
+		err = setVolumeProperty(&c, key, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zfsProperties: %v", err)
+		}
+	}
+
+	allowed := map[string]bool{}
+	for _, key := range splitList(config.PVCAnnotationAllowlist) {
+		// profiles are resolved with the StorageClass parameters
+		if key == "profile" {
+			continue
+		}
+		if _, ok := volumeProperties[key]; !ok {
+			return nil, fmt.Errorf("invalid pvcAnnotationAllowlist: unsupported volume property %s", key)
+		}
+		allowed[key] = true
+	}
+
+	if claim == nil {
+		return &c, nil
+	}
+
+	for annotation, value := range claim.Annotations {
+		if !strings.HasPrefix(annotation, propertyAnnotationPrefix) {
+			continue
+		}
+		key := strings.TrimPrefix(annotation, propertyAnnotationPrefix)
+		if _, ok := volumeProperties[key]; !ok {
+			continue
+		}
+		if !allowed[key] {
+			glog.Warningf("ignoring annotation %s of claim %s/%s, %s is not in pvcAnnotationAllowlist", annotation, claim.Namespace, claim.Name, key)
+			continue
+		}
+		err = setVolumeProperty(&c, key, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid annotation %s: %v", annotation, err)
+		}
+	}
+
+	return &c, nil
+}
+
+// effectiveProperties formats the zfs properties (or extent settings) set on
+// a volume as a sorted key=value list, unset values are omitted
+func effectiveProperties(config *freenasProvisionerConfig, zfs bool) string {
+	var items []string
+	for key, property := range volumeProperties {
+		if property.zfs != zfs {
+			continue
+		}
+		value := property.get(config)
+		if len(value) < 1 || value == "0" {
+			continue
+		}
+		items = append(items, key+"="+value)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+// datasetProperties returns the zfs properties of a volume which are set
+// through the dataset endpoint, unset values are omitted
+func datasetProperties(config *freenasProvisionerConfig) map[string]string {
+	properties := map[string]string{}
+	for key, property := range volumeProperties {
+		if value := property.get(config); property.dataset && len(value) > 0 {
+			properties[key] = value
+		}
+	}
+	return properties
+}
+
+// zfsPropertyNames lists the supported zfs properties
+func zfsPropertyNames() []string {
+	var names []string
+	for key, property := range volumeProperties {
+		if property.zfs {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -2,17 +2,23 @@ package provisioner
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/golang/glog"
 	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
 	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
 )
 
@@ -21,6 +27,39 @@ var (
 	_ controller.Provisioner = &freenasProvisioner{}
 )
 
+// annProvisionedBy is set on every PV by the provisioner controller
+const annProvisionedBy = "pv.kubernetes.io/provisioned-by"
+
+// PV annotations written at provision time, everything required to delete
+// the volume must be recorded here
+const (
+	annIdentity              = "freenasISCSIProvisionerIdentity"
+	annAPIVersion            = "freenasAPIVersion"
+	annServerSecretNamespace = "serverSecretNamespace"
+	annServerSecretName      = "serverSecretName"
+	annDatasetParent         = "datasetParent"
+	annPool                  = "pool"
+	annZvol                  = "zvol"
+	annISCSIName             = "iscsiName"
+	annTargetID              = "targetId"
+	annTargetGroupID         = "targetGroupId"
+	annExtentID              = "extentId"
+	annTargetToExtentID      = "targetToExtentId"
+	annInitiatorGroupID      = "initiatorGroupId"
+	annAuthCredentialID      = "authCredentialId"
+	annZFSProperties         = "freenasZfsProperties"
+	annExtentSettings        = "freenasExtentSettings"
+	annProfile               = "freenasProfile"
+)
+
+// PV annotations maintained by the background reconcilers
+const (
+	annDriftStatus     = "freenasDriftStatus"
+	annDriftMessage    = "freenasDriftMessage"
+	annUsedBytes       = "freenasUsedBytes"
+	annReferencedBytes = "freenasReferencedBytes"
+)
+
 type freenasProvisionerConfig struct {
 	// common params
 	FSType        string
@@ -30,12 +69,28 @@ type freenasProvisionerConfig struct {
 	ProvisionerRollbackPartialFailures bool
 	ProvisionerTargetPortal            string
 	ProvisionerPortals                 string
+	ProvisionerPortalsFromGroup        bool
 	ProvisionerISCSINamePrefix         string
 	ProvisionerISCSINameSuffix         string
 	ProvisionerISCSIInterface          string
+	ProvisionerNameTemplate            string
+	ProvisionerClusterID               string
 
 	// Dataset options
-	DatasetParentName string
+	DatasetParentName               string
+	DatasetPerNamespace             bool
+	DatasetNamespaceQuota           string
+	DatasetNamespaceQuotaAnnotation string
+	DatasetNamespaceQuotaConfigMap  string
+	DatasetParentCreate             bool
+	DatasetParentCompression        string
+	DatasetParentQuota              string
+	DatasetParentReservation        string
+	DatasetParentComments           string
+
+	// Capacity options
+	CapacityOvercommitRatio string
+	CapacityMinFree         string
 
 	// TargetGroup options
 	TargetGroupAuthgroup      int
@@ -44,9 +99,11 @@ type freenasProvisionerConfig struct {
 	TargetGroupPortalgroup    int
 
 	// Authentication options
-	DiscoveryCHAPAuth bool
-	SessionCHAPAuth   bool
-	AuthSecretRef     *v1.SecretReference
+	DiscoveryCHAPAuth   bool
+	SessionCHAPAuth     bool
+	AuthSecretRef       *v1.SecretReference
+	AuthPerVolume       bool
+	DiscoveryCHAPManage bool
 
 	// Zvol options
 	ZvolCompression string
@@ -54,6 +111,21 @@ type freenasProvisionerConfig struct {
 	ZvolSparse      bool
 	ZvolForce       bool
 	ZvolBlocksize   string
+	ZFSProperties   string
+	// set after creation through the dataset endpoint
+	ZvolSync         string
+	ZvolLogbias      string
+	ZvolPrimarycache string
+	ZvolVolmode      string
+
+	// Per volume overrides
+	PVCAnnotationAllowlist string
+	Profile                string
+
+	// Claim limits
+	PVCMinSize     string
+	PVCMaxSize     string
+	PVCAccessModes string
 
 	// Extent options
 	ExtentBlocksize                int
@@ -73,26 +145,124 @@ type freenasProvisionerConfig struct {
 	ServerUsername        string
 	ServerPassword        string
 	ServerAllowInsecure   bool
+
+	// Placement options
+	ServerSecretNames     string
+	DatasetParentNames    string
+	ServerPlacementPolicy string
+	ServerWeights         string
+	// position of the server in serverSecretNames
+	ServerIndex int
+
+	// Topology options
+	TopologyKey     string
+	TopologyServers string
+	TopologyPortals string
+
+	// Initiator group options
+	InitiatorGroupSync         bool
+	InitiatorGroupNodeSelector string
+	InitiatorGroupNetworks     string
+	InitiatorGroupPerVolume    bool
 }
 
+// GetConfig returns the config of the first server of a StorageClass to manage
+// existing volumes, parameters are parsed leniently
 func (p *freenasProvisioner) GetConfig(ctx context.Context, storageClassName string) (*freenasProvisionerConfig, error) {
 	class, err := p.Client.StorageV1().StorageClasses().Get(ctx, storageClassName, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
 	}
 
+	parameters, err := p.resolveProfile(ctx, class.Parameters, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := parseParametersLenient(storageClassName, parameters)
+	if err != nil {
+		return nil, err
+	}
+	config.ReclaimPolicy = class.ReclaimPolicy
+
+	// classes listing several servers default to the first one
+	entries, err := serverEntries(config)
+	if err != nil {
+		return nil, err
+	}
+	config = entries[0].apply(config)
+
+	err = p.applyServerSecret(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// GetConfigFromVolume builds the config required to manage an already provisioned
+// volume. Volumes carrying the server secret reference are self-contained, legacy
+// volumes fall back to their StorageClass.
+func (p *freenasProvisioner) GetConfigFromVolume(ctx context.Context, volume *v1.PersistentVolume) (*freenasProvisionerConfig, error) {
+	serverSecretName := volume.Annotations[annServerSecretName]
+	if len(serverSecretName) < 1 {
+		glog.Infof("volume %s has no server secret reference, falling back to StorageClass \"%s\"", volume.Name, volume.Spec.StorageClassName)
+		return p.GetConfig(ctx, volume.Spec.StorageClassName)
+	}
+
+	apiVersion := volume.Annotations[annAPIVersion]
+	if len(apiVersion) > 0 && apiVersion != freenas.APIVersion {
+		return nil, fmt.Errorf("volume %s was provisioned with unsupported FreeNAS API version %s", volume.Name, apiVersion)
+	}
+
+	config, err := parseParameters(map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+	config.DatasetParentName = volume.Annotations[annDatasetParent]
+	config.ServerSecretNamespace = volume.Annotations[annServerSecretNamespace]
+	config.ServerSecretName = serverSecretName
+
+	err = p.applyServerSecret(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// parseParameters builds and validates a config from StorageClass parameters,
+// all problems found are returned as a single ParameterError. Server details
+// are applied separately from the referenced secret.
+func parseParameters(parameters map[string]string) (*freenasProvisionerConfig, error) {
+	var errs parameterErrors
+
 	var fsType = "ext4"
 
 	// provisioner defaults
 	var provisionerRollbackPartialFailures = true
 	var provisionerTargetPortal string
 	var provisionerPortals string
+	var provisionerPortalsFromGroup bool
 	var provisionerISCSINamePrefix string
 	var provisionerISCSINameSuffix string
 	var provisionerISCSIInterface = "default"
+	var provisionerNameTemplate = defaultNameTemplate
+	var provisionerClusterID string
 
 	// dataset defaults
 	var datasetParentName = "tank"
+	var datasetPerNamespace = false
+	var datasetNamespaceQuota string
+	var datasetNamespaceQuotaAnnotation = "freenas.org/dataset-quota"
+	var datasetNamespaceQuotaConfigMap string
+	var datasetParentCreate = false
+	var datasetParentCompression string
+	var datasetParentQuota string
+	var datasetParentReservation string
+	var datasetParentComments string
+	var capacityOvercommitRatio string
+	var capacityMinFree string
 
 	// targetGroup defaults
 	var targetGroupAuthgroup int
@@ -106,6 +276,8 @@ func (p *freenasProvisioner) GetConfig(ctx context.Context, storageClassName str
 	var authSecretNamespace = "kube-system"
 	var authSecretName = "freenas-iscsi-chap"
 	var authSecretRef *v1.SecretReference
+	var targetGroupAuthPerVolume = false
+	var targetDiscoveryCHAPManage = false
 
 	// zvol defaults
 	var zvolCompression string
@@ -113,6 +285,14 @@ func (p *freenasProvisioner) GetConfig(ctx context.Context, storageClassName str
 	var zvolSparse = true
 	var zvolForce = false
 	var zvolBlocksize string
+	var zfsProperties string
+	var pvcAnnotationAllowlist string
+	var profile string
+
+	// claim limits
+	var pvcMinSize string
+	var pvcMaxSize string
+	var pvcAccessModes string
 
 	// extent defaults
 	var extentBlocksize int
@@ -133,45 +313,94 @@ func (p *freenasProvisioner) GetConfig(ctx context.Context, storageClassName str
 	var serverPassword string
 	var serverAllowInsecure = false
 
+	// placement options
+	var serverSecretNames string
+	var datasetParentNames string
+	var serverPlacementPolicy = placementMostFree
+	var serverWeights string
+
+	// topology options
+	var topologyKey string
+	var topologyServers string
+	var topologyPortals string
+
+	// initiator group options
+	var initiatorGroupSync bool
+	var initiatorGroupNodeSelector string
+	var initiatorGroupNetworks = initiatorNetworksNode
+	var initiatorGroupPerVolume bool
+
 	// set values from StorageClass parameters
-	for k, v := range class.Parameters {
+	for k, v := range parameters {
 		switch k {
 		case "fsType":
 			fsType = v
 
 		// Provisioner options
 		case "provisionerRollbackPartialFailures":
-			provisionerRollbackPartialFailures, _ = strconv.ParseBool(v)
+			errs.parseBool(k, v, &provisionerRollbackPartialFailures)
 		case "provisionerTargetPortal":
 			provisionerTargetPortal = v
 		case "provisionerPortals":
 			provisionerPortals = v
+		case "provisionerPortalsFromGroup":
+			errs.parseBool(k, v, &provisionerPortalsFromGroup)
 		case "provisionerISCSINamePrefix":
 			provisionerISCSINamePrefix = v
 		case "provisionerISCSINameSuffix":
 			provisionerISCSINameSuffix = v
 		case "provisionerISCSIInterface":
 			provisionerISCSIInterface = v
+		case "provisionerNameTemplate":
+			provisionerNameTemplate = v
+		case "provisionerClusterID":
+			provisionerClusterID = v
 
 		// Dataset options
 		case "datasetParentName":
 			datasetParentName = v
+		case "datasetPerNamespace":
+			errs.parseBool(k, v, &datasetPerNamespace)
+		case "datasetNamespaceQuota":
+			datasetNamespaceQuota = v
+		case "datasetNamespaceQuotaAnnotation":
+			datasetNamespaceQuotaAnnotation = v
+		case "datasetNamespaceQuotaConfigMap":
+			datasetNamespaceQuotaConfigMap = v
+		case "datasetParentCreate":
+			errs.parseBool(k, v, &datasetParentCreate)
+		case "datasetParentCompression":
+			datasetParentCompression = v
+		case "datasetParentQuota":
+			datasetParentQuota = v
+		case "datasetParentReservation":
+			datasetParentReservation = v
+		case "datasetParentComments":
+			datasetParentComments = v
+		case "capacityOvercommitRatio":
+			capacityOvercommitRatio = v
+		case "capacityMinFree":
+			capacityMinFree = v
 
 		// TargetGroup options
 		case "targetGroupAuthgroup":
-			targetGroupAuthgroup, _ = strconv.Atoi(v)
+			errs.parseInt(k, v, &targetGroupAuthgroup)
 		case "targetGroupAuthtype":
 			targetGroupAuthtype = v
 		case "targetGroupInitiatorgroup":
-			targetGroupInitiatorgroup, _ = strconv.Atoi(v)
+			errs.parseInt(k, v, &targetGroupInitiatorgroup)
 		case "targetGroupPortalgroup":
-			targetGroupPortalgroup, _ = strconv.Atoi(v)
+			errs.parseInt(k, v, &targetGroupPortalgroup)
 
 		// Authentication options
 		case "targetDiscoveryCHAPAuth":
-			targetDiscoveryCHAPAuth, _ = strconv.ParseBool(v)
+			errs.parseBool(k, v, &targetDiscoveryCHAPAuth)
+		case "targetDiscoveryCHAPManage":
+			errs.parseBool(k, v, &targetDiscoveryCHAPManage)
 		case "targetSessionCHAPAuth":
-			targetSessionCHAPAuth, _ = strconv.ParseBool(v)
+			errs.parseBool(k, v, &targetSessionCHAPAuth)
+		case "targetGroupAuthPerVolume":
+			errs.parseBool(k, v, &targetGroupAuthPerVolume)
 		case "authSecretNamespace":
 			authSecretNamespace = v
 		case "authSecretName":
@@ -183,61 +412,88 @@ func (p *freenasProvisioner) GetConfig(ctx context.Context, storageClassName str
 		case "zvolDedup":
 			zvolDedup = v
 		case "zvolSparse":
-			zvolSparse, _ = strconv.ParseBool(v)
+			errs.parseBool(k, v, &zvolSparse)
 		case "zvolForce":
-			zvolForce, _ = strconv.ParseBool(v)
+			errs.parseBool(k, v, &zvolForce)
 		case "zvolBlocksize":
 			zvolBlocksize = v
+		case "zfsProperties":
+			zfsProperties = v
+
+		// Per volume overrides
+		case "pvcAnnotationAllowlist":
+			pvcAnnotationAllowlist = v
+		case "profile":
+			profile = v
+		case "profileConfigMap":
+			// only used to resolve the profile
+
+		// Claim limits
+		case "pvcMinSize":
+			pvcMinSize = v
+		case "pvcMaxSize":
+			pvcMaxSize = v
+		case "pvcAccessModes":
+			pvcAccessModes = v
 
 		// Extent options
 		case "extentBlocksize":
-			extentBlocksize, _ = strconv.Atoi(v)
+			errs.parseInt(k, v, &extentBlocksize)
 		case "extentDisablePhysicalBlocksize":
-			extentDisablePhysicalBlocksize, _ = strconv.ParseBool(v)
+			errs.parseBool(k, v, &extentDisablePhysicalBlocksize)
 		case "extentAvailThreshold":
-			extentAvailThreshold, _ = strconv.Atoi(v)
+			errs.parseInt(k, v, &extentAvailThreshold)
 		case "extentInsecureTpc":
-			extentInsecureTpc, _ = strconv.ParseBool(v)
+			errs.parseBool(k, v, &extentInsecureTpc)
 		case "extentXen":
-			extentXen, _ = strconv.ParseBool(v)
+			errs.parseBool(k, v, &extentXen)
 		case "extentRpm":
 			extentRpm = v
 		case "extentReadOnly":
-			extentReadOnly, _ = strconv.ParseBool(v)
+			errs.parseBool(k, v, &extentReadOnly)
 
 		// Server options
 		case "serverSecretNamespace":
 			serverSecretNamespace = v
 		case "serverSecretName":
 			serverSecretName = v
-		}
-	}
 
-	secret, err := p.GetSecret(ctx, serverSecretNamespace, serverSecretName)
-	if err != nil {
-		return nil, err
-	}
-
-	// set values from secret
-	for k, v := range secret.Data {
-		switch k {
-		case "protocol":
-			serverProtocol = BytesToString(v)
-		case "host":
-			serverHost = BytesToString(v)
-		case "port":
-			serverPort, _ = strconv.Atoi(BytesToString(v))
-		case "username":
-			serverUsername = BytesToString(v)
-		case "password":
-			serverPassword = BytesToString(v)
-		case "allowInsecure":
-			serverAllowInsecure, _ = strconv.ParseBool(BytesToString(v))
+		// Placement options
+		case "serverSecretNames":
+			serverSecretNames = v
+		case "datasetParentNames":
+			datasetParentNames = v
+		case "serverPlacementPolicy":
+			serverPlacementPolicy = v
+		case "serverWeights":
+			serverWeights = v
+
+		// Topology options
+		case "topologyKey":
+			topologyKey = v
+		case "topologyServers":
+			topologyServers = v
+		case "topologyPortals":
+			topologyPortals = v
+
+		// Initiator group options
+		case "initiatorGroupSync":
+			errs.parseBool(k, v, &initiatorGroupSync)
+		case "initiatorGroupNodeSelector":
+			initiatorGroupNodeSelector = v
+		case "initiatorGroupNetworks":
+			initiatorGroupNetworks = v
+		case "initiatorGroupPerVolume":
+			errs.parseBool(k, v, &initiatorGroupPerVolume)
+
+		default:
+			errs.add("unknown parameter %s", k)
 		}
 	}
 
-	if provisionerTargetPortal == "" {
-		provisionerTargetPortal = serverHost + ":3260"
+	// generated credentials are always used for the session
+	if targetGroupAuthPerVolume {
+		targetSessionCHAPAuth = true
 	}
 
 	if targetDiscoveryCHAPAuth || targetSessionCHAPAuth {
@@ -247,20 +503,33 @@ func (p *freenasProvisioner) GetConfig(ctx context.Context, storageClassName str
 		}
 	}
 
-	return &freenasProvisionerConfig{
-		FSType:        fsType,
-		ReclaimPolicy: class.ReclaimPolicy,
+	config := &freenasProvisionerConfig{
+		FSType: fsType,
 
 		// Provisioner options
 		ProvisionerRollbackPartialFailures: provisionerRollbackPartialFailures,
 		ProvisionerTargetPortal:            provisionerTargetPortal,
 		ProvisionerPortals:                 provisionerPortals,
+		ProvisionerPortalsFromGroup:        provisionerPortalsFromGroup,
 		ProvisionerISCSINamePrefix:         provisionerISCSINamePrefix,
 		ProvisionerISCSINameSuffix:         provisionerISCSINameSuffix,
 		ProvisionerISCSIInterface:          provisionerISCSIInterface,
+		ProvisionerNameTemplate:            provisionerNameTemplate,
+		ProvisionerClusterID:               provisionerClusterID,
 
 		// Dataset options
-		DatasetParentName: datasetParentName,
+		DatasetParentName:               datasetParentName,
+		DatasetPerNamespace:             datasetPerNamespace,
+		DatasetNamespaceQuota:           datasetNamespaceQuota,
+		DatasetNamespaceQuotaAnnotation: datasetNamespaceQuotaAnnotation,
+		DatasetNamespaceQuotaConfigMap:  datasetNamespaceQuotaConfigMap,
+		DatasetParentCreate:             datasetParentCreate,
+		DatasetParentCompression:        datasetParentCompression,
+		DatasetParentQuota:              datasetParentQuota,
+		DatasetParentReservation:        datasetParentReservation,
+		DatasetParentComments:           datasetParentComments,
+		CapacityOvercommitRatio:         capacityOvercommitRatio,
+		CapacityMinFree:                 capacityMinFree,
 
 		// TargetGroup options
 		TargetGroupAuthgroup:      targetGroupAuthgroup,
@@ -269,9 +538,11 @@ func (p *freenasProvisioner) GetConfig(ctx context.Context, storageClassName str
 		TargetGroupPortalgroup:    targetGroupPortalgroup,
 
 		// Authentication options
-		DiscoveryCHAPAuth: targetDiscoveryCHAPAuth,
-		SessionCHAPAuth:   targetSessionCHAPAuth,
-		AuthSecretRef:     authSecretRef,
+		DiscoveryCHAPAuth:   targetDiscoveryCHAPAuth,
+		SessionCHAPAuth:     targetSessionCHAPAuth,
+		AuthSecretRef:       authSecretRef,
+		AuthPerVolume:       targetGroupAuthPerVolume,
+		DiscoveryCHAPManage: targetDiscoveryCHAPManage,
 
 		// Zvol options
 		ZvolCompression: zvolCompression,
@@ -279,6 +550,16 @@ func (p *freenasProvisioner) GetConfig(ctx context.Context, storageClassName str
 		ZvolSparse:      zvolSparse,
 		ZvolForce:       zvolForce,
 		ZvolBlocksize:   zvolBlocksize,
+		ZFSProperties:   zfsProperties,
+
+		// Per volume overrides
+		PVCAnnotationAllowlist: pvcAnnotationAllowlist,
+		Profile:                profile,
+
+		// Claim limits
+		PVCMinSize:     pvcMinSize,
+		PVCMaxSize:     pvcMaxSize,
+		PVCAccessModes: pvcAccessModes,
 
 		// Extent options
 		ExtentBlocksize:                extentBlocksize,
@@ -298,19 +579,81 @@ func (p *freenasProvisioner) GetConfig(ctx context.Context, storageClassName str
 		ServerUsername:        serverUsername,
 		ServerPassword:        serverPassword,
 		ServerAllowInsecure:   serverAllowInsecure,
-	}, nil
+
+		// Placement options
+		ServerSecretNames:     serverSecretNames,
+		DatasetParentNames:    datasetParentNames,
+		ServerPlacementPolicy: serverPlacementPolicy,
+		ServerWeights:         serverWeights,
+
+		// Topology options
+		TopologyKey:     topologyKey,
+		TopologyServers: topologyServers,
+		TopologyPortals: topologyPortals,
+
+		// Initiator group options
+		InitiatorGroupSync:         initiatorGroupSync,
+		InitiatorGroupNodeSelector: initiatorGroupNodeSelector,
+		InitiatorGroupNetworks:     initiatorGroupNetworks,
+		InitiatorGroupPerVolume:    initiatorGroupPerVolume,
+	}
+
+	validateConfig(config, &errs)
+
+	return config, errs.err()
+}
+
+// applyServerSecret sets the server connection details from the referenced secret
+func (p *freenasProvisioner) applyServerSecret(ctx context.Context, config *freenasProvisionerConfig) error {
+	secret, err := p.GetSecret(ctx, config.ServerSecretNamespace, config.ServerSecretName)
+	if err != nil {
+		return err
+	}
+
+	// set values from secret
+	for k, v := range secret.Data {
+		switch k {
+		case "protocol":
+			config.ServerProtocol = BytesToString(v)
+		case "host":
+			config.ServerHost = BytesToString(v)
+		case "port":
+			config.ServerPort, _ = strconv.Atoi(BytesToString(v))
+		case "username":
+			config.ServerUsername = BytesToString(v)
+		case "password":
+			config.ServerPassword = BytesToString(v)
+		case "allowInsecure":
+			config.ServerAllowInsecure, _ = strconv.ParseBool(BytesToString(v))
+		}
+	}
+
+	if config.ProvisionerTargetPortal == "" {
+		config.ProvisionerTargetPortal = config.ServerHost + ":3260"
+	}
+
+	return nil
 }
 
 type freenasProvisioner struct {
 	Client     kubernetes.Interface
 	Identifier string
+	// AttachmentSync is set when the attachment sync admits nodes to the
+	// dedicated initiator groups of initiatorGroupPerVolume
+	AttachmentSync bool
+
+	// round-robin placement positions per StorageClass
+	placementMutex    sync.Mutex
+	placementCounters map[string]int
 }
 
-// New creates a new client instance
-func New(client kubernetes.Interface, identifier string) controller.Provisioner {
+// New creates a new client instance, attachmentSync tells whether the
+// attachment sync is running
+func New(client kubernetes.Interface, identifier string, attachmentSync bool) controller.Provisioner {
 	return &freenasProvisioner{
-		Client:     client,
-		Identifier: identifier,
+		Client:         client,
+		Identifier:     identifier,
+		AttachmentSync: attachmentSync,
 	}
 }
 
@@ -349,46 +692,90 @@ func (p *freenasProvisioner) Provision(ctx context.Context, options controller.P
 	var err error
 	var resp *http.Response
 
-	var loopErr error
-	var loopResp *http.Response
-
-	// get config
-	config, err := p.GetConfig(ctx, *options.PVC.Spec.StorageClassName)
+	// get config of every server of the class
+	configs, err := p.GetConfigs(ctx, *options.PVC.Spec.StorageClassName, options.PVC)
 	if err != nil {
 		return nil, controller.ProvisioningFinished, err
 	}
-	//glog.Infof("%+v\n", config)
+	//glog.Infof("%+v\n", configs)
 
-	// get server
-	freenasServer, err := p.GetServer(*config)
+	// enforce the claim limits of the class
+	err = validateClaim(configs[0], options.PVC)
 	if err != nil {
 		return nil, controller.ProvisioningFinished, err
 	}
 
-	// get iscsi configuration
-	iscsiConfig := freenas.ISCSIConfig{}
-	resp, err = iscsiConfig.Get(freenasServer)
+	// nothing would ever admit a node to the dedicated initiator group
+	if configs[0].InitiatorGroupPerVolume && !p.AttachmentSync {
+		return nil, controller.ProvisioningFinished, fmt.Errorf("initiatorGroupPerVolume requires the attachment sync, set --attachment-sync-interval")
+	}
+
+	// apply zfsProperties and PVC overrides, failing before anything is created
+	for i := range configs {
+		configs[i], err = applyVolumeProperties(configs[i], options.PVC)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+	}
+
+	// restrict servers to those reachable from the selected node or allowed topologies
+	topology, err := getVolumeTopology(configs[0], options)
 	if err != nil {
 		return nil, controller.ProvisioningFinished, err
 	}
+	if topology != nil {
+		configs = topology.filter(configs)
+		if len(configs) < 1 {
+			// let the scheduler pick another node
+			if options.SelectedNode != nil {
+				return nil, controller.ProvisioningReschedule, fmt.Errorf("no server of StorageClass \"%s\" is mapped to %s=%s of node %s", *options.PVC.Spec.StorageClassName, topology.Key, topology.Preferred, options.SelectedNode.Name)
+			}
+			return nil, controller.ProvisioningFinished, fmt.Errorf("no server of StorageClass \"%s\" is mapped to the allowed topologies", *options.PVC.Spec.StorageClassName)
+		}
+	}
 
-	// get parent dataset
-	parentDs := freenas.Dataset{
-		Name: config.DatasetParentName,
+	// choose server, parent dataset and check capacity before anything is created
+	volSize := options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+	chosen, err := p.placeVolume(*options.PVC.Spec.StorageClassName, configs, volSize.Value())
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
 	}
-	resp, err = parentDs.Get(freenasServer)
+	config := chosen.config
+	freenasServer := chosen.server
+	iscsiConfig := chosen.iscsiConfig
+	parentDs := *chosen.parentDs
+
+	// portals of the portal group, a topology portal still takes precedence
+	err = applyGroupPortals(freenasServer, config)
 	if err != nil {
 		return nil, controller.ProvisioningFinished, err
 	}
 
+	var nodeAffinity *v1.VolumeNodeAffinity
+	if topology != nil {
+		nodeAffinity = topology.apply(config)
+	}
+
 	meta := options.PVC.GetObjectMeta()
 	pvcNamespace := meta.GetNamespace()
 	pvcName := meta.GetName()
-	zvolName := options.PVName
-	iscsiName := options.PVName
 
-	zvolName = strings.TrimPrefix(parentDs.Name, parentDs.Pool+"/") + "/" + zvolName
-	iscsiName = config.ProvisionerISCSINamePrefix + iscsiName + config.ProvisionerISCSINameSuffix
+	// zvols are placed in a child dataset per namespace when enabled
+	zvolDs := &parentDs
+	if config.DatasetPerNamespace {
+		zvolDs, err = p.ensureNamespaceDataset(ctx, freenasServer, config, pvcNamespace)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, err
+		}
+	}
+
+	names, err := resolveNames(config, namespaceDatasetName(config, pvcNamespace), newNameContext(config, options.PVName, options.PVC))
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+
+	zvolName := zvolPath(*zvolDs, names.Base)
+	iscsiName := names.ISCSIName
 	extentDiskName := "zvol/" + parentDs.Pool + "/" + zvolName
 
 	if len(extentDiskName) > 63 {
@@ -403,7 +790,6 @@ func (p *freenasProvisioner) Provision(ctx context.Context, options controller.P
 
 	// Create zvol
 	var zvolVolsize int64
-	volSize := options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
 	zvolVolsize = volSize.Value()
 	zvolVolsizeGB := (float64(zvolVolsize) / 1024 / 1024 / 1024)
 
@@ -429,213 +815,159 @@ func (p *freenasProvisioner) Provision(ctx context.Context, options controller.P
 		}
 	}
 
-	// Create target
-	target := freenas.Target{
-		Name:  iscsiName,
-		Alias: "",
-		Mode:  "iscsi",
-	}
-	resp, err = target.Create(freenasServer)
-	if err != nil {
-		// already exists
-		if resp.StatusCode != 409 {
+	// properties the zvol endpoint does not take
+	if properties := datasetProperties(config); len(properties) > 0 {
+		_, err = zvol.SetProperties(freenasServer, properties)
+		if err != nil {
 			if config.ProvisionerRollbackPartialFailures {
-				zvol.Delete(freenasServer)
+				rollback(freenasServer, &zvol)
 			}
 			return nil, controller.ProvisioningFinished, err
 		}
-
-		target.Get(freenasServer)
 	}
 
-	// Create targetgroup(s)
-	targetGroup := freenas.TargetGroup{
-		Target:         target.ID,
-		Authgroup:      config.TargetGroupAuthgroup,
-		Authtype:       config.TargetGroupAuthtype,
-		Initialdigest:  "Auto",
-		Initiatorgroup: config.TargetGroupInitiatorgroup,
-		Portalgroup:    config.TargetGroupPortalgroup,
-	}
-	resp, err = targetGroup.Create(freenasServer)
+	// Create target
+	target, err := ensureTarget(freenasServer, iscsiName)
 	if err != nil {
-		// cope with craziness
-		if resp.StatusCode == 404 {
-			loopResp, loopErr = targetGroup.Get(freenasServer)
-			if loopErr != nil || loopResp.StatusCode != 200 {
-				glog.Infof("failed attempt to create TargetGroup %d", resp.StatusCode)
-				if config.ProvisionerRollbackPartialFailures {
-					target.Delete(freenasServer)
-					zvol.Delete(freenasServer)
-				}
-				return nil, controller.ProvisioningFinished, err
+		if config.ProvisionerRollbackPartialFailures {
+			rollback(freenasServer, &zvol)
+		}
+		return nil, controller.ProvisioningFinished, err
+	}
+
+	// Create the dedicated initiator and auth groups, they are deleted after the target
+	var initiatorGroup *freenas.Initiator
+	var credential *freenas.AuthCredential
+	var authSecretRef *v1.SecretReference
+	rollbackVolume := func(resources ...freenas.Resource) {
+		if initiatorGroup != nil {
+			resources = append(resources, initiatorGroup)
+		}
+		if credential != nil {
+			resources = append(resources, credential)
+		}
+		rollback(freenasServer, resources...)
+		if authSecretRef != nil {
+			err := p.deleteVolumeAuthSecret(ctx, authSecretRef)
+			if err != nil {
+				glog.Warningf("failed to rollback CHAP secret %s/%s: %v", authSecretRef.Namespace, authSecretRef.Name, err)
 			}
-		} else if resp.StatusCode != 409 {
-			glog.Infof("failed attempt to create TargetGroup %d", resp.StatusCode)
+		}
+	}
+	if config.InitiatorGroupPerVolume {
+		initiatorGroup, err = ensureVolumeInitiatorGroup(freenasServer, iscsiName)
+		if err != nil {
 			if config.ProvisionerRollbackPartialFailures {
-				target.Delete(freenasServer)
-				zvol.Delete(freenasServer)
+				rollback(freenasServer, target, &zvol)
 			}
 			return nil, controller.ProvisioningFinished, err
 		}
+		config.TargetGroupInitiatorgroup = initiatorGroup.ID
 	}
-
-	// Create extent
-	// whole path to zvol Disk including "zvol/" must be <= 63 chars
-	extent := freenas.Extent{
-		Name:           iscsiName,
-		Type:           "Disk",
-		Disk:           extentDiskName,
-		Blocksize:      config.ExtentBlocksize, //config - 512, 1024, 2048, or 4096
-		Pblocksize:     config.ExtentDisablePhysicalBlocksize,
-		AvailThreshold: config.ExtentAvailThreshold,
-		Comment:        TruncateString(fmt.Sprintf("%s/%s", pvcNamespace, pvcName), 120),
-		InsecureTpc:    config.ExtentInsecureTpc,
-		Xen:            config.ExtentXen,
-		Rpm:            config.ExtentRpm, // config - Unknown, SSD, 5400, 7200, 10000, 15000
-		Ro:             config.ExtentReadOnly,
-	}
-
-	// run this as a loop as zvol creation returns a 202 and may take a little time to complete
-	extentLoopCurrent := 0
-	extentMaxLoops := 2
-	extentWaitDuration, err := time.ParseDuration("5s")
-	for {
-		resp, err = extent.Create(freenasServer)
+	if config.AuthPerVolume {
+		credential, err = p.ensureVolumeCredential(freenasServer, config, options.PVName)
+		if err == nil {
+			config.TargetGroupAuthgroup = credential.Tag
+			authSecretRef, err = p.ensureVolumeAuthSecret(ctx, config, options.PVName, credential)
+		}
 		if err != nil {
-			if resp.StatusCode == 409 {
-				loopResp, loopErr = extent.Get(freenasServer)
-				if loopErr != nil {
-					glog.Infof("failed attempt to create Extent %d", resp.StatusCode)
-					if config.ProvisionerRollbackPartialFailures {
-						targetGroup.Delete(freenasServer)
-						target.Delete(freenasServer)
-						zvol.Delete(freenasServer)
-					}
-					return nil, controller.ProvisioningFinished, err
-				}
-				break
+			if config.ProvisionerRollbackPartialFailures {
+				rollbackVolume(target, &zvol)
 			}
+			return nil, controller.ProvisioningFinished, err
+		}
+		config.AuthSecretRef = authSecretRef
+	}
 
-			if extentMaxLoops == extentLoopCurrent {
-				if config.ProvisionerRollbackPartialFailures {
-					targetGroup.Delete(freenasServer)
-					target.Delete(freenasServer)
-					zvol.Delete(freenasServer)
-				}
-				return nil, controller.ProvisioningFinished, err
-			}
-			extentLoopCurrent++
-			time.Sleep(extentWaitDuration)
-		} else {
-			break
+	// Create targetgroup(s)
+	targetGroup, err := ensureTargetGroup(freenasServer, config, target.ID)
+	if err != nil {
+		if config.ProvisionerRollbackPartialFailures {
+			rollbackVolume(target, &zvol)
 		}
+		return nil, controller.ProvisioningFinished, err
 	}
 
-	// Create targettoextent
-	lunid := 0
-	targetToExtent := freenas.TargetToExtent{
-		Extent: extent.ID,
-		Lunid:  &lunid,
-		Target: target.ID,
+	// Create extent
+	extent, err := ensureExtent(freenasServer, config, iscsiName, extentDiskName, fmt.Sprintf("%s/%s", pvcNamespace, pvcName))
+	if err != nil {
+		if config.ProvisionerRollbackPartialFailures {
+			rollbackVolume(targetGroup, target, &zvol)
+		}
+		return nil, controller.ProvisioningFinished, err
 	}
-	resp, err = targetToExtent.Create(freenasServer)
+
+	// Create targettoextent
+	targetToExtent, err := ensureTargetToExtent(freenasServer, target.ID, extent.ID)
 	if err != nil {
-		if resp.StatusCode == 409 {
-			loopResp, loopErr = targetToExtent.Get(freenasServer)
-			if loopErr != nil {
-				glog.Infof("failed attempt to create TargetToExtent %d", resp.StatusCode)
-				if config.ProvisionerRollbackPartialFailures {
-					extent.Delete(freenasServer)
-					targetGroup.Delete(freenasServer)
-					target.Delete(freenasServer)
-					zvol.Delete(freenasServer)
-				}
-				return nil, controller.ProvisioningFinished, err
-			}
-		} else {
-			if config.ProvisionerRollbackPartialFailures {
-				extent.Delete(freenasServer)
-				targetGroup.Delete(freenasServer)
-				target.Delete(freenasServer)
-				zvol.Delete(freenasServer)
-			}
-			return nil, controller.ProvisioningFinished, err
+		if config.ProvisionerRollbackPartialFailures {
+			rollbackVolume(extent, targetGroup, target, &zvol)
 		}
+		return nil, controller.ProvisioningFinished, err
 	}
 
 	// use this for testing idempotency
 	//return nil, errors.New("fake fail")
 
-	var portals []string
-	if len(config.ProvisionerPortals) > 0 {
-		portals = strings.Split(config.ProvisionerPortals, ",")
-	}
-
-	//mode := v1.PersistentVolumeFilesystem
-	//VolumeMode:                    &mode,
-	//v1.PersistentVolumeR
-	pv := &v1.PersistentVolume{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: options.PVName,
-			Annotations: map[string]string{
-				"freenasISCSIProvisionerIdentity": p.Identifier,
-				"datasetParent":                   config.DatasetParentName,
-				"pool":                            parentDs.Pool,
-				"zvol":                            zvolName,
-				"iscsiName":                       iscsiName,
-				"targetId":                        strconv.Itoa(target.ID),
-				"targetGroupId":                   strconv.Itoa(targetGroup.ID),
-				"extentId":                        strconv.Itoa(extent.ID),
-				"targetToExtentId":                strconv.Itoa(targetToExtent.ID),
-			},
-		},
-		Spec: v1.PersistentVolumeSpec{
-			PersistentVolumeReclaimPolicy: *config.ReclaimPolicy,
-			AccessModes:                   options.PVC.Spec.AccessModes,
-			Capacity: v1.ResourceList{
-				v1.ResourceName(v1.ResourceStorage): options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
-			},
-			// set volumeMode from PVC Spec
-			VolumeMode: options.PVC.Spec.VolumeMode,
-			PersistentVolumeSource: v1.PersistentVolumeSource{
-				ISCSI: &v1.ISCSIPersistentVolumeSource{
-					TargetPortal:      config.ProvisionerTargetPortal,
-					Portals:           portals,
-					IQN:               iscsiConfig.Basename + ":" + iscsiName,
-					ISCSIInterface:    config.ProvisionerISCSIInterface,
-					Lun:               int32(*targetToExtent.Lunid),
-					ReadOnly:          extent.Ro,
-					FSType:            config.FSType,
-					DiscoveryCHAPAuth: config.DiscoveryCHAPAuth,
-					SessionCHAPAuth:   config.SessionCHAPAuth,
-					SecretRef:         config.AuthSecretRef,
-				},
-			},
-		},
+	pv := p.newPersistentVolume(config, options.PVName, iscsiConfig.Basename, volumeResources{
+		DatasetParent:  config.DatasetParentName,
+		Pool:           parentDs.Pool,
+		Zvol:           zvolName,
+		ISCSIName:      iscsiName,
+		Target:         target,
+		TargetGroup:    targetGroup,
+		Extent:         extent,
+		TargetToExtent: targetToExtent,
+		InitiatorGroup: initiatorGroup,
+		AuthCredential: credential,
+	})
+	pv.Spec.AccessModes = options.PVC.Spec.AccessModes
+	pv.Spec.Capacity = v1.ResourceList{
+		v1.ResourceName(v1.ResourceStorage): options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
 	}
+	// set volumeMode from PVC Spec
+	pv.Spec.VolumeMode = options.PVC.Spec.VolumeMode
+	pv.Spec.NodeAffinity = nodeAffinity
 
 	return pv, controller.ProvisioningFinished, nil
 }
 
 func (p *freenasProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume) error {
 	var targetID, extentID int
+
+	// annotations may have been stripped (ie: by backup/restore tooling)
+	if needsRecovery(volume) {
+		recovered, err := p.recoverAnnotations(ctx, volume)
+		if err != nil {
+			return err
+		}
+
+		volume = volume.DeepCopy()
+		for k, v := range recovered {
+			metav1.SetMetaDataAnnotation(&volume.ObjectMeta, k, v)
+		}
+
+		err = p.saveAnnotations(ctx, volume.Name, recovered)
+		if err != nil {
+			glog.Warningf("failed to re-annotate volume %s: %v", volume.Name, err)
+		}
+	}
 	var poolName, zvolName, iscsiName, datasetParentName string
 
-	targetIDAnnotation, ok := volume.Annotations["targetId"]
+	targetIDAnnotation, ok := volume.Annotations[annTargetID]
 	if ok {
 		targetID, _ = strconv.Atoi(targetIDAnnotation)
 	}
 
-	extentIDAnnotation, ok := volume.Annotations["extentId"]
+	extentIDAnnotation, ok := volume.Annotations[annExtentID]
 	if ok {
 		extentID, _ = strconv.Atoi(extentIDAnnotation)
 	}
 
-	poolName = volume.Annotations["pool"]
-	zvolName = volume.Annotations["zvol"]
-	iscsiName = volume.Annotations["iscsiName"]
-	datasetParentName = volume.Annotations["datasetParent"]
+	poolName = volume.Annotations[annPool]
+	zvolName = volume.Annotations[annZvol]
+	iscsiName = volume.Annotations[annISCSIName]
+	datasetParentName = volume.Annotations[annDatasetParent]
 
 	if len(targetIDAnnotation) < 1 {
 		return fmt.Errorf("targetID cannot be empty")
@@ -661,7 +993,7 @@ func (p *freenasProvisioner) Delete(ctx context.Context, volume *v1.PersistentVo
 	var resp *http.Response
 
 	// get config
-	config, err := p.GetConfig(ctx, volume.Spec.StorageClassName)
+	config, err := p.GetConfigFromVolume(ctx, volume)
 	if err != nil {
 		return err
 	}
@@ -673,38 +1005,71 @@ func (p *freenasProvisioner) Delete(ctx context.Context, volume *v1.PersistentVo
 		return err
 	}
 
-	// get parent dataset
+	// parent dataset as recorded on the volume
 	parentDs := freenas.Dataset{
 		Name: datasetParentName,
-	}
-	resp, err = parentDs.Get(freenasServer)
-	if err != nil {
-		return err
+		Pool: poolName,
 	}
 
 	glog.Infof("Deleting target: %d (\"%s\"), extent: %d (\"%s\"), zvol: \"%s/%s\"", targetID, iscsiName, extentID, iscsiName, poolName, zvolName)
 
-	// Delete target
+	// Delete target, an ID of 0 means it could not be found by name either
 	// NOTE: deletting a target inherently deletes associated targetgroup(s) and targettoextent(s)
-	target := freenas.Target{
-		ID: targetID,
-	}
-	resp, err = target.Delete(freenasServer)
-	if err != nil {
-		if resp.StatusCode != 404 {
-			return err
+	if targetID > 0 {
+		target := freenas.Target{
+			ID: targetID,
+		}
+		resp, err = target.Delete(freenasServer)
+		if err != nil {
+			if resp.StatusCode != 404 {
+				return err
+			}
 		}
 	}
 
 	// Delete extent
-	extent := freenas.Extent{
-		ID: extentID,
+	if extentID > 0 {
+		extent := freenas.Extent{
+			ID: extentID,
+		}
+		resp, err = extent.Delete(freenasServer)
+		if err != nil {
+			if resp.StatusCode != 404 {
+				return err
+			}
+		}
 	}
-	resp, err = extent.Delete(freenasServer)
-	if err != nil {
-		if resp.StatusCode != 404 {
+
+	// Delete the generated auth group, unused once the target is gone. It
+	// holds two credentials while a rotation is in progress.
+	credentialID, _ := strconv.Atoi(volume.Annotations[annAuthCredentialID])
+	if credentialID > 0 {
+		err = deleteVolumeAuthGroup(freenasServer, credentialID)
+		if err != nil {
 			return err
 		}
+
+		iscsi := volume.Spec.PersistentVolumeSource.ISCSI
+		if iscsi != nil && iscsi.SecretRef != nil {
+			err = p.deleteVolumeAuthSecret(ctx, iscsi.SecretRef)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Delete the dedicated initiator group, unused once the target is gone
+	initiatorGroupID, _ := strconv.Atoi(volume.Annotations[annInitiatorGroupID])
+	if initiatorGroupID > 0 {
+		initiator := freenas.Initiator{
+			ID: initiatorGroupID,
+		}
+		resp, err = initiator.Delete(freenasServer)
+		if err != nil {
+			if resp == nil || resp.StatusCode != 404 {
+				return err
+			}
+		}
 	}
 
 	// Delete zvol
@@ -754,6 +1119,55 @@ func (p *freenasProvisioner) GetSecret(ctx context.Context, namespace, secretNam
 	return p.Client.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
 }
 
+// zvolPath returns the name of a zvol below the parent dataset relative to the pool
+func zvolPath(parentDs freenas.Dataset, name string) string {
+	return strings.TrimPrefix(parentDs.Name, parentDs.Pool+"/") + "/" + name
+}
+
+// serverKey uniquely identifies the FreeNAS server of a config
+func serverKey(config *freenasProvisionerConfig) string {
+	return fmt.Sprintf("%s://%s:%d", config.ServerProtocol, config.ServerHost, config.ServerPort)
+}
+
+// listStorageClasses lists all StorageClasses served by the named provisioner
+func listStorageClasses(ctx context.Context, client kubernetes.Interface, provisionerName string) ([]storagev1.StorageClass, error) {
+	list, err := client.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var classes []storagev1.StorageClass
+	for _, class := range list.Items {
+		if class.Provisioner == provisionerName {
+			classes = append(classes, class)
+		}
+	}
+	return classes, nil
+}
+
+// patchVolumeAnnotations sets (or removes when nil) annotations on a PV
+func patchVolumeAnnotations(ctx context.Context, client kubernetes.Interface, name string, annotations map[string]*string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.CoreV1().PersistentVolumes().Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// newEventRecorder creates a recorder emitting events as the given component
+func newEventRecorder(client kubernetes.Interface, component string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(glog.Infof)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events(v1.NamespaceAll)})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: component})
+}
+
 // BytesToString converts bytes to a string
 func BytesToString(data []byte) string {
 	return string(data[:])
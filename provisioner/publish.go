@@ -0,0 +1,168 @@
+package provisioner
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// StorageCapacity is the capacity of the parent dataset of a StorageClass on
+// one server as published in the status ConfigMap
+type StorageCapacity struct {
+	Server           string      `json:"server"`
+	Dataset          string      `json:"dataset"`
+	AvailableBytes   int64       `json:"availableBytes"`
+	UsedBytes        int64       `json:"usedBytes"`
+	ProvisionedBytes int64       `json:"provisionedBytes"`
+	Updated          metav1.Time `json:"updated"`
+}
+
+// CapacityPublisher periodically publishes the capacity of each StorageClass
+// to a ConfigMap (keyed by StorageClass name, one entry per server) and as
+// prometheus gauges
+type CapacityPublisher struct {
+	Client             kubernetes.Interface
+	ProvisionerName    string
+	ConfigMapNamespace string
+	ConfigMapName      string
+
+	provisioner *freenasProvisioner
+}
+
+// NewCapacityPublisher creates a new publisher instance
+func NewCapacityPublisher(client kubernetes.Interface, provisionerName, configMapNamespace, configMapName string) *CapacityPublisher {
+	return &CapacityPublisher{
+		Client:             client,
+		ProvisionerName:    provisionerName,
+		ConfigMapNamespace: configMapNamespace,
+		ConfigMapName:      configMapName,
+		provisioner: &freenasProvisioner{
+			Client: client,
+		},
+	}
+}
+
+// Run publishes capacity every interval until the context is done
+func (c *CapacityPublisher) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		_, err := c.Publish(ctx)
+		if err != nil {
+			glog.Errorf("capacity publishing failed: %v", err)
+		}
+	}, interval)
+}
+
+// Publish reads the capacity of all StorageClasses once and publishes it
+func (c *CapacityPublisher) Publish(ctx context.Context) (map[string][]StorageCapacity, error) {
+	classes, err := listStorageClasses(ctx, c.Client, c.ProvisionerName)
+	if err != nil {
+		return nil, err
+	}
+
+	capacities := map[string][]StorageCapacity{}
+	for _, class := range classes {
+		configs, err := c.provisioner.GetConfigs(ctx, class.Name, nil)
+		if err != nil {
+			glog.Warningf("failed to get capacity of StorageClass \"%s\": %v", class.Name, err)
+			continue
+		}
+		for _, config := range configs {
+			capacity, err := c.getCapacity(config)
+			if err != nil {
+				glog.Warningf("failed to get capacity of StorageClass \"%s\" on %s: %v", class.Name, serverKey(config), err)
+				continue
+			}
+			capacities[class.Name] = append(capacities[class.Name], *capacity)
+		}
+	}
+
+	// drop series of removed classes
+	datasetAvailableBytes.Reset()
+	datasetUsedBytes.Reset()
+	datasetProvisionedBytes.Reset()
+	for name, list := range capacities {
+		for _, capacity := range list {
+			datasetAvailableBytes.WithLabelValues(name, capacity.Server, capacity.Dataset).Set(float64(capacity.AvailableBytes))
+			datasetUsedBytes.WithLabelValues(name, capacity.Server, capacity.Dataset).Set(float64(capacity.UsedBytes))
+			datasetProvisionedBytes.WithLabelValues(name, capacity.Server, capacity.Dataset).Set(float64(capacity.ProvisionedBytes))
+		}
+	}
+
+	if len(c.ConfigMapName) > 0 {
+		err = c.saveConfigMap(ctx, capacities)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return capacities, nil
+}
+
+func (c *CapacityPublisher) getCapacity(config *freenasProvisionerConfig) (*StorageCapacity, error) {
+	freenasServer, err := c.provisioner.GetServer(*config)
+	if err != nil {
+		return nil, err
+	}
+
+	dataset := freenas.Dataset{
+		Name: config.DatasetParentName,
+	}
+	_, err = dataset.Get(freenasServer)
+	if err != nil {
+		return nil, err
+	}
+
+	provisioned, err := provisionedBytes(freenasServer, &dataset)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StorageCapacity{
+		Server:           serverKey(config),
+		Dataset:          config.DatasetParentName,
+		AvailableBytes:   dataset.Avail,
+		UsedBytes:        dataset.Used,
+		ProvisionedBytes: provisioned,
+		Updated:          metav1.Now(),
+	}, nil
+}
+
+// saveConfigMap replaces the data of the status ConfigMap, creating it if needed
+func (c *CapacityPublisher) saveConfigMap(ctx context.Context, capacities map[string][]StorageCapacity) error {
+	data := map[string]string{}
+	for name, list := range capacities {
+		value, err := json.Marshal(list)
+		if err != nil {
+			return err
+		}
+		data[name] = string(value)
+	}
+
+	configMaps := c.Client.CoreV1().ConfigMaps(c.ConfigMapNamespace)
+	configMap, err := configMaps.Get(ctx, c.ConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      c.ConfigMapName,
+				Namespace: c.ConfigMapNamespace,
+			},
+			Data: data,
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	configMap.Data = data
+	_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+	return err
+}
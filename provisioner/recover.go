@@ -0,0 +1,340 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// annotations Delete cannot do without
+var requiredAnnotations = []string{
+	annDatasetParent,
+	annPool,
+	annZvol,
+	annISCSIName,
+	annTargetID,
+	annExtentID,
+}
+
+// needsRecovery checks if any of the required annotations are missing
+func needsRecovery(volume *v1.PersistentVolume) bool {
+	for _, k := range requiredAnnotations {
+		if len(volume.Annotations[k]) < 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// recoveryCandidate is a server a volume may live on, classConfig holds the
+// naming options and is nil when the StorageClass is unavailable
+type recoveryCandidate struct {
+	config      *freenasProvisionerConfig
+	classConfig *freenasProvisionerConfig
+}
+
+// recoveryCandidates returns the servers to search for a volume. Volumes
+// recording their server secret are searched on that server only, otherwise
+// every server of the StorageClass is searched.
+func (p *freenasProvisioner) recoveryCandidates(ctx context.Context, volume *v1.PersistentVolume) ([]recoveryCandidate, error) {
+	classConfigs, classErr := p.getVolumeConfigs(ctx, volume.Spec.StorageClassName)
+
+	if len(volume.Annotations[annServerSecretName]) < 1 {
+		if classErr != nil {
+			return nil, classErr
+		}
+		var candidates []recoveryCandidate
+		for _, classConfig := range classConfigs {
+			candidates = append(candidates, recoveryCandidate{config: classConfig, classConfig: classConfig})
+		}
+		return candidates, nil
+	}
+
+	config, err := p.GetConfigFromVolume(ctx, volume)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []recoveryCandidate
+	for _, classConfig := range classConfigs {
+		if classConfig.ServerSecretNamespace == config.ServerSecretNamespace && classConfig.ServerSecretName == config.ServerSecretName {
+			candidates = append(candidates, recoveryCandidate{config: config, classConfig: classConfig})
+		}
+	}
+	if len(candidates) < 1 {
+		candidates = append(candidates, recoveryCandidate{config: config})
+	}
+	return candidates, nil
+}
+
+// recoverAnnotations rebuilds missing annotations by looking the resources up
+// using the deterministic naming scheme (prefix + rendered name template +
+// suffix below the parent dataset) on every server the volume may live on.
+// Resources which cannot be found are recorded with an ID of 0, a volume
+// found on no server is an error.
+func (p *freenasProvisioner) recoverAnnotations(ctx context.Context, volume *v1.PersistentVolume) (map[string]string, error) {
+	glog.Infof("recovering annotations of volume %s", volume.Name)
+
+	candidates, err := p.recoveryCandidates(ctx, volume)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	for _, candidate := range candidates {
+		recovered, found, err := p.recoverFrom(ctx, volume, candidate)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", serverKey(candidate.config), err))
+			continue
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: not found", serverKey(candidate.config)))
+			continue
+		}
+
+		glog.Infof("recovered annotations of volume %s: %v", volume.Name, recovered)
+		return recovered, nil
+	}
+
+	return nil, fmt.Errorf("volume %s was not found on any server: %s", volume.Name, strings.Join(errs, "; "))
+}
+
+// recoverFrom looks the resources of a volume up on a single server, found
+// reports whether its zvol or target exists there
+func (p *freenasProvisioner) recoverFrom(ctx context.Context, volume *v1.PersistentVolume, candidate recoveryCandidate) (map[string]string, bool, error) {
+	config := candidate.config
+
+	recovered := map[string]string{}
+	get := func(k string) string {
+		if v, ok := recovered[k]; ok {
+			return v
+		}
+		return volume.Annotations[k]
+	}
+
+	// naming options are only available from the StorageClass
+	getClassConfig := func() (*freenasProvisionerConfig, error) {
+		if candidate.classConfig == nil {
+			return nil, fmt.Errorf("StorageClass \"%s\" of volume %s is unavailable", volume.Spec.StorageClassName, volume.Name)
+		}
+		return candidate.classConfig, nil
+	}
+
+	if len(get(annIdentity)) < 1 {
+		recovered[annIdentity] = p.Identifier
+	}
+
+	if len(get(annServerSecretName)) < 1 {
+		recovered[annAPIVersion] = freenas.APIVersion
+		recovered[annServerSecretNamespace] = config.ServerSecretNamespace
+		recovered[annServerSecretName] = config.ServerSecretName
+	}
+
+	if len(get(annDatasetParent)) < 1 {
+		classConfig, err := getClassConfig()
+		if err != nil {
+			return nil, false, err
+		}
+		recovered[annDatasetParent] = classConfig.DatasetParentName
+	}
+
+	freenasServer, err := p.GetServer(*config)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// the dataset the zvol was created in
+	getDatasetName := func(classConfig *freenasProvisionerConfig) string {
+		c := *classConfig
+		c.DatasetParentName = get(annDatasetParent)
+		if volume.Spec.ClaimRef == nil {
+			return c.DatasetParentName
+		}
+		return namespaceDatasetName(&c, volume.Spec.ClaimRef.Namespace)
+	}
+
+	// names are resolved exactly like Provision does
+	var names *volumeNames
+	getNames := func() (*volumeNames, error) {
+		if names != nil {
+			return names, nil
+		}
+		classConfig, err := getClassConfig()
+		if err != nil {
+			return nil, err
+		}
+		names, err = resolveNames(classConfig, getDatasetName(classConfig), newNameContextFromVolume(classConfig, volume))
+		return names, err
+	}
+
+	if len(get(annPool)) < 1 {
+		parentDs := freenas.Dataset{
+			Name: get(annDatasetParent),
+		}
+		resp, err := parentDs.Get(freenasServer)
+		found, err := checkFound(resp, err)
+		if err != nil {
+			return nil, false, err
+		}
+		if !found {
+			return nil, false, nil
+		}
+		recovered[annPool] = parentDs.Pool
+	}
+
+	if len(get(annZvol)) < 1 {
+		classConfig, err := getClassConfig()
+		if err != nil {
+			return nil, false, err
+		}
+		names, err := getNames()
+		if err != nil {
+			return nil, false, err
+		}
+		zvolDs := freenas.Dataset{
+			Name: getDatasetName(classConfig),
+		}
+		resp, err := zvolDs.Get(freenasServer)
+		found, err := checkFound(resp, err)
+		if err != nil {
+			return nil, false, err
+		}
+		if found {
+			recovered[annZvol] = zvolPath(zvolDs, names.Base)
+		} else {
+			recovered[annZvol] = strings.TrimPrefix(getDatasetName(classConfig)+"/"+names.Base, get(annPool)+"/")
+		}
+	}
+
+	zvol := freenas.Zvol{
+		Name:    get(annZvol),
+		Dataset: freenas.Dataset{Pool: get(annPool)},
+	}
+	resp, err := zvol.Get(freenasServer)
+	zvolFound, err := checkFound(resp, err)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(get(annISCSIName)) < 1 {
+		names, err := getNames()
+		if err != nil {
+			return nil, false, err
+		}
+		recovered[annISCSIName] = names.ISCSIName
+	}
+	iscsiName := get(annISCSIName)
+
+	targetID, _ := strconv.Atoi(get(annTargetID))
+	if len(get(annTargetID)) < 1 {
+		targets, _, err := freenas.ListTargets(freenasServer)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, target := range targets {
+			if target.Name == iscsiName {
+				targetID = target.ID
+				break
+			}
+		}
+		recovered[annTargetID] = strconv.Itoa(targetID)
+	}
+
+	if !zvolFound && targetID < 1 {
+		return nil, false, nil
+	}
+
+	extentID, _ := strconv.Atoi(get(annExtentID))
+	if len(get(annExtentID)) < 1 {
+		extents, _, err := freenas.ListExtents(freenasServer)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, extent := range extents {
+			if extent.Name == iscsiName {
+				extentID = extent.ID
+				break
+			}
+		}
+		recovered[annExtentID] = strconv.Itoa(extentID)
+	}
+
+	if len(get(annTargetToExtentID)) < 1 {
+		targetToExtentID := 0
+		if targetID > 0 && extentID > 0 {
+			targetToExtents, _, err := freenas.ListTargetToExtents(freenasServer)
+			if err != nil {
+				return nil, false, err
+			}
+			for _, targetToExtent := range targetToExtents {
+				if targetToExtent.Target == targetID && targetToExtent.Extent == extentID {
+					targetToExtentID = targetToExtent.ID
+					break
+				}
+			}
+		}
+		recovered[annTargetToExtentID] = strconv.Itoa(targetToExtentID)
+	}
+
+	if len(get(annTargetGroupID)) < 1 {
+		targetGroupID := 0
+		if classConfig, err := getClassConfig(); err == nil && targetID > 0 {
+			targetGroup := freenas.TargetGroup{
+				Target:      targetID,
+				Portalgroup: classConfig.TargetGroupPortalgroup,
+			}
+			_, err = targetGroup.Get(freenasServer)
+			if err == nil {
+				targetGroupID = targetGroup.ID
+			}
+		}
+		recovered[annTargetGroupID] = strconv.Itoa(targetGroupID)
+	}
+
+	return recovered, true, nil
+}
+
+// saveAnnotations adds the given annotations to a PV
+func (p *freenasProvisioner) saveAnnotations(ctx context.Context, name string, annotations map[string]string) error {
+	patch := map[string]*string{}
+	for k := range annotations {
+		v := annotations[k]
+		patch[k] = &v
+	}
+	return patchVolumeAnnotations(ctx, p.Client, name, patch)
+}
+
+// RepairVolume recovers the missing annotations of a PV by looking its
+// resources up by name, they are only saved when dryRun is false
+func RepairVolume(ctx context.Context, client kubernetes.Interface, identifier, name string, dryRun bool) (map[string]string, error) {
+	p := &freenasProvisioner{
+		Client:     client,
+		Identifier: identifier,
+	}
+
+	volume, err := client.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if !needsRecovery(volume) {
+		return map[string]string{}, nil
+	}
+
+	recovered, err := p.recoverAnnotations(ctx, volume)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return recovered, nil
+	}
+
+	return recovered, p.saveAnnotations(ctx, name, recovered)
+}
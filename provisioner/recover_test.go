@@ -0,0 +1,169 @@
+package provisioner
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNeedsRecovery(t *testing.T) {
+	complete := map[string]string{}
+	for _, k := range requiredAnnotations {
+		complete[k] = "1"
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    bool
+	}{
+		{"none", nil, true},
+		{"complete", complete, false},
+		{"missing target", without(complete, annTargetID), true},
+		{"empty extent", with(complete, annExtentID, ""), true},
+		{"optional missing", without(complete, annTargetToExtentID), false},
+	}
+
+	for _, test := range tests {
+		volume := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Annotations: test.annotations}}
+		if actual := needsRecovery(volume); actual != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, actual)
+		}
+	}
+}
+
+// recoveryFixture is a StorageClass spread over two fake servers
+type recoveryFixture struct {
+	a, b        *fakeFreenas
+	provisioner *freenasProvisioner
+}
+
+func newRecoveryFixture(t *testing.T) *recoveryFixture {
+	f := &recoveryFixture{
+		a: newFakeFreenas(t),
+		b: newFakeFreenas(t),
+	}
+	f.a.addDataset("tank/k8s")
+	f.b.addDataset("tank/k8s")
+
+	class := &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "freenas-iscsi"},
+		Provisioner: "freenas.org/iscsi",
+		Parameters: map[string]string{
+			"datasetParentName": "tank/k8s",
+			"serverSecretNames": "a,b",
+		},
+	}
+	f.provisioner = &freenasProvisioner{
+		Client:     fake.NewSimpleClientset(class, f.a.secret("kube-system", "a"), f.b.secret("kube-system", "b")),
+		Identifier: "test",
+	}
+	return f
+}
+
+// addVolume creates the zvol, target and extent of a volume on a server
+func addVolume(server *fakeFreenas, name string) (int, int) {
+	server.addZvol("tank", "k8s/"+name)
+	targetID := server.add("target", map[string]interface{}{"iscsi_target_name": name})
+	extentID := server.add("extent", map[string]interface{}{"iscsi_target_extent_name": name, "iscsi_target_extent_disk": "zvol/tank/k8s/" + name})
+	server.add("targettoextent", map[string]interface{}{"iscsi_target": targetID, "iscsi_extent": extentID})
+	return targetID, extentID
+}
+
+func TestRecoverAnnotations(t *testing.T) {
+	tests := []struct {
+		name string
+		// servers holding the volume
+		onA, onB bool
+		// server secret recorded on the volume
+		annotatedSecret string
+		expectedSecret  string
+		expectedErr     string
+	}{
+		{name: "first server", onA: true, expectedSecret: "a"},
+		{name: "second server", onB: true, expectedSecret: "b"},
+		{name: "no server", expectedErr: "was not found on any server"},
+		{name: "annotated server", onA: true, onB: true, annotatedSecret: "b", expectedSecret: "b"},
+		{name: "only the annotated server is searched", onA: true, annotatedSecret: "b", expectedErr: "was not found on any server"},
+	}
+
+	for _, test := range tests {
+		f := newRecoveryFixture(t)
+		servers := map[string]*fakeFreenas{"a": f.a, "b": f.b}
+		ids := map[string][2]int{}
+		if test.onA {
+			targetID, extentID := addVolume(f.a, "pvc-1")
+			ids["a"] = [2]int{targetID, extentID}
+		}
+		if test.onB {
+			targetID, extentID := addVolume(f.b, "pvc-1")
+			ids["b"] = [2]int{targetID, extentID}
+		}
+
+		volume := &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", Annotations: map[string]string{}},
+			Spec:       v1.PersistentVolumeSpec{StorageClassName: "freenas-iscsi"},
+		}
+		if len(test.annotatedSecret) > 0 {
+			volume.Annotations[annServerSecretNamespace] = "kube-system"
+			volume.Annotations[annServerSecretName] = test.annotatedSecret
+		}
+
+		recovered, err := f.provisioner.recoverAnnotations(context.Background(), volume)
+		if len(test.expectedErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		secret := recovered[annServerSecretName]
+		if len(secret) < 1 {
+			secret = volume.Annotations[annServerSecretName]
+		}
+		if secret != test.expectedSecret {
+			t.Errorf("%s: expected server %s, got %s", test.name, test.expectedSecret, secret)
+		}
+		if servers[secret] == nil {
+			continue
+		}
+		expected := map[string]string{
+			annDatasetParent: "tank/k8s",
+			annPool:          "tank",
+			annZvol:          "k8s/pvc-1",
+			annISCSIName:     "pvc-1",
+			annTargetID:      strconv.Itoa(ids[secret][0]),
+			annExtentID:      strconv.Itoa(ids[secret][1]),
+		}
+		for k, v := range expected {
+			if recovered[k] != v {
+				t.Errorf("%s: expected %s=%s, got %s", test.name, k, v, recovered[k])
+			}
+		}
+	}
+}
+
+func with(annotations map[string]string, key, value string) map[string]string {
+	c := map[string]string{}
+	for k, v := range annotations {
+		c[k] = v
+	}
+	c[key] = value
+	return c
+}
+
+func without(annotations map[string]string, key string) map[string]string {
+	c := with(annotations, key, "")
+	delete(c, key)
+	return c
+}
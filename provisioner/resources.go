@@ -0,0 +1,318 @@
+package provisioner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// the lun all extents are mapped to
+const defaultLunID = 0
+
+// ensureTarget creates the named target or returns the existing one
+func ensureTarget(freenasServer *freenas.Server, iscsiName string) (*freenas.Target, error) {
+	target := freenas.Target{
+		Name:  iscsiName,
+		Alias: "",
+		Mode:  "iscsi",
+	}
+	resp, err := target.Create(freenasServer)
+	if err != nil {
+		// already exists
+		if resp == nil || resp.StatusCode != 409 {
+			return nil, err
+		}
+
+		_, err = target.Get(freenasServer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &target, nil
+}
+
+// ensureTargetGroup creates the targetgroup of a target or returns the existing one
+func ensureTargetGroup(freenasServer *freenas.Server, config *freenasProvisionerConfig, targetID int) (*freenas.TargetGroup, error) {
+	targetGroup := freenas.TargetGroup{
+		Target:         targetID,
+		Authgroup:      config.TargetGroupAuthgroup,
+		Authtype:       config.TargetGroupAuthtype,
+		Initialdigest:  "Auto",
+		Initiatorgroup: config.TargetGroupInitiatorgroup,
+		Portalgroup:    config.TargetGroupPortalgroup,
+	}
+	resp, err := targetGroup.Create(freenasServer)
+	if err != nil {
+		// cope with craziness
+		if resp != nil && (resp.StatusCode == 404 || resp.StatusCode == 409) {
+			loopResp, loopErr := targetGroup.Get(freenasServer)
+			if loopErr == nil && loopResp.StatusCode == 200 {
+				return &targetGroup, nil
+			}
+		}
+
+		if resp != nil {
+			glog.Infof("failed attempt to create TargetGroup %d", resp.StatusCode)
+		}
+		return nil, err
+	}
+
+	return &targetGroup, nil
+}
+
+// ensureExtent creates the named extent for a zvol or returns the existing one
+func ensureExtent(freenasServer *freenas.Server, config *freenasProvisionerConfig, iscsiName, extentDiskName, comment string) (*freenas.Extent, error) {
+	// whole path to zvol Disk including "zvol/" must be <= 63 chars
+	extent := freenas.Extent{
+		Name:           iscsiName,
+		Type:           "Disk",
+		Disk:           extentDiskName,
+		Blocksize:      config.ExtentBlocksize, //config - 512, 1024, 2048, or 4096
+		Pblocksize:     config.ExtentDisablePhysicalBlocksize,
+		AvailThreshold: config.ExtentAvailThreshold,
+		Comment:        TruncateString(comment, 120),
+		InsecureTpc:    config.ExtentInsecureTpc,
+		Xen:            config.ExtentXen,
+		Rpm:            config.ExtentRpm, // config - Unknown, SSD, 5400, 7200, 10000, 15000
+		Ro:             config.ExtentReadOnly,
+	}
+
+	// run this as a loop as zvol creation returns a 202 and may take a little time to complete
+	extentLoopCurrent := 0
+	extentMaxLoops := 2
+	extentWaitDuration, _ := time.ParseDuration("5s")
+	for {
+		resp, err := extent.Create(freenasServer)
+		if err == nil {
+			return &extent, nil
+		}
+
+		if resp != nil && resp.StatusCode == 409 {
+			_, loopErr := extent.Get(freenasServer)
+			if loopErr != nil {
+				glog.Infof("failed attempt to create Extent %d", resp.StatusCode)
+				return nil, err
+			}
+			return &extent, nil
+		}
+
+		if extentMaxLoops == extentLoopCurrent {
+			return nil, err
+		}
+		extentLoopCurrent++
+		time.Sleep(extentWaitDuration)
+	}
+}
+
+// ensureTargetToExtent maps an extent to a target or returns the existing mapping
+func ensureTargetToExtent(freenasServer *freenas.Server, targetID, extentID int) (*freenas.TargetToExtent, error) {
+	lunid := defaultLunID
+	targetToExtent := freenas.TargetToExtent{
+		Extent: extentID,
+		Lunid:  &lunid,
+		Target: targetID,
+	}
+	resp, err := targetToExtent.Create(freenasServer)
+	if err != nil {
+		if resp == nil || resp.StatusCode != 409 {
+			return nil, err
+		}
+
+		_, loopErr := targetToExtent.Get(freenasServer)
+		if loopErr != nil {
+			glog.Infof("failed attempt to create TargetToExtent %d", resp.StatusCode)
+			return nil, err
+		}
+	}
+
+	return &targetToExtent, nil
+}
+
+// initiator admitted by per volume initiator groups while the volume is not
+// in use, an empty group would admit every initiator
+const noInitiator = "iqn.1970-01.invalid:none"
+
+// ensureVolumeInitiatorGroup creates the dedicated initiator group of a volume
+// or returns the existing one, groups are found by their comment
+func ensureVolumeInitiatorGroup(freenasServer *freenas.Server, iscsiName string) (*freenas.Initiator, error) {
+	list, _, err := freenas.ListInitiators(freenasServer)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		if list[i].Comment == iscsiName {
+			return &list[i], nil
+		}
+	}
+
+	initiator := freenas.Initiator{
+		AuthNetwork: "ALL",
+		Comment:     iscsiName,
+		Initiators:  noInitiator,
+	}
+	_, err = initiator.Create(freenasServer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &initiator, nil
+}
+
+// volumeResources are the FreeNAS resources backing a PV
+type volumeResources struct {
+	DatasetParent  string
+	Pool           string
+	Zvol           string
+	ISCSIName      string
+	Target         *freenas.Target
+	TargetGroup    *freenas.TargetGroup
+	Extent         *freenas.Extent
+	TargetToExtent *freenas.TargetToExtent
+	InitiatorGroup *freenas.Initiator
+	AuthCredential *freenas.AuthCredential
+}
+
+// newPersistentVolume creates a PV for the given resources, access modes,
+// capacity and volume mode are left to the caller
+func (p *freenasProvisioner) newPersistentVolume(config *freenasProvisionerConfig, name, basename string, resources volumeResources) *v1.PersistentVolume {
+	var portals []string
+	if len(config.ProvisionerPortals) > 0 {
+		portals = strings.Split(config.ProvisionerPortals, ",")
+	}
+
+	annotations := map[string]string{
+		annIdentity:              p.Identifier,
+		annAPIVersion:            freenas.APIVersion,
+		annServerSecretNamespace: config.ServerSecretNamespace,
+		annServerSecretName:      config.ServerSecretName,
+		annDatasetParent:         resources.DatasetParent,
+		annPool:                  resources.Pool,
+		annZvol:                  resources.Zvol,
+		annISCSIName:             resources.ISCSIName,
+		annTargetID:              strconv.Itoa(resources.Target.ID),
+		annTargetGroupID:         strconv.Itoa(resources.TargetGroup.ID),
+		annExtentID:              strconv.Itoa(resources.Extent.ID),
+		annTargetToExtentID:      strconv.Itoa(resources.TargetToExtent.ID),
+	}
+	if resources.InitiatorGroup != nil {
+		annotations[annInitiatorGroupID] = strconv.Itoa(resources.InitiatorGroup.ID)
+	}
+	if resources.AuthCredential != nil {
+		annotations[annAuthCredentialID] = strconv.Itoa(resources.AuthCredential.ID)
+	}
+
+	// record the effective per volume settings
+	annotations[annZFSProperties] = effectiveProperties(config, true)
+	annotations[annExtentSettings] = effectiveProperties(config, false)
+	if len(config.Profile) > 0 {
+		annotations[annProfile] = config.Profile
+	}
+
+	reclaimPolicy := v1.PersistentVolumeReclaimDelete
+	if config.ReclaimPolicy != nil {
+		reclaimPolicy = *config.ReclaimPolicy
+	}
+
+	//mode := v1.PersistentVolumeFilesystem
+	//VolumeMode:                    &mode,
+	//v1.PersistentVolumeR
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: annotations,
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: reclaimPolicy,
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				ISCSI: &v1.ISCSIPersistentVolumeSource{
+					TargetPortal:      config.ProvisionerTargetPortal,
+					Portals:           portals,
+					IQN:               basename + ":" + resources.ISCSIName,
+					ISCSIInterface:    config.ProvisionerISCSIInterface,
+					Lun:               int32(*resources.TargetToExtent.Lunid),
+					ReadOnly:          resources.Extent.Ro,
+					FSType:            config.FSType,
+					DiscoveryCHAPAuth: config.DiscoveryCHAPAuth,
+					SessionCHAPAuth:   config.SessionCHAPAuth,
+					SecretRef:         config.AuthSecretRef,
+				},
+			},
+		},
+	}
+}
+
+// rollback deletes the given resources in order, failures are logged only as
+// the orphan collector will eventually catch anything left behind
+func rollback(freenasServer *freenas.Server, resources ...freenas.Resource) {
+	for _, resource := range resources {
+		_, err := resource.Delete(freenasServer)
+		if err != nil {
+			glog.Warningf("failed to rollback %s: %v", describeResource(resource), err)
+		}
+	}
+}
+
+func describeResource(resource freenas.Resource) string {
+	switch r := resource.(type) {
+	case *freenas.Zvol:
+		return fmt.Sprintf("zvol \"%s/%s\"", r.Dataset.Pool, r.Name)
+	case *freenas.Target:
+		return fmt.Sprintf("target %d (\"%s\")", r.ID, r.Name)
+	case *freenas.TargetGroup:
+		return fmt.Sprintf("targetgroup %d", r.ID)
+	case *freenas.Extent:
+		return fmt.Sprintf("extent %d (\"%s\")", r.ID, r.Name)
+	case *freenas.TargetToExtent:
+		return fmt.Sprintf("targettoextent %d", r.ID)
+	case *freenas.Initiator:
+		return fmt.Sprintf("initiator %d", r.ID)
+	case *freenas.AuthCredential:
+		return fmt.Sprintf("authcredential %d (tag %d)", r.ID, r.Tag)
+	}
+	return fmt.Sprintf("%T", resource)
+}
+
+// ensureDataset gets the dataset, creating it (and any missing parents) when
+// it does not exist yet
+func ensureDataset(freenasServer *freenas.Server, dataset *freenas.Dataset) error {
+	name := dataset.Name
+	resp, err := dataset.Get(freenasServer)
+	if err == nil {
+		return nil
+	}
+	if resp == nil || resp.StatusCode != 404 {
+		return err
+	}
+
+	// pools cannot be created
+	i := strings.LastIndex(name, "/")
+	if i < 1 {
+		return err
+	}
+
+	parent := freenas.Dataset{
+		Name: name[:i],
+	}
+	err = ensureDataset(freenasServer, &parent)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("Creating dataset: \"%s\"", name)
+	dataset.Name = name
+	_, err = dataset.Create(freenasServer)
+	if err != nil {
+		return err
+	}
+
+	dataset.Name = name
+	_, err = dataset.Get(freenasServer)
+	return err
+}
@@ -0,0 +1,509 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// rotation state recorded on the CHAP Secret between start and finish
+const (
+	annCHAPRotationStarted      = "freenasCHAPRotationStarted"
+	annCHAPRotationPreviousUser = "freenasCHAPRotationPreviousUser"
+)
+
+// suffix appended to rotated CHAP users
+var rotatedUserSuffix = regexp.MustCompile(`-r[0-9]+$`)
+
+// CHAPAuthGroup is an auth group on a FreeNAS server
+type CHAPAuthGroup struct {
+	Server string
+	Tag    int
+
+	config *freenasProvisionerConfig
+}
+
+func (g *CHAPAuthGroup) String() string {
+	return fmt.Sprintf("%s authgroup %d", g.Server, g.Tag)
+}
+
+// CHAPGroup is a Secret holding session credentials together with the auth
+// groups and volumes using it, a Secret is rotated in all its auth groups at
+// once
+type CHAPGroup struct {
+	SecretNamespace string
+	SecretName      string
+	AuthGroups      []*CHAPAuthGroup
+	StorageClasses  []string
+	Volumes         []string
+
+	// set while a rotation is in progress
+	RotationStarted *time.Time
+	PreviousUser    string
+
+	// auth group of each volume
+	volumeAuthGroups map[string]*CHAPAuthGroup
+}
+
+func (g *CHAPGroup) String() string {
+	return fmt.Sprintf("secret %s/%s", g.SecretNamespace, g.SecretName)
+}
+
+// CHAPVolumeUse is a volume which may still be logged in with the previous
+// credentials of its auth group
+type CHAPVolumeUse struct {
+	Volume string
+	Node   string
+	User   string
+}
+
+func (u CHAPVolumeUse) String() string {
+	if len(u.User) < 1 {
+		return fmt.Sprintf("%s on node %s", u.Volume, u.Node)
+	}
+	return fmt.Sprintf("%s on node %s (user %s)", u.Volume, u.Node, u.User)
+}
+
+// CHAPRotator replaces the session credentials of auth groups without
+// breaking attached volumes. A rotation adds new credentials to every auth
+// group using a Secret and points the Secret at them, the previous credentials stay valid until the
+// rotation is finished once every volume logged in again.
+type CHAPRotator struct {
+	Client          kubernetes.Interface
+	ProvisionerName string
+
+	provisioner *freenasProvisioner
+}
+
+// NewCHAPRotator creates a new rotator instance
+func NewCHAPRotator(client kubernetes.Interface, provisionerName string) *CHAPRotator {
+	return &CHAPRotator{
+		Client:          client,
+		ProvisionerName: provisionerName,
+		provisioner: &freenasProvisioner{
+			Client: client,
+		},
+	}
+}
+
+// Groups returns the Secrets used by the volumes of this provisioner with
+// their auth groups, the auth group of a volume is read from its targetgroup
+func (r *CHAPRotator) Groups(ctx context.Context) ([]*CHAPGroup, error) {
+	volumes, err := listVolumes(ctx, r.Client, r.ProvisionerName)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := map[string]*CHAPGroup{}
+	var keys []string
+	for i := range volumes {
+		volume := &volumes[i]
+		iscsi := volume.Spec.PersistentVolumeSource.ISCSI
+		if iscsi == nil || !iscsi.SessionCHAPAuth || iscsi.SecretRef == nil {
+			continue
+		}
+
+		config, err := r.provisioner.GetConfigFromVolume(ctx, volume)
+		if err != nil {
+			return nil, fmt.Errorf("volume %s: %v", volume.Name, err)
+		}
+		freenasServer, err := r.provisioner.GetServer(*config)
+		if err != nil {
+			return nil, fmt.Errorf("volume %s: %v", volume.Name, err)
+		}
+
+		targetGroupID, _ := strconv.Atoi(volume.Annotations[annTargetGroupID])
+		if targetGroupID < 1 {
+			glog.Warningf("skipping volume %s for CHAP rotation, it has no targetgroup id", volume.Name)
+			continue
+		}
+		targetGroup := freenas.TargetGroup{ID: targetGroupID}
+		_, err = targetGroup.Get(freenasServer)
+		if err != nil {
+			return nil, fmt.Errorf("volume %s: failed to get targetgroup %d: %v", volume.Name, targetGroupID, err)
+		}
+		if targetGroup.Authgroup < 1 {
+			continue
+		}
+
+		key := secretKey(iscsi.SecretRef)
+		group, ok := groups[key]
+		if !ok {
+			group = &CHAPGroup{
+				SecretNamespace:  iscsi.SecretRef.Namespace,
+				SecretName:       iscsi.SecretRef.Name,
+				volumeAuthGroups: map[string]*CHAPAuthGroup{},
+			}
+			groups[key] = group
+			keys = append(keys, key)
+		}
+
+		var authGroup *CHAPAuthGroup
+		for _, g := range group.AuthGroups {
+			if g.Server == serverKey(config) && g.Tag == targetGroup.Authgroup {
+				authGroup = g
+			}
+		}
+		if authGroup == nil {
+			authGroup = &CHAPAuthGroup{
+				Server: serverKey(config),
+				Tag:    targetGroup.Authgroup,
+				config: config,
+			}
+			group.AuthGroups = append(group.AuthGroups, authGroup)
+		}
+		group.volumeAuthGroups[volume.Name] = authGroup
+		group.Volumes = append(group.Volumes, volume.Name)
+		if !contains(group.StorageClasses, volume.Spec.StorageClassName) {
+			group.StorageClasses = append(group.StorageClasses, volume.Spec.StorageClassName)
+		}
+	}
+
+	sort.Strings(keys)
+	result := make([]*CHAPGroup, 0, len(keys))
+	for _, key := range keys {
+		group := groups[key]
+		secret, err := r.provisioner.GetSecret(ctx, group.SecretNamespace, group.SecretName)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", group, err)
+		}
+		group.RotationStarted, group.PreviousUser, err = rotationState(secret)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", group, err)
+		}
+		result = append(result, group)
+	}
+
+	return result, nil
+}
+
+// rotationState returns the start and the previous user of the rotation in
+// progress on a Secret, if any
+func rotationState(secret *v1.Secret) (*time.Time, string, error) {
+	started, ok := secret.Annotations[annCHAPRotationStarted]
+	if !ok {
+		return nil, "", nil
+	}
+	t, err := time.Parse(time.RFC3339, started)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid %s annotation: %v", annCHAPRotationStarted, err)
+	}
+	return &t, secret.Annotations[annCHAPRotationPreviousUser], nil
+}
+
+// rotatedCredential is a credential added by a rotation
+type rotatedCredential struct {
+	server     *freenas.Server
+	credential freenas.AuthCredential
+}
+
+// Start adds new credentials to every auth group using the Secret, records
+// them on volumes with generated credentials and then updates the Secret. The
+// previous credentials remain valid so logged in volumes keep working, any
+// failure restores the volumes and deletes the new credentials again.
+func (r *CHAPRotator) Start(ctx context.Context, group *CHAPGroup) error {
+	secrets := r.Client.CoreV1().Secrets(group.SecretNamespace)
+	secret, err := secrets.Get(ctx, group.SecretName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	// the Secret is the source of truth, another run may have started since
+	started, _, err := rotationState(secret)
+	if err != nil {
+		return fmt.Errorf("%s: %v", group, err)
+	}
+	if started != nil {
+		return fmt.Errorf("%s: rotation started at %s has not been finished", group, started.Format(time.RFC3339))
+	}
+	user := string(secret.Data[chapSessionUsername])
+
+	authTagMutex.Lock()
+	defer authTagMutex.Unlock()
+
+	// 1. new credentials next to the current ones in every auth group
+	now := time.Now().UTC()
+	var created []rotatedCredential
+	rollback := func() {
+		for _, c := range created {
+			if _, err := c.credential.Delete(c.server); err != nil {
+				glog.Warningf("failed to rollback credential of user %s: %v", c.credential.User, err)
+			}
+		}
+	}
+	credentialIDs := map[*CHAPAuthGroup]int{}
+	var desired *freenas.AuthCredential
+	for _, authGroup := range group.AuthGroups {
+		freenasServer, err := r.provisioner.GetServer(*authGroup.config)
+		if err != nil {
+			rollback()
+			return err
+		}
+		credentials, _, err := freenas.ListAuthCredentials(freenasServer)
+		if err != nil {
+			rollback()
+			return err
+		}
+		var current *freenas.AuthCredential
+		for i := range credentials {
+			if credentials[i].Tag == authGroup.Tag && credentials[i].User == user {
+				current = &credentials[i]
+			}
+		}
+		if current == nil {
+			rollback()
+			return fmt.Errorf("%s: no credential of user %s (%s) in %s", group, user, chapSessionUsername, authGroup)
+		}
+
+		if desired == nil {
+			desired = &freenas.AuthCredential{
+				User:     fmt.Sprintf("%s-r%d", rotatedUserSuffix.ReplaceAllString(user, ""), now.Unix()),
+				Peeruser: current.Peeruser,
+			}
+			desired.Secret, err = generateCHAPSecret()
+			if err != nil {
+				rollback()
+				return err
+			}
+			if len(current.Peeruser) > 0 {
+				for len(desired.Peersecret) < 1 || desired.Peersecret == desired.Secret {
+					desired.Peersecret, err = generateCHAPSecret()
+					if err != nil {
+						rollback()
+						return err
+					}
+				}
+			}
+		}
+
+		credential := *desired
+		credential.ID = 0
+		credential.Tag = authGroup.Tag
+		_, err = credential.Create(freenasServer)
+		if err != nil {
+			rollback()
+			return fmt.Errorf("%s: failed to add credential to %s: %v", group, authGroup, err)
+		}
+		created = append(created, rotatedCredential{server: freenasServer, credential: credential})
+		credentialIDs[authGroup] = credential.ID
+		glog.Infof("%s: added credential of user %s to %s", group, credential.User, authGroup)
+	}
+	if desired == nil {
+		return fmt.Errorf("%s: no auth group uses the secret", group)
+	}
+
+	// 2. generated per volume credentials are recorded on the volume, before
+	// the Secret so a failure leaves nothing pointing at the new credentials
+	previousIDs := map[string]string{}
+	unpatch := func() {
+		for name, previousID := range previousIDs {
+			previousID := previousID
+			err := patchVolumeAnnotations(ctx, r.Client, name, map[string]*string{
+				annAuthCredentialID: &previousID,
+			})
+			if err != nil {
+				glog.Warningf("%s: failed to restore the %s annotation of volume %s to %s: %v", group, annAuthCredentialID, name, previousID, err)
+			}
+		}
+	}
+	for _, name := range group.Volumes {
+		volume, err := r.Client.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			unpatch()
+			rollback()
+			return err
+		}
+		if len(volume.Annotations[annAuthCredentialID]) < 1 {
+			continue
+		}
+		credentialID := strconv.Itoa(credentialIDs[group.volumeAuthGroups[name]])
+		err = patchVolumeAnnotations(ctx, r.Client, name, map[string]*string{
+			annAuthCredentialID: &credentialID,
+		})
+		if err != nil {
+			unpatch()
+			rollback()
+			return fmt.Errorf("%s: failed to record the new credential on volume %s: %v", group, name, err)
+		}
+		previousIDs[name] = volume.Annotations[annAuthCredentialID]
+	}
+
+	// 3. new logins use the new credentials
+	secret.Data[chapSessionUsername] = []byte(desired.User)
+	secret.Data[chapSessionPassword] = []byte(desired.Secret)
+	if len(desired.Peeruser) > 0 {
+		secret.Data[chapSessionUsernameIn] = []byte(desired.Peeruser)
+		secret.Data[chapSessionPasswordIn] = []byte(desired.Peersecret)
+	}
+	metav1.SetMetaDataAnnotation(&secret.ObjectMeta, annCHAPRotationStarted, now.Format(time.RFC3339))
+	metav1.SetMetaDataAnnotation(&secret.ObjectMeta, annCHAPRotationPreviousUser, user)
+	_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	if err != nil {
+		// the new credentials are unused, leave the groups and volumes as they were
+		unpatch()
+		rollback()
+		return err
+	}
+
+	group.RotationStarted = &now
+	group.PreviousUser = user
+	return nil
+}
+
+// InUse returns the volumes using the Secret which were logged in before the
+// rotation started (or now if none is in progress) and still are. iscsid keeps
+// the credentials of the login, these volumes need to be detached and attached
+// again, e.g. by restarting their pods, to pick up the new credentials.
+func (r *CHAPRotator) InUse(ctx context.Context, group *CHAPGroup) ([]CHAPVolumeUse, error) {
+	since := time.Now()
+	user := ""
+	if group.RotationStarted != nil {
+		since = *group.RotationStarted
+		user = group.PreviousUser
+	}
+
+	volumes := map[string]*v1.PersistentVolume{}
+	claims := map[string]string{}
+	for _, name := range group.Volumes {
+		volume, err := r.Client.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		volumes[name] = volume
+		if volume.Spec.ClaimRef != nil {
+			claims[volume.Spec.ClaimRef.Namespace+"/"+volume.Spec.ClaimRef.Name] = name
+		}
+	}
+
+	seen := map[string]bool{}
+	var uses []CHAPVolumeUse
+	add := func(volume, node string) {
+		if seen[volume+"/"+node] {
+			return
+		}
+		seen[volume+"/"+node] = true
+		uses = append(uses, CHAPVolumeUse{Volume: volume, Node: node, User: user})
+	}
+
+	attachments, err := r.Client.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, attachment := range attachments.Items {
+		name := attachment.Spec.Source.PersistentVolumeName
+		if name == nil || volumes[*name] == nil {
+			continue
+		}
+		if attachment.CreationTimestamp.Time.Before(since) {
+			add(*name, attachment.Spec.NodeName)
+		}
+	}
+
+	pods, err := r.Client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range pods.Items {
+		if len(pod.Spec.NodeName) < 1 || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		// pods which have not started yet log in with the new credentials
+		if pod.Status.StartTime == nil || !pod.Status.StartTime.Time.Before(since) {
+			continue
+		}
+		for _, podVolume := range pod.Spec.Volumes {
+			if podVolume.PersistentVolumeClaim == nil {
+				continue
+			}
+			if name, ok := claims[pod.Namespace+"/"+podVolume.PersistentVolumeClaim.ClaimName]; ok {
+				add(name, pod.Spec.NodeName)
+			}
+		}
+	}
+
+	sort.Slice(uses, func(i, j int) bool {
+		if uses[i].Volume != uses[j].Volume {
+			return uses[i].Volume < uses[j].Volume
+		}
+		return uses[i].Node < uses[j].Node
+	})
+	return uses, nil
+}
+
+// Finish removes the previous credentials from every auth group using the
+// Secret. Unless forced it refuses while volumes may still be logged in with
+// them.
+func (r *CHAPRotator) Finish(ctx context.Context, group *CHAPGroup, force bool) ([]CHAPVolumeUse, error) {
+	secrets := r.Client.CoreV1().Secrets(group.SecretNamespace)
+	secret, err := secrets.Get(ctx, group.SecretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	group.RotationStarted, group.PreviousUser, err = rotationState(secret)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", group, err)
+	}
+	if group.RotationStarted == nil {
+		return nil, fmt.Errorf("%s: no rotation in progress", group)
+	}
+
+	uses, err := r.InUse(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+	if len(uses) > 0 && !force {
+		return uses, fmt.Errorf("%s: %d volume(s) still need to log in again", group, len(uses))
+	}
+
+	// 3. drop the previous credentials
+	for _, authGroup := range group.AuthGroups {
+		freenasServer, err := r.provisioner.GetServer(*authGroup.config)
+		if err != nil {
+			return uses, err
+		}
+		credentials, _, err := freenas.ListAuthCredentials(freenasServer)
+		if err != nil {
+			return uses, err
+		}
+		for i := range credentials {
+			credential := &credentials[i]
+			if credential.Tag != authGroup.Tag || credential.User != group.PreviousUser {
+				continue
+			}
+			resp, err := credential.Delete(freenasServer)
+			if err != nil && (resp == nil || resp.StatusCode != 404) {
+				return uses, err
+			}
+			glog.Infof("%s: removed credential of user %s from %s", group, credential.User, authGroup)
+		}
+	}
+
+	delete(secret.Annotations, annCHAPRotationStarted)
+	delete(secret.Annotations, annCHAPRotationPreviousUser)
+	_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	if err != nil {
+		return uses, err
+	}
+
+	group.RotationStarted = nil
+	group.PreviousUser = ""
+	return uses, nil
+}
+
+// contains reports whether list holds value
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
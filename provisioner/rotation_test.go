@@ -0,0 +1,125 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRotationStart(t *testing.T) {
+	tests := []struct {
+		name string
+		// "verb resource name" failing in the cluster
+		failing string
+		err     string
+	}{
+		{name: "rotated"},
+		{name: "secret update fails", failing: "update secrets chap", err: "injected"},
+		{name: "volume patch fails", failing: "patch persistentvolumes pv-b", err: "failed to record the new credential on volume pv-b"},
+	}
+
+	for _, test := range tests {
+		f := newFakeFreenas(t)
+		credentialID := f.add("authcredential", map[string]interface{}{
+			"iscsi_target_auth_tag":    float64(1),
+			"iscsi_target_auth_user":   "shared",
+			"iscsi_target_auth_secret": "0123456789abcdef",
+		})
+		previousID := strconv.Itoa(credentialID)
+
+		var objects []runtime.Object
+		objects = append(objects, &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "chap"},
+			Data: map[string][]byte{
+				chapSessionUsername: []byte("shared"),
+				chapSessionPassword: []byte("0123456789abcdef"),
+			},
+		})
+		for _, name := range []string{"pv-a", "pv-b"} {
+			objects = append(objects, &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{annAuthCredentialID: previousID}},
+			})
+		}
+		client := fake.NewSimpleClientset(objects...)
+		if len(test.failing) > 0 {
+			failing := strings.Split(test.failing, " ")
+			client.PrependReactor(failing[0], failing[1], func(action k8stesting.Action) (bool, runtime.Object, error) {
+				var name string
+				switch a := action.(type) {
+				case k8stesting.UpdateAction:
+					name = a.GetObject().(metav1.Object).GetName()
+				case k8stesting.PatchAction:
+					name = a.GetName()
+				}
+				return name == failing[2], nil, errors.New("injected")
+			})
+		}
+
+		u, _ := url.Parse(f.URL)
+		port, _ := strconv.Atoi(u.Port())
+		authGroup := &CHAPAuthGroup{
+			Server: u.Host,
+			Tag:    1,
+			config: &freenasProvisionerConfig{
+				ServerProtocol: "http",
+				ServerHost:     u.Hostname(),
+				ServerPort:     port,
+				ServerUsername: "root",
+				ServerPassword: "secret",
+			},
+		}
+		group := &CHAPGroup{
+			SecretNamespace:  "kube-system",
+			SecretName:       "chap",
+			AuthGroups:       []*CHAPAuthGroup{authGroup},
+			Volumes:          []string{"pv-a", "pv-b"},
+			volumeAuthGroups: map[string]*CHAPAuthGroup{"pv-a": authGroup, "pv-b": authGroup},
+		}
+
+		ctx := context.Background()
+		err := NewCHAPRotator(client, testProvisionerName).Start(ctx, group)
+		credentials := f.list("authcredential")
+		secret, _ := client.CoreV1().Secrets("kube-system").Get(ctx, "chap", metav1.GetOptions{})
+
+		expectedID := previousID
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			if len(credentials) != 1 {
+				t.Errorf("%s: expected the new credential to be rolled back, got %v", test.name, credentials)
+			}
+			if string(secret.Data[chapSessionUsername]) != "shared" {
+				t.Errorf("%s: expected the secret unchanged, got user %s", test.name, secret.Data[chapSessionUsername])
+			}
+		} else {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+				continue
+			}
+			if len(credentials) != 2 {
+				t.Fatalf("%s: expected the new credential next to the previous one, got %v", test.name, credentials)
+			}
+			if user := string(secret.Data[chapSessionUsername]); user != credentials[1]["iscsi_target_auth_user"] {
+				t.Errorf("%s: expected the secret to use the new credential, got user %s", test.name, user)
+			}
+			expectedID = strconv.Itoa(credentials[1]["id"].(int))
+		}
+
+		for _, name := range group.Volumes {
+			volume, _ := client.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+			if actual := volume.Annotations[annAuthCredentialID]; actual != expectedID {
+				t.Errorf("%s: expected volume %s to record credential %s, got %s", test.name, name, expectedID, actual)
+			}
+		}
+	}
+}
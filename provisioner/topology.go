@@ -0,0 +1,166 @@
+package provisioner
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
+)
+
+// topologyMapping maps a node label value to the server (and optionally the
+// portal) reachable from nodes carrying it
+type topologyMapping struct {
+	Value           string
+	SecretNamespace string
+	SecretName      string
+	Portal          string
+}
+
+// volumeTopology restricts the servers of a StorageClass to the topology
+// values allowed for a volume
+type volumeTopology struct {
+	Key      string
+	Mappings []topologyMapping
+	Allowed  map[string]bool
+	// Preferred is the value of the selected node
+	Preferred string
+}
+
+// topologyMappings parses topologyServers (value=secret, secrets given as
+// name or namespace/name) and topologyPortals (value=host:port)
+func topologyMappings(config *freenasProvisionerConfig) ([]topologyMapping, error) {
+	portals := map[string]string{}
+	for _, item := range splitList(config.TopologyPortals) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || len(parts[0]) < 1 || len(parts[1]) < 1 {
+			return nil, fmt.Errorf("invalid topologyPortals entry (%s), must be value=host:port", item)
+		}
+		portals[parts[0]] = parts[1]
+	}
+
+	var mappings []topologyMapping
+	for _, item := range splitList(config.TopologyServers) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || len(parts[0]) < 1 || len(parts[1]) < 1 {
+			return nil, fmt.Errorf("invalid topologyServers entry (%s), must be value=secret", item)
+		}
+		mapping := topologyMapping{
+			Value:           parts[0],
+			SecretNamespace: config.ServerSecretNamespace,
+			SecretName:      parts[1],
+			Portal:          portals[parts[0]],
+		}
+		if secret := strings.SplitN(parts[1], "/", 2); len(secret) == 2 {
+			mapping.SecretNamespace = secret[0]
+			mapping.SecretName = secret[1]
+		}
+		mappings = append(mappings, mapping)
+	}
+
+	return mappings, nil
+}
+
+// getVolumeTopology determines the topology values a volume may use from the
+// selected node or the allowed topologies of the StorageClass, nil is
+// returned for classes without topology mappings
+func getVolumeTopology(config *freenasProvisionerConfig, options controller.ProvisionOptions) (*volumeTopology, error) {
+	if len(config.TopologyServers) < 1 {
+		return nil, nil
+	}
+	if len(config.TopologyKey) < 1 {
+		return nil, fmt.Errorf("topologyKey is required with topologyServers")
+	}
+
+	mappings, err := topologyMappings(config)
+	if err != nil {
+		return nil, err
+	}
+
+	topology := &volumeTopology{
+		Key:      config.TopologyKey,
+		Mappings: mappings,
+	}
+
+	if options.SelectedNode != nil {
+		value, ok := options.SelectedNode.Labels[config.TopologyKey]
+		if !ok {
+			return nil, fmt.Errorf("selected node %s has no %s label", options.SelectedNode.Name, config.TopologyKey)
+		}
+		topology.Allowed = map[string]bool{value: true}
+		topology.Preferred = value
+		return topology, nil
+	}
+
+	if options.StorageClass != nil && len(options.StorageClass.AllowedTopologies) > 0 {
+		topology.Allowed = map[string]bool{}
+		for _, term := range options.StorageClass.AllowedTopologies {
+			for _, expression := range term.MatchLabelExpressions {
+				if expression.Key != config.TopologyKey {
+					continue
+				}
+				for _, value := range expression.Values {
+					topology.Allowed[value] = true
+				}
+			}
+		}
+	}
+
+	return topology, nil
+}
+
+// filter returns the configs of servers mapped to an allowed topology value
+func (t *volumeTopology) filter(configs []*freenasProvisionerConfig) []*freenasProvisionerConfig {
+	var filtered []*freenasProvisionerConfig
+	for _, config := range configs {
+		if len(t.values(config)) > 0 {
+			filtered = append(filtered, config)
+		}
+	}
+	return filtered
+}
+
+// values returns the allowed topology values mapped to the server of a config
+func (t *volumeTopology) values(config *freenasProvisionerConfig) []string {
+	var values []string
+	for _, mapping := range t.Mappings {
+		if mapping.SecretNamespace != config.ServerSecretNamespace || mapping.SecretName != config.ServerSecretName {
+			continue
+		}
+		if t.Allowed != nil && !t.Allowed[mapping.Value] {
+			continue
+		}
+		values = append(values, mapping.Value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// apply sets the portal of the chosen server and returns the node affinity
+// restricting the PV to nodes which can reach it
+func (t *volumeTopology) apply(config *freenasProvisionerConfig) *v1.VolumeNodeAffinity {
+	values := t.values(config)
+
+	value := t.Preferred
+	if len(value) < 1 && len(values) > 0 {
+		value = values[0]
+	}
+	for _, mapping := range t.Mappings {
+		if mapping.Value == value && len(mapping.Portal) > 0 {
+			config.ProvisionerTargetPortal = mapping.Portal
+		}
+	}
+
+	return &v1.VolumeNodeAffinity{
+		Required: &v1.NodeSelector{
+			NodeSelectorTerms: []v1.NodeSelectorTerm{{
+				MatchExpressions: []v1.NodeSelectorRequirement{{
+					Key:      t.Key,
+					Operator: v1.NodeSelectorOpIn,
+					Values:   values,
+				}},
+			}},
+		},
+	}
+}
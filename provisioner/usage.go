@@ -0,0 +1,140 @@
+package provisioner
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/travisghansen/freenas-iscsi-provisioner/freenas"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// VolumeUsage is the consumption of the zvol backing a PV
+type VolumeUsage struct {
+	Volume          string
+	ClaimNamespace  string
+	ClaimName       string
+	UsedBytes       int64
+	ReferencedBytes int64
+	CapacityBytes   int64
+}
+
+// UsageCollector periodically reads the zvol stats of all managed PVs and
+// exports them as prometheus gauges and optionally as PV annotations
+type UsageCollector struct {
+	Client          kubernetes.Interface
+	ProvisionerName string
+	Annotate        bool
+
+	provisioner *freenasProvisioner
+}
+
+// NewUsageCollector creates a new collector instance
+func NewUsageCollector(client kubernetes.Interface, provisionerName string, annotate bool) *UsageCollector {
+	return &UsageCollector{
+		Client:          client,
+		ProvisionerName: provisionerName,
+		Annotate:        annotate,
+		provisioner: &freenasProvisioner{
+			Client: client,
+		},
+	}
+}
+
+// Run collects usage every interval until the context is done
+func (u *UsageCollector) Run(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		_, err := u.Collect(ctx)
+		if err != nil {
+			glog.Errorf("usage collection failed: %v", err)
+		}
+	}, interval)
+}
+
+// Collect reads the usage of all volumes once
+func (u *UsageCollector) Collect(ctx context.Context) ([]VolumeUsage, error) {
+	volumes, err := listVolumes(ctx, u.Client, u.ProvisionerName)
+	if err != nil {
+		return nil, err
+	}
+
+	// zvols are listed once per server and pool
+	zvolLists := map[string]map[string]freenas.Zvol{}
+
+	var usages []VolumeUsage
+	for i := range volumes {
+		volume := &volumes[i]
+		config, err := u.provisioner.GetConfigFromVolume(ctx, volume)
+		if err != nil {
+			glog.Warningf("skipping volume %s for usage collection: %v", volume.Name, err)
+			continue
+		}
+
+		pool := volume.Annotations[annPool]
+		key := serverKey(config) + "/" + pool
+		zvols, ok := zvolLists[key]
+		if !ok {
+			freenasServer, err := u.provisioner.GetServer(*config)
+			if err != nil {
+				glog.Warningf("skipping volume %s for usage collection: %v", volume.Name, err)
+				continue
+			}
+			list, _, err := freenas.ListZvols(freenasServer, pool)
+			if err != nil {
+				glog.Warningf("skipping volume %s for usage collection: %v", volume.Name, err)
+				continue
+			}
+			zvols = map[string]freenas.Zvol{}
+			for _, zvol := range list {
+				zvols[zvol.Name] = zvol
+			}
+			zvolLists[key] = zvols
+		}
+
+		zvol, ok := zvols[volume.Annotations[annZvol]]
+		if !ok {
+			glog.Warningf("zvol %s/%s of volume %s not found", pool, volume.Annotations[annZvol], volume.Name)
+			continue
+		}
+
+		usage := VolumeUsage{
+			Volume:          volume.Name,
+			UsedBytes:       zvol.Used,
+			ReferencedBytes: zvol.Refer,
+			CapacityBytes:   zvol.VolsizeBytes,
+		}
+		if volume.Spec.ClaimRef != nil {
+			usage.ClaimNamespace = volume.Spec.ClaimRef.Namespace
+			usage.ClaimName = volume.Spec.ClaimRef.Name
+		}
+		usages = append(usages, usage)
+
+		if u.Annotate {
+			used := strconv.FormatInt(usage.UsedBytes, 10)
+			referenced := strconv.FormatInt(usage.ReferencedBytes, 10)
+			if volume.Annotations[annUsedBytes] != used || volume.Annotations[annReferencedBytes] != referenced {
+				err = patchVolumeAnnotations(ctx, u.Client, volume.Name, map[string]*string{
+					annUsedBytes:       &used,
+					annReferencedBytes: &referenced,
+				})
+				if err != nil {
+					glog.Warningf("failed to annotate usage of volume %s: %v", volume.Name, err)
+				}
+			}
+		}
+	}
+
+	// drop series of deleted volumes
+	volumeUsedBytes.Reset()
+	volumeReferencedBytes.Reset()
+	volumeCapacityBytes.Reset()
+	for _, usage := range usages {
+		volumeUsedBytes.WithLabelValues(usage.Volume, usage.ClaimNamespace, usage.ClaimName).Set(float64(usage.UsedBytes))
+		volumeReferencedBytes.WithLabelValues(usage.Volume, usage.ClaimNamespace, usage.ClaimName).Set(float64(usage.ReferencedBytes))
+		volumeCapacityBytes.WithLabelValues(usage.Volume, usage.ClaimNamespace, usage.ClaimName).Set(float64(usage.CapacityBytes))
+	}
+
+	return usages, nil
+}
@@ -0,0 +1,246 @@
+package provisioner
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// ParameterError lists all problems found in the parameters of a StorageClass
+type ParameterError struct {
+	Problems []string
+}
+
+func (e *ParameterError) Error() string {
+	return "invalid StorageClass parameters: " + strings.Join(e.Problems, "; ")
+}
+
+// parameterErrors collects problems while parsing parameters
+type parameterErrors []string
+
+func (e *parameterErrors) add(format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, args...))
+}
+
+// parseBool parses a boolean parameter, target keeps its default on errors
+// and for empty values
+func (e *parameterErrors) parseBool(key, value string, target *bool) {
+	if len(value) < 1 {
+		return
+	}
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		e.add("%s must be true or false, got %q", key, value)
+		return
+	}
+	*target = v
+}
+
+// parseInt parses an integer parameter, target keeps its default on errors
+// and for empty values
+func (e *parameterErrors) parseInt(key, value string, target *int) {
+	if len(value) < 1 {
+		return
+	}
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		e.add("%s must be an integer, got %q", key, value)
+		return
+	}
+	*target = v
+}
+
+// oneOf checks an enum parameter, empty values are left to the defaults
+func (e *parameterErrors) oneOf(key, value string, allowed ...string) {
+	if len(value) < 1 {
+		return
+	}
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	e.add("%s must be one of %s, got %q", key, strings.Join(allowed, ", "), value)
+}
+
+// quantity checks an optional size parameter
+func (e *parameterErrors) quantity(key, value string) {
+	if len(value) < 1 {
+		return
+	}
+	if _, err := resource.ParseQuantity(value); err != nil {
+		e.add("%s must be a quantity (e.g. 100Gi), got %q", key, value)
+	}
+}
+
+func (e parameterErrors) err() error {
+	if len(e) < 1 {
+		return nil
+	}
+	problems := append([]string{}, e...)
+	sort.Strings(problems)
+	return &ParameterError{Problems: problems}
+}
+
+// parseParametersLenient parses the parameters of a StorageClass to manage
+// existing volumes, invalid values are logged and left to their defaults so a
+// typo in an immutable StorageClass does not keep its volumes from being deleted
+func parseParametersLenient(storageClassName string, parameters map[string]string) (*freenasProvisionerConfig, error) {
+	config, err := parseParameters(parameters)
+	if e, ok := err.(*ParameterError); ok {
+		glog.Warningf("ignoring %s of StorageClass \"%s\"", e.Error(), storageClassName)
+		return config, nil
+	}
+	return config, err
+}
+
+// validateConfig checks enums and cross-field rules of a parsed config
+func validateConfig(config *freenasProvisionerConfig, errs *parameterErrors) {
+	errs.oneOf("fsType", config.FSType, "ext2", "ext3", "ext4", "xfs", "btrfs")
+	errs.oneOf("targetGroupAuthtype", config.TargetGroupAuthtype, "None", "Auto", "CHAP", "CHAP Mutual")
+	errs.oneOf("zvolCompression", config.ZvolCompression, volumeProperties["compression"].values...)
+	errs.oneOf("zvolDedup", config.ZvolDedup, volumeProperties["dedup"].values...)
+	errs.oneOf("zvolBlocksize", config.ZvolBlocksize, volumeProperties["volblocksize"].values...)
+	errs.oneOf("extentRpm", config.ExtentRpm, volumeProperties["extentRpm"].values...)
+	errs.oneOf("datasetParentCompression", config.DatasetParentCompression, volumeProperties["compression"].values...)
+	errs.oneOf("initiatorGroupNetworks", config.InitiatorGroupNetworks, initiatorNetworksNode, initiatorNetworksAll)
+	errs.oneOf("serverPlacementPolicy", config.ServerPlacementPolicy, placementMostFree, placementRoundRobin, placementWeighted)
+
+	if config.ExtentBlocksize != 0 {
+		errs.oneOf("extentBlocksize", strconv.Itoa(config.ExtentBlocksize), volumeProperties["extentBlocksize"].values...)
+	}
+	if config.ExtentAvailThreshold < 0 || config.ExtentAvailThreshold > 100 {
+		errs.add("extentAvailThreshold must be between 0 and 100, got %d", config.ExtentAvailThreshold)
+	}
+	for key, id := range map[string]int{
+		"targetGroupAuthgroup":      config.TargetGroupAuthgroup,
+		"targetGroupInitiatorgroup": config.TargetGroupInitiatorgroup,
+		"targetGroupPortalgroup":    config.TargetGroupPortalgroup,
+	} {
+		if id < 0 {
+			errs.add("%s must not be negative, got %d", key, id)
+		}
+	}
+
+	name := config.DatasetParentName
+	if len(name) < 1 || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") || strings.Contains(name, "//") {
+		errs.add("datasetParentName must be a dataset name such as tank/k8s, got %q", name)
+	}
+
+	errs.quantity("datasetNamespaceQuota", config.DatasetNamespaceQuota)
+	errs.quantity("datasetParentQuota", config.DatasetParentQuota)
+	errs.quantity("datasetParentReservation", config.DatasetParentReservation)
+	errs.quantity("capacityMinFree", config.CapacityMinFree)
+	errs.quantity("pvcMinSize", config.PVCMinSize)
+	errs.quantity("pvcMaxSize", config.PVCMaxSize)
+	for _, mode := range splitList(config.PVCAccessModes) {
+		errs.oneOf("pvcAccessModes", mode, string(v1.ReadWriteOnce), string(v1.ReadOnlyMany))
+	}
+	if len(config.CapacityOvercommitRatio) > 0 {
+		if ratio, err := strconv.ParseFloat(config.CapacityOvercommitRatio, 64); err != nil || ratio <= 0 {
+			errs.add("capacityOvercommitRatio must be a positive number, got %q", config.CapacityOvercommitRatio)
+		}
+	}
+
+	if tmpl, err := template.New("name").Option("missingkey=error").Parse(config.ProvisionerNameTemplate); err != nil {
+		errs.add("provisionerNameTemplate is invalid: %v", err)
+	} else if !uniqueTemplate(tmpl) {
+		// an existing zvol is taken over on retries, a name shared by two
+		// volumes would hand the data of one to the other
+		errs.add("provisionerNameTemplate must use .PVName or .UID so every volume gets its own name")
+	}
+
+	// cross-field rules
+	chap := config.TargetGroupAuthtype == "CHAP" || config.TargetGroupAuthtype == "CHAP Mutual"
+	if chap && config.TargetGroupAuthgroup < 1 && !config.AuthPerVolume {
+		errs.add("targetGroupAuthtype %s requires targetGroupAuthgroup", config.TargetGroupAuthtype)
+	}
+	if config.AuthPerVolume && (!chap || config.TargetGroupAuthgroup > 0) {
+		errs.add("targetGroupAuthPerVolume requires targetGroupAuthtype CHAP or CHAP Mutual and cannot be combined with targetGroupAuthgroup")
+	}
+	if config.DiscoveryCHAPManage && (!config.DiscoveryCHAPAuth || config.TargetGroupPortalgroup < 1) {
+		errs.add("targetDiscoveryCHAPManage requires targetDiscoveryCHAPAuth and targetGroupPortalgroup")
+	}
+	if config.SessionCHAPAuth && !chap {
+		errs.add("targetSessionCHAPAuth requires targetGroupAuthtype CHAP or CHAP Mutual")
+	}
+	if config.InitiatorGroupSync && config.TargetGroupInitiatorgroup < 1 {
+		errs.add("initiatorGroupSync requires targetGroupInitiatorgroup")
+	}
+	if config.InitiatorGroupPerVolume && (config.InitiatorGroupSync || config.TargetGroupInitiatorgroup > 0) {
+		errs.add("initiatorGroupPerVolume cannot be combined with initiatorGroupSync or targetGroupInitiatorgroup")
+	}
+	if _, err := labels.Parse(config.InitiatorGroupNodeSelector); err != nil {
+		errs.add("initiatorGroupNodeSelector is invalid: %v", err)
+	}
+	if config.ProvisionerPortalsFromGroup && (len(config.ProvisionerTargetPortal) > 0 || len(config.ProvisionerPortals) > 0) {
+		errs.add("provisionerPortalsFromGroup cannot be combined with provisionerTargetPortal or provisionerPortals")
+	}
+	if config.ProvisionerPortalsFromGroup && config.TargetGroupPortalgroup < 1 {
+		errs.add("provisionerPortalsFromGroup requires targetGroupPortalgroup")
+	}
+	if !config.DatasetPerNamespace && (len(config.DatasetNamespaceQuota) > 0 || len(config.DatasetNamespaceQuotaConfigMap) > 0) {
+		errs.add("datasetNamespaceQuota and datasetNamespaceQuotaConfigMap require datasetPerNamespace")
+	}
+	if !config.DatasetParentCreate && (len(config.DatasetParentCompression) > 0 || len(config.DatasetParentQuota) > 0 || len(config.DatasetParentReservation) > 0 || len(config.DatasetParentComments) > 0) {
+		errs.add("datasetParentCompression, datasetParentQuota, datasetParentReservation and datasetParentComments require datasetParentCreate")
+	}
+	if len(config.ServerSecretNames) < 1 && (len(config.DatasetParentNames) > 0 || len(config.ServerWeights) > 0) {
+		errs.add("datasetParentNames and serverWeights require serverSecretNames")
+	}
+	if len(config.ServerWeights) > 0 && config.ServerPlacementPolicy != placementWeighted {
+		errs.add("serverWeights requires serverPlacementPolicy %s", placementWeighted)
+	}
+	entries, err := serverEntries(config)
+	if err != nil {
+		errs.add("%v", err)
+	}
+	if len(config.TopologyServers) > 0 && len(config.TopologyKey) < 1 {
+		errs.add("topologyServers requires topologyKey")
+	}
+	if len(config.TopologyPortals) > 0 && len(config.TopologyServers) < 1 {
+		errs.add("topologyPortals requires topologyServers")
+	}
+	mappings, err := topologyMappings(config)
+	if err != nil {
+		errs.add("%v", err)
+	}
+	for _, mapping := range mappings {
+		found := false
+		for _, entry := range entries {
+			if entry.SecretNamespace == mapping.SecretNamespace && entry.SecretName == mapping.SecretName {
+				found = true
+			}
+		}
+		if !found {
+			errs.add("topologyServers maps %s to %s/%s which is not a server of the StorageClass", mapping.Value, mapping.SecretNamespace, mapping.SecretName)
+		}
+	}
+	if _, err := applyVolumeProperties(config, nil); err != nil {
+		errs.add("%v", err)
+	}
+}
+
+// uniqueTemplate checks that a naming template renders different names for
+// volumes only differing in their PV name and claim UID
+func uniqueTemplate(tmpl *template.Template) bool {
+	render := func(data nameContext) string {
+		var rendered bytes.Buffer
+		if err := tmpl.Execute(&rendered, data); err != nil {
+			return ""
+		}
+		return rendered.String()
+	}
+
+	a := render(nameContext{PVName: "pvc-a", PVCNamespace: "ns", PVCName: "claim", UID: "a"})
+	b := render(nameContext{PVName: "pvc-b", PVCNamespace: "ns", PVCName: "claim", UID: "b"})
+	return a != b
+}
@@ -0,0 +1,181 @@
+package provisioner
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseParameters(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		// expected problems, one substring each
+		problems []string
+		check    func(config *freenasProvisionerConfig) bool
+	}{
+		{
+			name:       "defaults",
+			parameters: map[string]string{},
+			check: func(c *freenasProvisionerConfig) bool {
+				return c.FSType == "ext4" && c.DatasetParentName == "tank" && c.ZvolSparse && c.ProvisionerRollbackPartialFailures && c.TargetGroupAuthtype == "None"
+			},
+		},
+		{
+			name: "values",
+			parameters: map[string]string{
+				"datasetParentName":      "tank/k8s",
+				"zvolSparse":             "false",
+				"targetGroupPortalgroup": "2",
+				"zfsProperties":          "compression=lz4, sync=always",
+			},
+			check: func(c *freenasProvisionerConfig) bool {
+				return c.DatasetParentName == "tank/k8s" && !c.ZvolSparse && c.TargetGroupPortalgroup == 2
+			},
+		},
+		{
+			name: "empty values are unset",
+			parameters: map[string]string{
+				"targetGroupPortalgroup":    "",
+				"targetGroupInitiatorgroup": "",
+				"zvolSparse":                "",
+				"zvolCompression":           "",
+			},
+			check: func(c *freenasProvisionerConfig) bool {
+				return c.TargetGroupPortalgroup == 0 && c.TargetGroupInitiatorgroup == 0 && c.ZvolSparse
+			},
+		},
+		{
+			name:       "unknown parameter",
+			parameters: map[string]string{"datasetParent": "tank/k8s"},
+			problems:   []string{"unknown parameter datasetParent"},
+		},
+		{
+			name: "malformed values",
+			parameters: map[string]string{
+				"zvolSparse":             "yes please",
+				"targetGroupPortalgroup": "one",
+				"pvcMaxSize":             "lots",
+			},
+			problems: []string{"zvolSparse must be true or false", "targetGroupPortalgroup must be an integer", "pvcMaxSize must be a quantity"},
+		},
+		{
+			name:       "enum",
+			parameters: map[string]string{"targetGroupAuthtype": "Kerberos", "fsType": "zfs"},
+			problems:   []string{"fsType must be one of", "targetGroupAuthtype must be one of"},
+		},
+		{
+			name:       "dataset name",
+			parameters: map[string]string{"datasetParentName": "/tank/k8s/"},
+			problems:   []string{"datasetParentName must be a dataset name"},
+		},
+		{
+			name:       "chap requires authgroup",
+			parameters: map[string]string{"targetGroupAuthtype": "CHAP"},
+			problems:   []string{"targetGroupAuthtype CHAP requires targetGroupAuthgroup"},
+		},
+		{
+			name:       "per volume auth",
+			parameters: map[string]string{"targetGroupAuthPerVolume": "true", "targetGroupAuthtype": "CHAP", "targetGroupAuthgroup": "1"},
+			problems:   []string{"targetGroupAuthPerVolume requires"},
+		},
+		{
+			name:       "per volume initiator group",
+			parameters: map[string]string{"initiatorGroupPerVolume": "true", "targetGroupInitiatorgroup": "1"},
+			problems:   []string{"initiatorGroupPerVolume cannot be combined"},
+		},
+		{
+			name:       "weights without servers",
+			parameters: map[string]string{"serverWeights": "1,2"},
+			problems:   []string{"datasetParentNames and serverWeights require serverSecretNames", "serverWeights requires serverPlacementPolicy"},
+		},
+		{
+			name:       "name template",
+			parameters: map[string]string{"provisionerNameTemplate": "{{ .PVCNamespace }}-{{ .PVCName }}"},
+			problems:   []string{"provisionerNameTemplate must use .PVName or .UID"},
+		},
+		{
+			name:       "unsupported zfs property",
+			parameters: map[string]string{"zfsProperties": "recordsize=128K"},
+			problems:   []string{"zfs property recordsize cannot be set"},
+		},
+		{
+			name:       "invalid zfs property value",
+			parameters: map[string]string{"zfsProperties": "sync=sometimes"},
+			problems:   []string{"invalid value (sometimes) for volume property sync"},
+		},
+	}
+
+	for _, test := range tests {
+		config, err := parseParameters(test.parameters)
+		if len(test.problems) < 1 {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+				continue
+			}
+			if test.check != nil && !test.check(config) {
+				t.Errorf("%s: unexpected config %+v", test.name, config)
+			}
+			continue
+		}
+
+		e, ok := err.(*ParameterError)
+		if !ok {
+			t.Errorf("%s: expected a ParameterError, got %v", test.name, err)
+			continue
+		}
+		if len(e.Problems) != len(test.problems) {
+			t.Errorf("%s: expected %d problems, got %q", test.name, len(test.problems), e.Problems)
+		}
+		for _, problem := range test.problems {
+			if !strings.Contains(e.Error(), problem) {
+				t.Errorf("%s: expected problem %q, got %q", test.name, problem, e.Problems)
+			}
+		}
+	}
+}
+
+func TestParseParametersLenient(t *testing.T) {
+	config, err := parseParametersLenient("class", map[string]string{
+		"datasetParentName": "tank/k8s",
+		"zvolSparse":        "maybe",
+		"unknown":           "value",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.DatasetParentName != "tank/k8s" || !config.ZvolSparse {
+		t.Errorf("expected valid values applied and invalid ones left to their defaults, got %+v", config)
+	}
+}
+
+// existing volumes stay manageable when their StorageClass became invalid
+func TestGetConfigsStrictness(t *testing.T) {
+	server := newFakeFreenas(t)
+	class := &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "freenas-iscsi"},
+		Provisioner: "freenas.org/iscsi",
+		Parameters: map[string]string{
+			"datasetParentName": "tank/k8s",
+			"zvolSparse":        "maybe",
+		},
+	}
+	p := &freenasProvisioner{
+		Client: fake.NewSimpleClientset(class, server.secret("kube-system", "freenas-iscsi")),
+	}
+	ctx := context.Background()
+
+	if _, err := p.GetConfigs(ctx, class.Name, nil); err == nil {
+		t.Errorf("GetConfigs: expected the invalid parameter to fail provisioning")
+	}
+	if configs, err := p.getVolumeConfigs(ctx, class.Name); err != nil || len(configs) != 1 {
+		t.Errorf("getVolumeConfigs: expected one config, got %v, %v", configs, err)
+	}
+	if config, err := p.GetConfig(ctx, class.Name); err != nil || config.DatasetParentName != "tank/k8s" {
+		t.Errorf("GetConfig: expected the config of the class, got %v, %v", config, err)
+	}
+}